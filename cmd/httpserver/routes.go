@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/noelw19/tcptohttp/internal/decompress"
 	"github.com/noelw19/tcptohttp/internal/headers"
 	"github.com/noelw19/tcptohttp/internal/request"
 	"github.com/noelw19/tcptohttp/internal/response"
@@ -24,14 +25,18 @@ func wakandaPOSTHandler(w *response.Writer, req *request.Request) {
 }
 
 func wakandaIDHandler(w *response.Writer, req *request.Request) {
-	// Access the dynamic route parameters
-	id := req.Vars["id"]
+	// Access the dynamic route parameters, parsing the ones that aren't text
+	id, err := req.ParamInt("id")
+	if err != nil {
+		w.Respond(response.StatusBadRequest, []byte(err.Error()))
+		return
+	}
 	lala := req.Vars["lala"]
 
 	// You can also access query string parameters
 	// Example: /wakanda/123/abc?filter=active&sort=name
 	var result strings.Builder
-	result.WriteString(fmt.Sprintf("Wakanda ID: %s, Lala: %s", id, lala))
+	result.WriteString(fmt.Sprintf("Wakanda ID: %d, Lala: %s", id, lala))
 
 	if len(req.Params) > 0 {
 		result.WriteString("\nQuery params: ")
@@ -63,6 +68,9 @@ func queryHandler(w *response.Writer, req *request.Request) {
 	w.Respond(200, body)
 }
 
+// maxUpstreamBodySize caps what streamHandler relays from httpbin once decoded
+const maxUpstreamBodySize = 50 << 20
+
 func streamHandler(w *response.Writer, req *request.Request) {
 
 	target := req.RequestLine.RequestTarget
@@ -70,7 +78,18 @@ func streamHandler(w *response.Writer, req *request.Request) {
 	var status response.StatusCode
 	h := response.GetDefaultHeaders(0)
 
-	res, err := http.Get("https://httpbin.org/" + target[len("/httpbin/"):])
+	// Tied to the request context, so the upstream fetch stops if our client
+	// hangs up
+	upstream, err := http.NewRequestWithContext(req.Context(), "GET", "https://httpbin.org/"+target[len("/httpbin/"):], nil)
+	if err != nil {
+		w.Respond(response.StatusBadRequest, respond400())
+		return
+	}
+	// Asking for gzip ourselves turns off the client's transparent
+	// decompression, which has no size limit
+	upstream.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := http.DefaultClient.Do(upstream)
 	if err != nil {
 		body = respond500()
 		status = response.StatusInternalServerError
@@ -78,8 +97,15 @@ func streamHandler(w *response.Writer, req *request.Request) {
 
 		return
 	}
+	defer res.Body.Close()
+
+	decoded, err := decompress.NewReader(res.Body, res.Header.Get("Content-Encoding"), maxUpstreamBodySize)
+	if err != nil {
+		w.Respond(response.StatusBadGateway, []byte(response.GetStatusReason(response.StatusBadGateway)))
+		return
+	}
 	w.ReplaceHeader("content-type", "text/plain")
-	stream.Streamer(w, h, res.Body)
+	stream.Streamer(w, h, decoded)
 }
 
 func videoHandler(w *response.Writer, req *request.Request) {
@@ -68,8 +68,10 @@ func main() {
 		}
 
 		fmt.Printf("Request line:\n- Method: %s\n- Target: %s\n- Version: %s\nHeaders:\n", req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion)
-		for header := range req.Headers {
-			fmt.Printf("- %s: %s\n", header, req.Headers.Get(header))
+		for header, values := range req.Headers {
+			for _, value := range values {
+				fmt.Printf("- %s: %s\n", header, value)
+			}
 		}
 		fmt.Printf("Body:\n%s", string(req.Body))
 	}
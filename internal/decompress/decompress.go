@@ -0,0 +1,76 @@
+package decompress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrTooLarge = fmt.Errorf("decompressed body too large")
+var ErrUnsupportedEncoding = fmt.Errorf("unsupported content encoding")
+
+// NewReader returns a reader decoding r according to encoding, a
+// Content-Encoding value. "gzip", "x-gzip" and "deflate" are understood; ""
+// and "identity" pass r through as is.
+//
+// Reads fail with ErrTooLarge once the decoded output goes past limit bytes,
+// so a small payload that expands enormously (a zip bomb) is cut off instead
+// of exhausting memory or flooding a client. The check applies to identity
+// bodies too.
+func NewReader(r io.Reader, encoding string, limit int64) (io.ReadCloser, error) {
+	if !Supported(encoding) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	var decoder io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		decoder = io.NopCloser(r)
+	case "gzip", "x-gzip":
+		decoder, err = gzip.NewReader(r)
+	case "deflate":
+		decoder, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReader{ReadCloser: decoder, remaining: limit}, nil
+}
+
+// Supported reports whether NewReader can decode encoding, without needing
+// any of the data.
+func Supported(encoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity", "gzip", "x-gzip", "deflate":
+		return true
+	}
+	return false
+}
+
+// limitedReader fails with ErrTooLarge instead of stopping quietly at the
+// limit, the way io.LimitReader does
+type limitedReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// At the limit, the body is fine only if nothing is left
+		var probe [1]byte
+		n, err := l.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return 0, ErrTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
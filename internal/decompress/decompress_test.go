@@ -0,0 +1,68 @@
+package decompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	require.NoError(t, err)
+	gw.Write(data)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestNewReaderBomb(t *testing.T) {
+	bomb := gzipBytes(t, make([]byte, 100<<20))
+	require.Less(t, len(bomb), 200<<10)
+
+	r, err := NewReader(bytes.NewReader(bomb), "gzip", 1<<20)
+	require.NoError(t, err)
+	defer r.Close()
+
+	n, err := io.Copy(io.Discard, r)
+	require.ErrorIs(t, err, ErrTooLarge)
+	assert.Equal(t, int64(1<<20), n)
+}
+
+func TestNewReaderWithinLimit(t *testing.T) {
+	plain := []byte(strings.Repeat("hello\n", 100))
+
+	// Test: Exactly at the limit is fine
+	r, err := NewReader(bytes.NewReader(gzipBytes(t, plain)), "x-gzip", int64(len(plain)))
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, plain, got)
+
+	// Test: deflate
+	var zl bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	zw.Write(plain)
+	zw.Close()
+	r, err = NewReader(&zl, "Deflate", 1<<20)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, plain, got)
+
+	// Test: Identity bodies are still held to the limit
+	r, err = NewReader(bytes.NewReader(plain), "", 10)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.ErrorIs(t, err, ErrTooLarge)
+
+	// Test: Unknown encodings
+	_, err = NewReader(bytes.NewReader(plain), "br", 1<<20)
+	require.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
@@ -1,7 +1,10 @@
 package handler
 
 import (
+	"fmt"
+	"mime"
 	"slices"
+	"strings"
 
 	"github.com/noelw19/tcptohttp/internal/middleware.go"
 	"github.com/noelw19/tcptohttp/internal/request"
@@ -11,10 +14,14 @@ import (
 type AllowedMethod string
 
 const (
-	GET    AllowedMethod = "GET"
-	POST   AllowedMethod = "POST"
-	PATCH  AllowedMethod = "PATCH"
-	DELETE AllowedMethod = "DELETE"
+	GET     AllowedMethod = "GET"
+	POST    AllowedMethod = "POST"
+	PUT     AllowedMethod = "PUT"
+	PATCH   AllowedMethod = "PATCH"
+	DELETE  AllowedMethod = "DELETE"
+	HEAD    AllowedMethod = "HEAD"
+	OPTIONS AllowedMethod = "OPTIONS"
+	TRACE   AllowedMethod = "TRACE"
 )
 
 type Params map[string]string
@@ -29,6 +36,12 @@ type Handler struct {
 	Vars           Vars
 	Params         Params
 	middlewares    []middleware.MiddlewareHandler
+	produces       map[*HandlerFunc][]string
+	variants       map[AllowedMethod][]*HandlerFunc
+	pattern        *routePattern // Compiled form of dynamic routes, nil for static ones
+	methodFallback *HandlerFunc  // Runs for methods the route has no func for
+	accepts        []string      // Content types request bodies may have, nil for any
+	table          Handlers      // The routes it was added alongside, for spotting conflicts
 }
 
 func NewHandler(route string, hf HandlerFunc) Handler {
@@ -46,7 +59,9 @@ func NewHandler(route string, hf HandlerFunc) Handler {
 }
 
 func (h *Handler) ExecuteMiddlewares(w *response.Writer, r *request.Request, final middleware.MiddlewareFunc) middleware.MiddlewareFunc {
+	routesMu.RLock()
 	middlewares := slices.Clone(h.middlewares)
+	routesMu.RUnlock()
 	slices.Reverse(middlewares)
 	finalHandler := middleware.MiddlewareFunc(final)
 
@@ -58,26 +73,315 @@ func (h *Handler) ExecuteMiddlewares(w *response.Writer, r *request.Request, fin
 }
 
 func (h *Handler) Use(m middleware.MiddlewareHandler) *Handler {
+	routesMu.Lock()
+	defer routesMu.Unlock()
 	h.middlewares = append(h.middlewares, m)
 	return h
 }
 
-func (h *Handler) GET() *Handler {
-	h.MethodFuncs[GET] = h.HandleFunc
+// Produces declares the content types the handler func just added can
+// respond with. A route can be added several times with different funcs and
+// Produces types; the server then runs the one matching the request's Accept
+// header, and answers 406 Not Acceptable when none do.
+func (h *Handler) Produces(types ...string) *Handler {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	if h.produces == nil {
+		h.produces = map[*HandlerFunc][]string{}
+	}
+	h.produces[h.HandleFunc] = append(h.produces[h.HandleFunc], types...)
 	return h
 }
 
-func (h *Handler) POST() *Handler {
-	h.MethodFuncs[POST] = h.HandleFunc
+// Accept limits the request bodies the route takes to the given content
+// types, e.g. Accept("application/json") for a webhook. The server answers
+// requests with a body of any other type, or none stated, with 415
+// Unsupported Media Type before middleware or the handler run. Types can end
+// in "/*" to take a whole family, like "image/*". Requests without a body
+// aren't checked.
+func (h *Handler) Accept(types ...string) *Handler {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	for _, t := range types {
+		h.accepts = append(h.accepts, strings.ToLower(strings.TrimSpace(t)))
+	}
 	return h
 }
 
-func (h *Handler) PATCH() *Handler {
-	h.MethodFuncs[PATCH] = h.HandleFunc
+// AcceptsBody reports whether a request body of contentType, a Content-Type
+// header value, is one the route takes. Routes without Accept take anything.
+func (h *Handler) AcceptsBody(contentType string) bool {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	if len(h.accepts) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	for _, t := range h.accepts {
+		if t == mediaType || t == mainType+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns the pattern the handler was registered under, such as
+// "/users/{id}".
+func (h *Handler) Route() string {
+	return h.route
+}
+
+// ProducedTypes returns every content type declared with Produces on the route.
+func (h *Handler) ProducedTypes() []string {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	var types []string
+	for _, produced := range h.produces {
+		for _, t := range produced {
+			if !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+	}
+	return types
+}
+
+// ErrNotAcceptable is returned by SelectVariant when the route produces none
+// of the content types the client accepts.
+var ErrNotAcceptable = fmt.Errorf("Not acceptable")
+
+// SelectVariant picks the func to run for method out of those registered on
+// the route. negotiate is given the content types they produce and returns the
+// one to serve, or "" if none is acceptable. Funcs without declared types are
+// used when nothing else is acceptable. contentType is empty when no
+// negotiated type applies.
+func (h *Handler) SelectVariant(method AllowedMethod, negotiate func(offers []string) string) (hf HandlerFunc, contentType string, err error) {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	candidates := h.variants[method]
+	if len(candidates) == 0 && method == HEAD {
+		candidates = h.variants[GET]
+	}
+	if len(candidates) == 0 {
+		if hf := h.funcFor(method); hf != nil {
+			candidates = []*HandlerFunc{hf}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, "", ErrNotAcceptable
+	}
+
+	var offers []string
+	var fallback *HandlerFunc
+	for _, c := range candidates {
+		produced := h.produces[c]
+		if len(produced) == 0 {
+			fallback = c
+		}
+		for _, t := range produced {
+			if !slices.Contains(offers, t) {
+				offers = append(offers, t)
+			}
+		}
+	}
+
+	if len(offers) == 0 {
+		// Nothing to negotiate, the latest func registered for method wins
+		return *candidates[len(candidates)-1], "", nil
+	}
+
+	if contentType = negotiate(offers); contentType != "" {
+		for _, c := range candidates {
+			if slices.Contains(h.produces[c], contentType) {
+				return *c, contentType, nil
+			}
+		}
+	}
+	if fallback != nil {
+		return *fallback, "", nil
+	}
+	return nil, "", ErrNotAcceptable
+}
+
+// register records the current func as a variant for method
+func (h *Handler) register(method AllowedMethod) *Handler {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	h.checkConflict(method)
+	h.MethodFuncs[method] = h.HandleFunc
+	if !slices.Contains(h.AllowedMethods, method) {
+		h.AllowedMethods = append(h.AllowedMethods, method)
+	}
+	if h.variants == nil {
+		h.variants = map[AllowedMethod][]*HandlerFunc{}
+	}
+	if !slices.Contains(h.variants[method], h.HandleFunc) {
+		h.variants[method] = append(h.variants[method], h.HandleFunc)
+	}
 	return h
 }
 
+// bound reports whether hf was registered for a method. It is for callers
+// holding routesMu.
+func (h *Handler) bound(hf *HandlerFunc) bool {
+	for _, funcs := range h.variants {
+		if slices.Contains(funcs, hf) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConflict panics if registering the current func for method leaves
+// two funcs claiming the same requests, which would otherwise be settled
+// silently by whichever came last: another func for method on the route, unless
+// one of them declares what it Produces, or a dynamic route of the same shape,
+// like "/a/{x}" next to "/a/{y}", taking method too.
+func (h *Handler) checkConflict(method AllowedMethod) {
+	for _, existing := range h.variants[method] {
+		if existing != h.HandleFunc && len(h.produces[existing]) == 0 && len(h.produces[h.HandleFunc]) == 0 {
+			panic(fmt.Sprintf("Route %s already has a %s handler", h.route, method))
+		}
+	}
+	if h.pattern == nil {
+		return
+	}
+	for _, other := range h.table {
+		if other != h && other.pattern != nil && other.pattern.shape == h.pattern.shape && slices.Contains(other.AllowedMethods, method) {
+			panic(fmt.Sprintf("Route %s conflicts with %s for %s", h.route, other.route, method))
+		}
+	}
+}
+
+func (h *Handler) GET() *Handler {
+	return h.register(GET)
+}
+
+func (h *Handler) POST() *Handler {
+	return h.register(POST)
+}
+
+func (h *Handler) PUT() *Handler {
+	return h.register(PUT)
+}
+
+func (h *Handler) PATCH() *Handler {
+	return h.register(PATCH)
+}
+
 func (h *Handler) DELETE() *Handler {
-	h.MethodFuncs[DELETE] = h.HandleFunc
+	return h.register(DELETE)
+}
+
+// HEAD registers a dedicated HEAD handler, for routes where working out the
+// headers is much cheaper than producing the body. It can set Content-Length
+// itself and respond with no body. Routes without one answer HEAD by running
+// their GET handler with the body discarded.
+func (h *Handler) HEAD() *Handler {
+	return h.register(HEAD)
+}
+
+// OPTIONS registers an OPTIONS handler in place of the automatic one, which
+// answers 204 No Content with the route's methods in an Allow header.
+func (h *Handler) OPTIONS() *Handler {
+	return h.register(OPTIONS)
+}
+
+// TRACE registers a TRACE handler. Routes don't answer TRACE unless they
+// register one, since echoing requests back can leak credentials to scripts.
+func (h *Handler) TRACE() *Handler {
+	return h.register(TRACE)
+}
+
+// MethodFallback sets the func run when the path matches but the request's
+// method has no func registered, e.g. to tell the client which methods to use
+// instead. The response already carries an Allow header listing the route's
+// methods when fn runs, and fn sees them in AllowedMethods too.
+func (h *Handler) MethodFallback(fn HandlerFunc) *Handler {
+	fallback := HandlerFunc(func(w *response.Writer, req *request.Request) {
+		w.ReplaceHeader("allow", h.allow())
+		fn(w, req)
+	})
+	routesMu.Lock()
+	h.methodFallback = &fallback
+	routesMu.Unlock()
 	return h
 }
+
+// allow lists the route's methods for an Allow header. HEAD is included
+// whenever GET is, since GET funcs answer HEAD requests too, and OPTIONS
+// always is as it is answered automatically. It is for handler funcs, which
+// run without routesMu held.
+func (h *Handler) allow() string {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	return strings.Join(h.allowed(), ", ")
+}
+
+// allowed is the list allow joins, for callers already holding routesMu
+func (h *Handler) allowed() []string {
+	// The registered methods come in the order they were added, then HEAD
+	// and OPTIONS, whether registered or implied, always in that order
+	methods := make([]string, 0, len(h.AllowedMethods)+2)
+	for _, m := range h.AllowedMethods {
+		if m != HEAD && m != OPTIONS {
+			methods = append(methods, string(m))
+		}
+	}
+	if slices.Contains(h.AllowedMethods, GET) || slices.Contains(h.AllowedMethods, HEAD) {
+		methods = append(methods, string(HEAD))
+	}
+	return append(methods, string(OPTIONS))
+}
+
+// registered lists the methods with a func in MethodFuncs, in the order they
+// were added. Unlike allow it leaves out the methods only implied, HEAD for a
+// GET route and the automatic OPTIONS.
+func (h *Handler) registered() string {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	methods := make([]string, 0, len(h.MethodFuncs))
+	for _, m := range h.AllowedMethods {
+		if _, ok := h.MethodFuncs[m]; ok {
+			methods = append(methods, string(m))
+		}
+	}
+	return strings.Join(methods, ", ")
+}
+
+// autoOptions answers an OPTIONS request with 204 No Content and the route's
+// registered methods in an Allow header. It runs at the end of the middleware
+// chain like any handler func, so middleware answering OPTIONS itself, such
+// as middleware.CORS with a preflight request, goes first.
+func (h *Handler) autoOptions() *HandlerFunc {
+	hf := HandlerFunc(func(w *response.Writer, req *request.Request) {
+		w.ReplaceHeader("allow", h.registered())
+		w.WriteStatus(response.StatusNoContent)
+	})
+	return &hf
+}
+
+// funcFor returns the func to run for method: the one registered for it,
+// the GET one for HEAD requests, autoOptions for OPTIONS requests or the
+// method fallback if one is set. It is nil when the route has methods but
+// none of those apply. Routes registered without any methods run their
+// latest func for every method.
+func (h *Handler) funcFor(method AllowedMethod) *HandlerFunc {
+	if hf, ok := h.MethodFuncs[method]; ok {
+		return hf
+	}
+	if hf, ok := h.MethodFuncs[GET]; ok && method == HEAD {
+		return hf
+	}
+	if method == OPTIONS && len(h.MethodFuncs) > 0 {
+		return h.autoOptions()
+	}
+	if len(h.MethodFuncs) > 0 {
+		return h.methodFallback
+	}
+	return h.HandleFunc
+}
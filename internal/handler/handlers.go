@@ -2,15 +2,23 @@ package handler
 
 import (
 	"fmt"
-	"maps"
 	"strings"
+	"sync"
 )
 
 type Handlers map[string]*Handler
 
-// MatchResult contains the matched handler and extracted path variables
+// routesMu guards every route table and the routes in it, so routes can be
+// added, or configured through the builders chained after Add, while the
+// server is matching requests against them. Methods taking it never call out
+// to code that could add a route while it is held.
+var routesMu sync.RWMutex
+
+// MatchResult contains the matched handler and extracted path variables.
+// Handler is the route as registered, so its middleware and settings are the
+// ones it was given.
 type MatchResult struct {
-	Handler     Handler
+	Handler     *Handler
 	HandlerFunc HandlerFunc
 	Vars        Vars
 }
@@ -20,104 +28,166 @@ func (h Handlers) Match(route string, method AllowedMethod) (*Handler, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &result.Handler, nil
+	return result.Handler, nil
 }
 
+// ErrMethodNotAllowed is returned, as a *MethodNotAllowedError, when the
+// path matches a route that has no func for the request's method.
+var ErrMethodNotAllowed = fmt.Errorf("Method not allowed")
+
+// MethodNotAllowedError is the error MatchWithVars returns when the path is
+// known but the method isn't. Allowed lists the methods the route does take,
+// ready for an Allow header.
+type MethodNotAllowedError struct {
+	Allowed []string
+}
+
+func (e *MethodNotAllowedError) Error() string {
+	return fmt.Sprintf("%s, allowed: %s", ErrMethodNotAllowed, strings.Join(e.Allowed, ", "))
+}
+
+func (e *MethodNotAllowedError) Unwrap() error {
+	return ErrMethodNotAllowed
+}
+
+// MatchWithVars finds the route for path and method. A path matching a route
+// without a func for method fails with a *MethodNotAllowedError, unless a
+// dynamic route matching the path takes the method; paths matching no route
+// at all fail with a plain error.
 func (h Handlers) MatchWithVars(route string, method AllowedMethod) (*MatchResult, error) {
 	if route == "" {
 		return nil, fmt.Errorf("Empty route when trying to match")
 	}
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+
+	// The most specific route matching the path, in case none takes method
+	var known *Handler
 
 	// First, try exact matches (static routes)
 	if handler, ok := h[route]; ok {
-		keys := maps.Keys(handler.MethodFuncs)
-		for iter := range keys {
-			if iter == method {
-				hf := handler.MethodFuncs[method]
-				return &MatchResult{HandlerFunc: *hf, Handler: *handler, Vars: make(Vars)}, nil
-			}
-		}
-		if handler.HandleFunc != nil {
-			return &MatchResult{HandlerFunc: *handler.HandleFunc, Handler: *handler, Vars: make(Vars)}, nil
+		if hf := handler.funcFor(method); hf != nil {
+			return &MatchResult{HandlerFunc: *hf, Handler: handler, Vars: make(Vars)}, nil
 		}
+		known = handler
 	}
 
-	// Then, try dynamic route matching
-	for routePath, handler := range h {
-		if !strings.Contains(routePath, "{") {
+	// Then, try dynamic route matching, picking the most specific pattern
+	// when several match
+	var best *Handler
+	for _, handler := range h {
+		if handler.pattern == nil {
 			continue // Skip static routes, already checked above
 		}
 
-		vars, matched := matchDynamicRoute(routePath, route)
-		if matched {
-			keys := maps.Keys(handler.MethodFuncs)
-			for iter := range keys {
-				if iter == method {
-					hf := handler.MethodFuncs[method]
-					return &MatchResult{HandlerFunc: *hf, Handler: *handler, Vars: vars}, nil
-				}
-			}
-			if handler.HandleFunc != nil {
-				return &MatchResult{HandlerFunc: *handler.HandleFunc, Handler: *handler, Vars: vars}, nil
+		if handler.pattern.matches(route) && (best == nil || handler.pattern.moreSpecific(best.pattern)) {
+			best = handler
+		}
+	}
+
+	if best != nil {
+		if hf := best.funcFor(method); hf != nil {
+			vars, err := best.pattern.vars(route)
+			if err != nil {
+				return nil, err
 			}
+			return &MatchResult{HandlerFunc: *hf, Handler: best, Vars: vars}, nil
+		}
+		if known == nil {
+			known = best
 		}
 	}
 
+	if known != nil {
+		return nil, &MethodNotAllowedError{Allowed: known.allowed()}
+	}
 	return nil, fmt.Errorf("No route match found")
 }
 
-// matchDynamicRoute matches a route pattern (e.g., "/wakanda/{id}") against an actual route (e.g., "/wakanda/123")
-// Returns the extracted variables and whether there was a match
-func matchDynamicRoute(pattern, actualRoute string) (Vars, bool) {
-	vars := make(Vars)
-
-	// Split both pattern and actual route into segments
-	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
-	actualParts := strings.Split(strings.Trim(actualRoute, "/"), "/")
+func (h Handlers) Add(route string, hf HandlerFunc) *Handler {
+	return h.AddWith(route, hf, nil)
+}
 
-	// Must have same number of segments
-	if len(patternParts) != len(actualParts) {
-		return vars, false
+// AddWith adds a route like Add, but hands it to configure to set its
+// methods, middleware and the like before requests can match it. A route
+// added with Add while the server is running is matched as soon as it is
+// added, before the builders chained after it have run: until then it takes
+// every method and has no middleware. configure closes that gap.
+//
+//	h.AddWith("/admin/{id}", admin, func(r *Handler) {
+//		r.Use(requireAuth).GET()
+//	})
+//
+// Adding a func to a route already there changes the live route, configure
+// then runs on it as the chained builders would.
+func (h Handlers) AddWith(route string, hf HandlerFunc, configure func(h *Handler)) *Handler {
+	handle, isNew := h.prepare(route, hf)
+	if configure != nil {
+		configure(handle)
 	}
-
-	// Match each segment
-	for i, patternPart := range patternParts {
-		actualPart := actualParts[i]
-
-		// Check if this is a parameter segment (e.g., "{id}")
-		if strings.HasPrefix(patternPart, "{") && strings.HasSuffix(patternPart, "}") {
-			// Extract parameter name (remove { and })
-			paramName := strings.TrimSuffix(strings.TrimPrefix(patternPart, "{"), "}")
-			if paramName == "" {
-				return vars, false // Invalid parameter name
-			}
-			vars[paramName] = actualPart
-		} else if patternPart != actualPart {
-			// Static segment doesn't match
-			return vars, false
+	if isNew {
+		routesMu.Lock()
+		defer routesMu.Unlock()
+		if _, ok := h[route]; ok {
+			panic(fmt.Sprintf("Route %s was added twice at the same time", route))
 		}
+		h[route] = handle
 	}
-
-	return vars, true
+	return handle
 }
 
-func (h Handlers) Add(route string, hf HandlerFunc) *Handler {
+// prepare sets hf as the func of the route already added for route, or
+// returns a new route for it that isn't in the table yet
+func (h Handlers) prepare(route string, hf HandlerFunc) (handle *Handler, isNew bool) {
 	if route == "" {
 		panic("Empty route when trying to add handler")
 	}
-
-	if _, ok := h[route]; ok {
-		h[route].HandleFunc = &hf
-	} else {
-		handle := &Handler{
-			route:          route,
-			HandleFunc:     &hf,
-			MethodFuncs:    map[AllowedMethod]*HandlerFunc{},
-			AllowedMethods: []AllowedMethod{},
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	if existing, ok := h[route]; ok {
+		// Only the latest func is kept for methods to be bound to, one not
+		// bound yet would be lost without a trace
+		if !existing.bound(existing.HandleFunc) {
+			panic(fmt.Sprintf("Route %s added again before its handler was given a method, it would never run", route))
 		}
+		existing.HandleFunc = &hf
+		return existing, false
+	}
 
-		h[route] = handle
+	handle = &Handler{
+		route:          route,
+		HandleFunc:     &hf,
+		MethodFuncs:    map[AllowedMethod]*HandlerFunc{},
+		AllowedMethods: []AllowedMethod{},
+		table:          h,
+	}
+	if strings.Contains(route, "{") {
+		handle.pattern = compilePattern(route)
+	}
+	return handle, true
+}
 
+// Each calls fn for every route, with the route table locked so it can't
+// change meanwhile. fn must not add or configure routes.
+func (h Handlers) Each(fn func(route string, handler *Handler)) {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	for route, handler := range h {
+		fn(route, handler)
+	}
+}
+
+// Validate panics if a route has a func that can never run: one added after
+// others were given methods, without any method of its own. Add catches a
+// func replaced before it was given one; this catches the last one added,
+// and the server calls it when it starts listening.
+func (h Handlers) Validate() {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	for route, handler := range h {
+		if len(handler.MethodFuncs) > 0 && !handler.bound(handler.HandleFunc) {
+			panic(fmt.Sprintf("Route %s has a handler added without a method, it would never run", route))
+		}
 	}
-	return h[route]
 }
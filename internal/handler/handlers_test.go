@@ -0,0 +1,560 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/noelw19/tcptohttp/internal/middleware.go"
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+func noop(w *response.Writer, req *request.Request) {}
+
+// benchmarkHandlers is a route table with a mix of static and dynamic routes
+func benchmarkHandlers() Handlers {
+	h := Handlers{}
+	h.Add("/", noop).GET()
+	h.Add("/users", noop).GET()
+	h.Add("/users/{id}", noop).GET()
+	h.Add("/users/{id}/posts", noop).GET()
+	h.Add("/users/{id}/posts/{postId}", noop).GET()
+	h.Add("/wakanda/{id}/{lala}", noop).GET()
+	h.Add("/files/{name}/download", noop).GET()
+	return h
+}
+
+func BenchmarkMatchDynamicRoute(b *testing.B) {
+	h := benchmarkHandlers()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := h.MatchWithVars("/users/42/posts/7", GET); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMatchDynamicRoute(t *testing.T) {
+	h := benchmarkHandlers()
+
+	cases := []struct {
+		route string
+		vars  Vars
+	}{
+		{"/users/42", Vars{"id": "42"}},
+		{"/users/42/", Vars{"id": "42"}},
+		{"/users/42/posts", Vars{"id": "42"}},
+		{"/users/42/posts/7", Vars{"id": "42", "postId": "7"}},
+		{"/files/report.pdf/download", Vars{"name": "report.pdf"}},
+	}
+	for _, c := range cases {
+		res, err := h.MatchWithVars(c.route, GET)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", c.route, err)
+		}
+		if len(res.Vars) != len(c.vars) {
+			t.Fatalf("%s: got vars %v, want %v", c.route, res.Vars, c.vars)
+		}
+		for k, v := range c.vars {
+			if res.Vars[k] != v {
+				t.Errorf("%s: var %s = %q, want %q", c.route, k, res.Vars[k], v)
+			}
+		}
+	}
+
+	for _, route := range []string{"/users/42/posts/7/extra", "/files/x/upload", "/wakanda/1"} {
+		if _, err := h.MatchWithVars(route, GET); err == nil {
+			t.Errorf("%s: expected no match", route)
+		}
+	}
+}
+
+func TestOptionalSegment(t *testing.T) {
+	h := Handlers{}
+	h.Add("/posts/{id}/{section?}", noop).GET()
+
+	res, err := h.MatchWithVars("/posts/5", GET)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if res.Vars["id"] != "5" {
+		t.Errorf("id = %q, want %q", res.Vars["id"], "5")
+	}
+	if _, ok := res.Vars["section"]; ok {
+		t.Errorf("section should be unset, got %q", res.Vars["section"])
+	}
+
+	res, err = h.MatchWithVars("/posts/5/comments", GET)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if res.Vars["id"] != "5" || res.Vars["section"] != "comments" {
+		t.Errorf("got vars %v", res.Vars)
+	}
+
+	if _, err := h.MatchWithVars("/posts", GET); err == nil {
+		t.Error("/posts: the required id segment should still be required")
+	}
+	if _, err := h.MatchWithVars("/posts/5/comments/9", GET); err == nil {
+		t.Error("/posts/5/comments/9: expected no match")
+	}
+}
+
+func TestOptionalSegmentPrecedence(t *testing.T) {
+	hit := ""
+	h := Handlers{}
+	h.Add("/posts/{id}/{section?}", func(w *response.Writer, req *request.Request) { hit = "optional" }).GET()
+	h.Add("/posts/{id}/comments", func(w *response.Writer, req *request.Request) { hit = "comments" }).GET()
+	h.Add("/posts/{id}", func(w *response.Writer, req *request.Request) { hit = "id" }).GET()
+
+	// Run a few times so map iteration order can't hide a wrong choice
+	for range 20 {
+		for route, want := range map[string]string{
+			"/posts/5":          "id",
+			"/posts/5/comments": "comments",
+			"/posts/5/likes":    "optional",
+		} {
+			res, err := h.MatchWithVars(route, GET)
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", route, err)
+			}
+			res.HandlerFunc(nil, nil)
+			if hit != want {
+				t.Fatalf("%s: matched %q, want %q", route, hit, want)
+			}
+		}
+	}
+}
+
+func TestOptionalSegmentMustBeTrailing(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a required segment after an optional one")
+		}
+	}()
+	Handlers{}.Add("/posts/{id?}/comments", noop)
+}
+
+func TestCatchAllSegment(t *testing.T) {
+	hit := ""
+	h := Handlers{}
+	h.Add("/files/{path...}", func(w *response.Writer, req *request.Request) { hit = "files" }).GET()
+	h.Add("/files/readme", func(w *response.Writer, req *request.Request) { hit = "readme" }).GET()
+	h.Add("/files/{name}/info", func(w *response.Writer, req *request.Request) { hit = "info" }).GET()
+
+	for range 20 {
+		for route, want := range map[string]struct{ hit, path string }{
+			"/files/a/b/c":       {"files", "a/b/c"},
+			"/files/a":           {"files", "a"},
+			"/files/a%2Fb/c%20d": {"files", "a/b/c d"},
+			"/files/":            {"files", ""},
+			"/files/readme":      {"readme", ""},
+			"/files/x/info":      {"info", ""},
+		} {
+			res, err := h.MatchWithVars(route, GET)
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", route, err)
+			}
+			res.HandlerFunc(nil, nil)
+			if hit != want.hit {
+				t.Fatalf("%s: matched %q, want %q", route, hit, want.hit)
+			}
+			if want.hit == "files" && res.Vars["path"] != want.path {
+				t.Errorf("%s: path = %q, want %q", route, res.Vars["path"], want.path)
+			}
+		}
+	}
+
+	if _, err := h.MatchWithVars("/images/a", GET); err == nil {
+		t.Error("/images/a: expected no match")
+	}
+}
+
+func TestCatchAllMustBeLast(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a segment after a catch-all")
+		}
+	}()
+	compilePattern("/files/{path...}/raw")
+}
+
+func TestDuplicateStaticRoute(t *testing.T) {
+	h := Handlers{}
+	h.Add("/health", func(w *response.Writer, req *request.Request) {}).GET()
+	// Another method, or a variant declaring what it Produces, is no conflict
+	h.Add("/health", func(w *response.Writer, req *request.Request) {}).POST()
+	h.Add("/health", func(w *response.Writer, req *request.Request) {}).Produces("application/json").GET()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a second GET handler on /health")
+		}
+	}()
+	h.Add("/health", func(w *response.Writer, req *request.Request) {}).GET()
+}
+
+func TestAddUnboundTwice(t *testing.T) {
+	h := Handlers{}
+	h.Add("/x", func(w *response.Writer, req *request.Request) {})
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for replacing a handler never given a method")
+		}
+	}()
+	h.Add("/x", func(w *response.Writer, req *request.Request) {})
+}
+
+func TestAddWithoutMethodAfterBound(t *testing.T) {
+	h := Handlers{}
+	h.Add("/x", func(w *response.Writer, req *request.Request) {}).GET()
+	h.Add("/x", func(w *response.Writer, req *request.Request) {})
+
+	// Test: Found when the route table is validated
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Validate to panic for a handler without a method")
+			}
+		}()
+		h.Validate()
+	}()
+
+	// Test: Or as soon as the route is added again
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for replacing a handler never given a method")
+		}
+	}()
+	h.Add("/x", func(w *response.Writer, req *request.Request) {}).POST()
+}
+
+func TestValidate(t *testing.T) {
+	h := Handlers{}
+	h.Add("/any", func(w *response.Writer, req *request.Request) {})
+	h.Add("/x", func(w *response.Writer, req *request.Request) {}).GET()
+	h.Add("/x", func(w *response.Writer, req *request.Request) {}).POST()
+	h.Validate()
+}
+
+func TestAddWith(t *testing.T) {
+	h := Handlers{}
+	var seen []string
+	mw := func(next middleware.MiddlewareFunc) middleware.MiddlewareFunc { return next }
+
+	handle := h.AddWith("/late/{id}", noop, func(r *Handler) {
+		// Test: Not matched while it is being set up
+		if _, err := h.MatchWithVars("/late/1", POST); err == nil {
+			t.Error("expected the route to be unmatched before configure returns")
+		}
+		h.Each(func(route string, _ *Handler) { seen = append(seen, route) })
+		r.Use(mw).GET()
+	})
+
+	if len(seen) != 0 {
+		t.Errorf("expected the route table to be empty during configure, got %v", seen)
+	}
+	res, err := h.MatchWithVars("/late/1", GET)
+	if err != nil {
+		t.Fatalf("MatchWithVars: %v", err)
+	}
+	if res.Handler != handle || len(handle.middlewares) != 1 {
+		t.Errorf("expected the configured route, got %+v", res.Handler)
+	}
+	if _, err := h.MatchWithVars("/late/1", POST); !errors.Is(err, ErrMethodNotAllowed) {
+		t.Errorf("expected 405 for POST, got %v", err)
+	}
+}
+
+func TestDuplicateDynamicRoute(t *testing.T) {
+	h := Handlers{}
+	h.Add("/a/{x}", func(w *response.Writer, req *request.Request) {}).GET()
+	h.Add("/a/{y}", func(w *response.Writer, req *request.Request) {}).POST()
+	// Shapes differing in a literal or in the kind of segment don't clash
+	h.Add("/a/{x}/b", func(w *response.Writer, req *request.Request) {}).GET()
+	h.Add("/a/{x?}", func(w *response.Writer, req *request.Request) {}).GET()
+	h.Add("/a/{x...}", func(w *response.Writer, req *request.Request) {}).GET()
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("expected a panic for /a/{y} taking GET from /a/{x}")
+		}
+		if msg := fmt.Sprint(r); !strings.Contains(msg, "/a/{x}") || !strings.Contains(msg, "/a/{y}") {
+			t.Errorf("panic %q should name both routes", msg)
+		}
+	}()
+	h.Add("/a/{y}", func(w *response.Writer, req *request.Request) {}).GET()
+}
+
+func TestMethodFallback(t *testing.T) {
+	hit := ""
+	h := Handlers{}
+	h.Add("/orders/{id}", func(w *response.Writer, req *request.Request) { hit = "get" }).GET()
+	h.Add("/orders/{id}", func(w *response.Writer, req *request.Request) { hit = "delete" }).DELETE().
+		MethodFallback(func(w *response.Writer, req *request.Request) {
+			hit = "fallback"
+			w.Respond(response.StatusMethodNotAllowed, []byte("use GET or DELETE"))
+		})
+
+	for method, want := range map[AllowedMethod]string{GET: "get", HEAD: "get", DELETE: "delete", POST: "fallback", PATCH: "fallback"} {
+		hit = ""
+		res, err := h.MatchWithVars("/orders/7", method)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", method, err)
+		}
+		buf := &bytes.Buffer{}
+		res.HandlerFunc(response.NewResponseWriter(buf), nil)
+		if hit != want {
+			t.Errorf("%s: ran %q, want %q", method, hit, want)
+		}
+		if want == "fallback" && !strings.Contains(buf.String(), "Allow: GET, DELETE, HEAD, OPTIONS\r\n") {
+			t.Errorf("%s: no Allow header in %q", method, buf.String())
+		}
+	}
+
+	// Test: Routes without a fallback don't take other methods
+	h.Add("/carts", func(w *response.Writer, req *request.Request) { hit = "carts" }).GET()
+	_, err := h.MatchWithVars("/carts", POST)
+	var notAllowed *MethodNotAllowedError
+	if !errors.As(err, &notAllowed) || !errors.Is(err, ErrMethodNotAllowed) {
+		t.Fatalf("expected a MethodNotAllowedError, got %v", err)
+	}
+	if strings.Join(notAllowed.Allowed, ", ") != "GET, HEAD, OPTIONS" {
+		t.Errorf("Allowed = %v", notAllowed.Allowed)
+	}
+
+	// Test: Routes registered without methods still run for any
+	h.Add("/any", func(w *response.Writer, req *request.Request) { hit = "any" })
+	hit = ""
+	res, err := h.MatchWithVars("/any", POST)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res.HandlerFunc(nil, nil)
+	if hit != "any" {
+		t.Errorf("ran %q, want the route's func", hit)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	h := Handlers{}
+	h.Add("/users/me", noop).GET()
+	h.Add("/users/{id}", noop).GET().DELETE()
+
+	// Test: A known static path with the wrong method
+	_, err := h.MatchWithVars("/users/me", POST)
+	var notAllowed *MethodNotAllowedError
+	if !errors.As(err, &notAllowed) {
+		t.Fatalf("expected a MethodNotAllowedError, got %v", err)
+	}
+	if strings.Join(notAllowed.Allowed, ", ") != "GET, HEAD, OPTIONS" {
+		t.Errorf("Allowed = %v", notAllowed.Allowed)
+	}
+
+	// Test: A dynamic route matching the path can still take the method
+	res, err := h.MatchWithVars("/users/me", DELETE)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if res.Handler.Route() != "/users/{id}" {
+		t.Errorf("matched %q", res.Handler.Route())
+	}
+
+	// Test: Dynamic routes with the wrong method
+	_, err = h.MatchWithVars("/users/7", PATCH)
+	if !errors.As(err, &notAllowed) {
+		t.Fatalf("expected a MethodNotAllowedError, got %v", err)
+	}
+	if strings.Join(notAllowed.Allowed, ", ") != "GET, DELETE, HEAD, OPTIONS" {
+		t.Errorf("Allowed = %v", notAllowed.Allowed)
+	}
+
+	// Test: Unknown paths aren't a method problem
+	_, err = h.MatchWithVars("/orders", POST)
+	if err == nil || errors.Is(err, ErrMethodNotAllowed) {
+		t.Errorf("expected a no match error, got %v", err)
+	}
+}
+
+func TestMatchDecodesVars(t *testing.T) {
+	h := benchmarkHandlers()
+
+	cases := []struct {
+		route string
+		vars  Vars
+	}{
+		{"/wakanda/hello%20world/x", Vars{"id": "hello world", "lala": "x"}},
+		{"/files/a%2Fb.txt/download", Vars{"name": "a/b.txt"}},
+		{"/files/%252F/download", Vars{"name": "%2F"}},
+		{"/users/caf%C3%A9", Vars{"id": "café"}},
+		{"/users/a+b", Vars{"id": "a+b"}},
+	}
+	for _, c := range cases {
+		res, err := h.MatchWithVars(c.route, GET)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", c.route, err)
+		}
+		if len(res.Vars) != len(c.vars) {
+			t.Fatalf("%s: got vars %v, want %v", c.route, res.Vars, c.vars)
+		}
+		for k, v := range c.vars {
+			if res.Vars[k] != v {
+				t.Errorf("%s: var %s = %q, want %q", c.route, k, res.Vars[k], v)
+			}
+		}
+	}
+
+	// Test: An encoded slash doesn't split a segment
+	res, err := h.MatchWithVars("/users/1%2Fposts", GET)
+	if err != nil {
+		t.Fatalf("/users/1%%2Fposts: unexpected error %v", err)
+	}
+	if res.Vars["id"] != "1/posts" {
+		t.Errorf("/users/1%%2Fposts: got vars %v, want id 1/posts", res.Vars)
+	}
+
+	// Test: Invalid escapes
+	for _, route := range []string{"/users/%zz", "/users/50%", "/files/%2/download"} {
+		if _, err := h.MatchWithVars(route, GET); !errors.Is(err, ErrBadPath) {
+			t.Errorf("%s: got error %v, want ErrBadPath", route, err)
+		}
+	}
+}
+
+func TestClosest(t *testing.T) {
+	h := Handlers{}
+	for _, route := range []string{"/wakanda", "/users", "/users/{id}", "/about"} {
+		h.Add(route, noop)
+	}
+
+	tests := []struct {
+		path, want string
+		ok         bool
+	}{
+		{"/wakanada", "/wakanda", true},
+		{"/user", "/users", true},
+		{"/abuot", "/about", true},
+		{"/completely/elsewhere", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := h.Closest(tt.path, 3)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Closest(%q) = %q, %v; want %q, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAutoOptions(t *testing.T) {
+	hit := ""
+	h := Handlers{}
+	h.Add("/items", func(w *response.Writer, req *request.Request) { hit = "get" }).GET()
+	h.Add("/items", func(w *response.Writer, req *request.Request) { hit = "post" }).POST()
+
+	res, err := h.MatchWithVars("/items", OPTIONS)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	buf := &bytes.Buffer{}
+	res.HandlerFunc(response.NewResponseWriter(buf), nil)
+	if hit != "" {
+		t.Errorf("OPTIONS ran the %s func", hit)
+	}
+	// Only the methods in MethodFuncs, as registered
+	out := buf.String()
+	if !strings.HasPrefix(out, "HTTP/1.1 204") || !strings.Contains(out, "Allow: GET, POST\r\n") {
+		t.Errorf("Expected 204 with the route's methods, got %q", out)
+	}
+
+	// Test: An explicit OPTIONS handler replaces the automatic one
+	h.Add("/items", func(w *response.Writer, req *request.Request) { hit = "options" }).OPTIONS()
+	res, err = h.MatchWithVars("/items", OPTIONS)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res.HandlerFunc(response.NewResponseWriter(&bytes.Buffer{}), nil)
+	if hit != "options" {
+		t.Errorf("ran %q, want the explicit OPTIONS func", hit)
+	}
+	// Test: The 405 Allow list adds HEAD and OPTIONS, HEAD going before
+	// OPTIONS however they were registered
+	if allow := h["/items"].allow(); allow != "GET, POST, HEAD, OPTIONS" {
+		t.Errorf("allow() = %q", allow)
+	}
+	h.Add("/items", func(w *response.Writer, req *request.Request) {}).HEAD()
+	if allow := h["/items"].allow(); allow != "GET, POST, HEAD, OPTIONS" {
+		t.Errorf("allow() with an explicit HEAD = %q", allow)
+	}
+	h.Add("/head-only", func(w *response.Writer, req *request.Request) {}).OPTIONS()
+	h.Add("/head-only", func(w *response.Writer, req *request.Request) {}).HEAD()
+	if allow := h["/head-only"].allow(); allow != "HEAD, OPTIONS" {
+		t.Errorf("allow() for OPTIONS then HEAD = %q", allow)
+	}
+
+	// Test: Routes without methods keep running their func for OPTIONS
+	h.Add("/any", func(w *response.Writer, req *request.Request) { hit = "any" })
+	res, err = h.MatchWithVars("/any", OPTIONS)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res.HandlerFunc(response.NewResponseWriter(&bytes.Buffer{}), nil)
+	if hit != "any" {
+		t.Errorf("ran %q, want the route's func", hit)
+	}
+}
+
+func TestMethodBuilders(t *testing.T) {
+	hit := ""
+	h := Handlers{}
+	h.Add("/docs/{id}", func(w *response.Writer, req *request.Request) { hit = "put" }).PUT()
+	h.Add("/docs/{id}", func(w *response.Writer, req *request.Request) { hit = "trace" }).TRACE()
+	h.Add("/docs/{id}", func(w *response.Writer, req *request.Request) { hit = "options" }).OPTIONS()
+
+	for method, want := range map[AllowedMethod]string{PUT: "put", TRACE: "trace", OPTIONS: "options"} {
+		hit = ""
+		res, err := h.MatchWithVars("/docs/7", method)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", method, err)
+		}
+		res.HandlerFunc(nil, nil)
+		if hit != want {
+			t.Errorf("%s: ran %q, want %q", method, hit, want)
+		}
+		if res.Vars["id"] != "7" {
+			t.Errorf("%s: vars %v", method, res.Vars)
+		}
+	}
+
+	_, err := h.MatchWithVars("/docs/7", GET)
+	var notAllowed *MethodNotAllowedError
+	if !errors.As(err, &notAllowed) || strings.Join(notAllowed.Allowed, ", ") != "PUT, TRACE, OPTIONS" {
+		t.Errorf("expected PUT, TRACE and OPTIONS allowed, got %v", err)
+	}
+}
+
+func TestMatchReturnsRegisteredHandler(t *testing.T) {
+	h := Handlers{}
+	registered := h.Add("/items/{id}", noop).GET()
+
+	res, err := h.MatchWithVars("/items/1", GET)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if res.Handler != registered {
+		t.Error("MatchWithVars should return the registered handler, not a copy")
+	}
+
+	// Test: Changes made through Match stick
+	matched, err := h.Match("/items/1", GET)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	matched.Accept("application/json")
+	if registered.AcceptsBody("text/plain") {
+		t.Error("Accept set on the matched handler should apply to the route")
+	}
+}
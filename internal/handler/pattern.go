@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrBadPath is returned, wrapped, by MatchWithVars when a path variable
+// isn't valid percent-encoding, such as "%zz".
+var ErrBadPath = fmt.Errorf("invalid percent-encoding in path")
+
+// segment is one /-separated piece of a compiled route pattern
+type segment struct {
+	value    string // literal text, or the variable name for {name} segments
+	isVar    bool
+	optional bool // {name?} segments may be missing from the end of the path
+	rest     bool // {name...} takes the rest of the path, slashes and all
+}
+
+// rank orders segment kinds from most to least specific
+func (s segment) rank() int {
+	switch {
+	case !s.isVar:
+		return 0
+	case s.rest:
+		return 3
+	case !s.optional:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// routePattern is a dynamic route split into segments once, at registration,
+// so matching a request doesn't have to re-parse the pattern every time.
+type routePattern struct {
+	route    string
+	segments []segment
+	shape    string // The route with variable names left out, "/a/{}/{?}"
+}
+
+// compilePattern parses a route such as "/posts/{id}/{section?}" into its
+// segments. Optional segments are only allowed at the end of a route, and a
+// catch-all like "/files/{path...}" only as its last segment.
+func compilePattern(pattern string) *routePattern {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	p := &routePattern{route: pattern, segments: make([]segment, 0, len(parts))}
+
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			name := part[1 : len(part)-1]
+			if name, ok := strings.CutSuffix(name, "..."); ok {
+				if i != len(parts)-1 {
+					panic(fmt.Sprintf("Route %s has a catch-all segment before its end", pattern))
+				}
+				p.segments = append(p.segments, segment{value: name, isVar: true, rest: true})
+				continue
+			}
+			name, optional := strings.CutSuffix(name, "?")
+			p.segments = append(p.segments, segment{value: name, isVar: true, optional: optional})
+			continue
+		}
+		p.segments = append(p.segments, segment{value: part})
+	}
+
+	var shape strings.Builder
+	for _, seg := range p.segments {
+		shape.WriteByte('/')
+		switch {
+		case seg.rest:
+			shape.WriteString("{...}")
+		case seg.optional:
+			shape.WriteString("{?}")
+		case seg.isVar:
+			shape.WriteString("{}")
+		default:
+			shape.WriteString(seg.value)
+		}
+	}
+	p.shape = shape.String()
+
+	for i := 1; i < len(p.segments); i++ {
+		if p.segments[i-1].optional && !p.segments[i].optional && !p.segments[i].rest {
+			panic(fmt.Sprintf("Route %s has a required segment after an optional one", pattern))
+		}
+	}
+	return p
+}
+
+// matches reports whether an actual route (e.g. "/wakanda/123") fits the
+// pattern. The route is walked in place rather than split, so a miss costs no
+// allocations.
+func (p *routePattern) matches(route string) bool {
+	return p.walk(strings.Trim(route, "/"), nil)
+}
+
+// vars extracts the variables of a route already known to match. Optional
+// segments missing from the route are left unset. The route is matched as it
+// was sent, so an encoded slash stays inside its segment, and each variable
+// is percent-decoded afterwards: "/files/a%2Fb" gives name "a/b".
+func (p *routePattern) vars(route string) (Vars, error) {
+	vars := make(Vars)
+	p.walk(strings.Trim(route, "/"), vars)
+	for name, raw := range vars {
+		value, err := url.PathUnescape(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadPath, err)
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// walk reports whether route fits the pattern, recording variables into vars
+// when it is non-nil. A catch-all takes whatever is left, which may be
+// nothing.
+func (p *routePattern) walk(route string, vars Vars) bool {
+	rest, done := route, false
+	for _, seg := range p.segments {
+		if seg.rest {
+			if seg.value == "" {
+				return false // Invalid parameter name
+			}
+			if vars != nil {
+				if done {
+					rest = ""
+				}
+				vars[seg.value] = rest
+			}
+			return true
+		}
+		if done {
+			if !seg.optional {
+				return false // Fewer segments than the pattern needs
+			}
+			continue
+		}
+
+		part, remaining, found := strings.Cut(rest, "/")
+		if seg.isVar {
+			if seg.value == "" {
+				return false // Invalid parameter name
+			}
+			if vars != nil && !(seg.optional && part == "") {
+				vars[seg.value] = part
+			}
+		} else if part != seg.value {
+			return false
+		}
+		rest, done = remaining, !found
+	}
+	return done // Anything left over means more segments than the pattern has
+}
+
+// moreSpecific reports whether p should win over other when both match the
+// same path. Segments are compared left to right: static beats a variable,
+// which beats an optional variable, which beats a catch-all. If one pattern is a prefix of the other,
+// the longer one only matched by leaving optional segments out, so the shorter
+// one wins. The route text settles the rest so the choice never depends on map
+// order.
+func (p *routePattern) moreSpecific(other *routePattern) bool {
+	for i := 0; i < len(p.segments) && i < len(other.segments); i++ {
+		a, b := p.segments[i].rank(), other.segments[i].rank()
+		if a != b {
+			return a < b
+		}
+	}
+	if len(p.segments) != len(other.segments) {
+		return len(p.segments) < len(other.segments)
+	}
+	return p.route < other.route
+}
@@ -0,0 +1,42 @@
+package handler
+
+// Closest returns the registered route nearest to path by edit distance,
+// for pointing a client that mistyped a URL at the one it probably meant.
+// Routes more than maxDistance edits away don't count; ok is false when none
+// is that close. Ties go to the route that sorts first, so the answer
+// doesn't change from one call to the next.
+func (h Handlers) Closest(path string, maxDistance int) (route string, ok bool) {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+
+	best := maxDistance + 1
+	for candidate := range h {
+		d := editDistance(path, candidate)
+		if d < best || (d == best && ok && candidate < route) {
+			route, best, ok = candidate, d, true
+		}
+	}
+	return route, ok
+}
+
+// editDistance is the Levenshtein distance between a and b: the fewest single
+// byte insertions, deletions and substitutions turning one into the other
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
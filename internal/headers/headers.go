@@ -3,44 +3,142 @@ package headers
 import (
 	"bytes"
 	"fmt"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 )
 
-type Headers map[string]string
+// Headers maps lower-cased field names to their values. A field sent on
+// several lines keeps each line's value, in order, so fields that can't be
+// comma-joined, like Set-Cookie, survive intact.
+type Headers map[string][]string
 
 func NewHeaders() Headers {
-	return map[string]string{}
+	return map[string][]string{}
 }
 
 var ErrInvalidHeader = fmt.Errorf("invalid header in request")
+var ErrHeaderLineTooLong = fmt.Errorf("header line too long")
+var ErrBareLF = fmt.Errorf("line terminated by a bare LF")
+var ErrBareCR = fmt.Errorf("bare CR in line")
 
 const CRLF = "\r\n"
 
-var numberRegexp = regexp.MustCompile("^[a-zA-Z0-9!#$%&'*+-.^_|~`]+$")
+// MaxLineLength caps a single header line, excluding its CRLF. Longer lines
+// are rejected rather than buffered indefinitely while waiting for a CRLF.
+const MaxLineLength = 8 << 10
 
+// tokenChars marks the bytes allowed in a header name. It is checked once
+// per header line, so a lookup table beats a regexp here.
+var tokenChars = func() (t [256]bool) {
+	for c := 'a'; c <= 'z'; c++ {
+		t[c] = true
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		t[c] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		t[c] = true
+	}
+	// ',' has always been let through alongside RFC 9110's tchar set
+	for _, c := range []byte("!#$%&'*+,-.^_|~`") {
+		t[c] = true
+	}
+	return t
+}()
+
+// isToken reports whether name is a non-empty run of tokenChars
+func isToken(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if !tokenChars[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the first value of key, or "" if it isn't set.
 func (h Headers) Get(key string) string {
+	if values := h[strings.ToLower(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns every value of key in the order they were added, or nil.
+func (h Headers) Values(key string) []string {
 	return h[strings.ToLower(key)]
 }
 
-func (h Headers) Set(key, value string) {
-	if h.Get(key) == "" {
-		h[strings.ToLower(key)] = value
-		return
-	}
+// Joined returns every value of key joined with ", ", which is how a list
+// field like Accept or Transfer-Encoding reads when it was split over
+// several lines.
+func (h Headers) Joined(key string) string {
+	return strings.Join(h.Values(key), ", ")
+}
 
-	h[strings.ToLower(key)] = h[strings.ToLower(key)] + ", " + value
+// Set adds value to key, after any values it already has.
+func (h Headers) Set(key, value string) {
+	key = strings.ToLower(key)
+	h[key] = append(h[key], value)
 }
 
+// Replace makes value the only value of key.
 func (h Headers) Replace(key, value string) {
-	h[strings.ToLower(key)] = value
+	h[strings.ToLower(key)] = []string{value}
+}
+
+// Clone returns a copy of h that shares no values with it.
+func (h Headers) Clone() Headers {
+	c := make(Headers, len(h))
+	for key, values := range h {
+		c[key] = slices.Clone(values)
+	}
+	return c
 }
 
 func (h Headers) Delete(key string) {
 	delete(h, strings.ToLower(key))
 }
 
+// hopByHop are the fields that describe a single connection and never go
+// further than the next hop, whatever the Connection header says
+var hopByHop = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// RemoveHopByHop deletes the fields that only apply to the connection they
+// arrived on, as a proxy must before forwarding a message: every field named
+// in Connection, e.g. X-Custom for "Connection: close, X-Custom", then
+// Connection itself, Keep-Alive, TE, Trailer, Transfer-Encoding, Upgrade and
+// any Proxy-* field.
+func (h Headers) RemoveHopByHop() {
+	for _, value := range h.Values("connection") {
+		for token := range strings.SplitSeq(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				h.Delete(token)
+			}
+		}
+	}
+	for _, key := range hopByHop {
+		delete(h, key)
+	}
+	for key := range h {
+		if strings.HasPrefix(key, "proxy-") {
+			delete(h, key)
+		}
+	}
+}
+
 func (h Headers) HasContentLength() (int, bool) {
 	cl := h.Get("content-length")
 	te := h.Get("transfer-encoding")
@@ -54,46 +152,85 @@ func (h Headers) HasContentLength() (int, bool) {
 	return lengthInt, true
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	if !bytes.Contains(data, []byte(CRLF)) {
-		return 0, false, nil
+// ParseOptions tunes how header lines are read.
+type ParseOptions struct {
+	// AllowBareLF accepts a lone LF as a line terminator as well as CRLF.
+	// Either way every line of a message is read by the same rule, so no two
+	// parsers can disagree about where a line ends.
+	AllowBareLF bool
+}
+
+// NextLine finds the first line in data. It returns the line without its
+// terminator and the number of bytes it took up, or n == 0 if no complete
+// line has arrived yet. Lines must end in CRLF unless opts.AllowBareLF is
+// set; a bare LF otherwise fails with ErrBareLF. A CR anywhere but right
+// before the LF is always an error.
+func NextLine(data []byte, opts ParseOptions) (line []byte, n int, err error) {
+	idx := bytes.IndexByte(data, '\n')
+	if idx == -1 {
+		// Only a CR at the very end can still turn out to start a CRLF
+		if cr := bytes.IndexByte(data, '\r'); cr >= 0 && cr < len(data)-1 {
+			return nil, 0, ErrBareCR
+		}
+		return nil, 0, nil
 	}
 
-	if string(data[:len(CRLF)]) == CRLF {
-		return len(CRLF), true, nil
+	line = data[:idx]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	} else if !opts.AllowBareLF {
+		return nil, 0, ErrBareLF
+	}
+	if bytes.IndexByte(line, '\r') >= 0 {
+		return nil, 0, ErrBareCR
 	}
+	return line, idx + 1, nil
+}
 
-	read := 0
-	headers := bytes.Split(data, []byte(CRLF))
+func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.ParseWithOptions(data, ParseOptions{})
+}
 
-	header := headers[0]
-	read += len(header) + len(CRLF)
+// ParseWithOptions parses one header line from data like Parse, applying opts.
+func (h Headers) ParseWithOptions(data []byte, opts ParseOptions) (n int, done bool, err error) {
+	header, read, err := NextLine(data, opts)
+	if err != nil {
+		return 0, false, err
+	}
+	if read == 0 {
+		if len(data) > MaxLineLength {
+			return 0, false, ErrHeaderLineTooLong
+		}
+		return 0, false, nil
+	}
 
-	before, after, ok := bytes.Cut(header, []byte(":"))
-	if !ok {
-		return read, false, ErrInvalidHeader
+	if len(header) == 0 {
+		return read, true, nil
 	}
 
-	key := string(before)
-	value := string(after)
+	if len(header) > MaxLineLength {
+		return 0, false, ErrHeaderLineTooLong
+	}
 
-	if !numberRegexp.Match(before) {
-		fmt.Println("includes invalid")
-		return 0, false, ErrInvalidHeader
+	colon := bytes.IndexByte(header, ':')
+	if colon == -1 {
+		return read, false, ErrInvalidHeader
 	}
+	before, after := header[:colon], header[colon+1:]
 
-	if string(key[len(key)-1]) == " " {
+	// A name with surrounding whitespace fails here too, space isn't a token
+	// character
+	if !isToken(before) {
 		return 0, false, ErrInvalidHeader
 	}
 
-	key = strings.ToLower(strings.Trim(key, " "))
-	value = strings.Trim(value, " ")
+	// Only the first colon ends the name, values like "example.com:8080" or
+	// a timestamp keep theirs. Whitespace around the value is spaces or tabs.
+	key := strings.ToLower(string(before))
+	value := string(bytes.Trim(after, " \t"))
 
-	if _, ok := h[key]; ok {
-		h.Set(key, h.Get(key)+", "+value)
-	} else {
-		h.Set(key, value)
-	}
+	// A repeated field keeps each value, see Values
+	h.Set(key, value)
 
 	return read, false, nil
 }
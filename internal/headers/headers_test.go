@@ -2,6 +2,8 @@ package headers
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,7 +18,7 @@ func TestSingleHeader(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["Host"])
+	assert.Equal(t, "localhost:42069", headers.Get("Host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -58,6 +60,247 @@ func TestMultipleHeaders(t *testing.T) {
 	_, _, _ = headers.Parse(data2)
 	fmt.Println(headers)
 	require.NoError(t, err)
-	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", headers["set-person"])
+	assert.Equal(t, []string{"lane-loves-go", "prime-loves-zig", "tj-loves-ocaml"}, headers.Values("set-person"))
+	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", headers.Joined("set-person"))
+	assert.Equal(t, "lane-loves-go", headers.Get("set-person"))
 	assert.False(t, done)
 }
+
+func TestHeaderValues(t *testing.T) {
+	cases := []struct {
+		line  string
+		key   string
+		value string
+	}{
+		// Colons in the value
+		{"Host: example.com:8080", "host", "example.com:8080"},
+		{"Referer: https://example.com:8443/a?b=c:d", "referer", "https://example.com:8443/a?b=c:d"},
+		{"X-Empty-Colon: :", "x-empty-colon", ":"},
+		{"Date: Mon, 02 Jan 2006 15:04:05 GMT", "date", "Mon, 02 Jan 2006 15:04:05 GMT"},
+		// Whitespace around the value, but not inside it
+		{"Accept:text/html", "accept", "text/html"},
+		{"Accept:   text/html   ", "accept", "text/html"},
+		{"Accept:\ttext/html\t", "accept", "text/html"},
+		{"Accept: \t text/html \t ", "accept", "text/html"},
+		{"User-Agent: Mozilla/5.0 (X11; Linux)", "user-agent", "Mozilla/5.0 (X11; Linux)"},
+		{"X-Blank:", "x-blank", ""},
+		{"X-Blank:   ", "x-blank", ""},
+	}
+	for _, c := range cases {
+		h := NewHeaders()
+		n, done, err := h.Parse([]byte(c.line + "\r\n"))
+		require.NoError(t, err, c.line)
+		assert.Equal(t, len(c.line)+2, n, c.line)
+		assert.False(t, done)
+		assert.Equal(t, Headers{c.key: {c.value}}, h, c.line)
+	}
+
+	// Test: Written back out and parsed again, values are unchanged
+	h := NewHeaders()
+	for _, line := range []string{"Date: Mon, 02 Jan 2006 15:04:05 GMT", "Host: example.com:8080", "Location: http://example.com:8080/x"} {
+		_, _, err := h.Parse([]byte(line + "\r\n"))
+		require.NoError(t, err)
+	}
+	again := NewHeaders()
+	for key, values := range h {
+		for _, value := range values {
+			_, _, err := again.Parse([]byte(key + ": " + value + "\r\n"))
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, h, again)
+
+	// Test: Repeated fields keep each value once
+	h = NewHeaders()
+	for _, line := range []string{"Accept: text/html", "Accept: application/json"} {
+		_, _, err := h.Parse([]byte(line + "\r\n"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"text/html", "application/json"}, h.Values("accept"))
+	assert.Equal(t, "text/html, application/json", h.Joined("accept"))
+}
+
+func TestHeaderLineTooLong(t *testing.T) {
+	headers := NewHeaders()
+
+	// Test: No CRLF yet and already past the limit
+	data := []byte("X-Huge: " + strings.Repeat("a", MaxLineLength))
+	n, done, err := headers.Parse(data)
+	require.ErrorIs(t, err, ErrHeaderLineTooLong)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Complete line over the limit
+	data = []byte("X-Huge: " + strings.Repeat("a", MaxLineLength) + "\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrHeaderLineTooLong)
+}
+
+func TestNextLine(t *testing.T) {
+	// Test: CRLF line
+	line, n, err := NextLine([]byte("Host: a\r\nrest"), ParseOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "Host: a", string(line))
+	assert.Equal(t, 9, n)
+
+	// Test: Incomplete line, including a CR that may still become CRLF
+	_, n, err = NextLine([]byte("Host: a\r"), ParseOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Test: Bare LF, strict and lenient
+	_, _, err = NextLine([]byte("Host: a\nrest"), ParseOptions{})
+	require.ErrorIs(t, err, ErrBareLF)
+	line, n, err = NextLine([]byte("Host: a\nrest"), ParseOptions{AllowBareLF: true})
+	require.NoError(t, err)
+	assert.Equal(t, "Host: a", string(line))
+	assert.Equal(t, 8, n)
+
+	// Test: Bare CR
+	_, _, err = NextLine([]byte("Host: a\rb"), ParseOptions{AllowBareLF: true})
+	require.ErrorIs(t, err, ErrBareCR)
+}
+
+// headerBlock is a typical browser request's worth of headers
+var headerBlock = []byte("Host: example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0\r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Accept-Language: en-US,en;q=0.5\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Referer: https://example.com/search?q=tcp\r\n" +
+	"Connection: keep-alive\r\n" +
+	"Cookie: session=abc123; theme=dark\r\n" +
+	"Upgrade-Insecure-Requests: 1\r\n" +
+	"Sec-Fetch-Dest: document\r\n" +
+	"Sec-Fetch-Mode: navigate\r\n" +
+	"Sec-Fetch-Site: same-origin\r\n" +
+	"Sec-Fetch-User: ?1\r\n" +
+	"Cache-Control: max-age=0\r\n" +
+	"DNT: 1\r\n" +
+	"Pragma: no-cache\r\n" +
+	"X-Request-Id: 7f9c2ba4e88f827d616045507605853e\r\n" +
+	"X-Forwarded-For: 203.0.113.7\r\n" +
+	"If-None-Match: \"33a64df551425fcc55e4d42a148795d9f25f89d4\"\r\n" +
+	"Priority: u=0, i\r\n" +
+	"\r\n")
+
+// parseAll feeds data to Parse the way the request parser does, one line at
+// a time until the blank line
+func parseAll(h Headers, data []byte) (int, error) {
+	read := 0
+	for {
+		n, done, err := h.Parse(data[read:])
+		if err != nil {
+			return read, err
+		}
+		read += n
+		if done || n == 0 {
+			return read, nil
+		}
+	}
+}
+
+func TestParseHeaderBlock(t *testing.T) {
+	headers := NewHeaders()
+	n, err := parseAll(headers, headerBlock)
+	require.NoError(t, err)
+	assert.Equal(t, len(headerBlock), n)
+	assert.Len(t, headers, 20)
+	assert.Equal(t, "example.com", headers.Get("host"))
+	assert.Equal(t, "gzip, deflate, br", headers.Get("accept-encoding"))
+	assert.Equal(t, "u=0, i", headers.Get("priority"))
+	assert.Equal(t, `"33a64df551425fcc55e4d42a148795d9f25f89d4"`, headers.Get("if-none-match"))
+
+	// Test: Lines arriving one byte at a time parse the same
+	partial := NewHeaders()
+	read := 0
+	for end := 1; end <= len(headerBlock); end++ {
+		n, done, err := partial.Parse(headerBlock[read:end])
+		require.NoError(t, err)
+		read += n
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, len(headerBlock), read)
+	assert.Equal(t, headers, partial)
+}
+
+// Test: Header names accept exactly what the old validation regexp did
+func TestHeaderNameChars(t *testing.T) {
+	old := regexp.MustCompile("^[a-zA-Z0-9!#$%&'*+-.^_|~`]+$")
+	for c := 0; c < 256; c++ {
+		name := []byte{'X', byte(c)}
+		assert.Equal(t, old.Match(name), isToken(name), "byte %q", c)
+	}
+	assert.False(t, isToken(nil))
+}
+
+func BenchmarkParseHeaders(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(headerBlock)))
+	for b.Loop() {
+		parseAll(NewHeaders(), headerBlock)
+	}
+}
+
+func TestHeaderRepeatedValues(t *testing.T) {
+	h := NewHeaders()
+	block := "Set-Cookie: session=abc; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Path=/\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"set-cookie: theme=dark, light\r\n\r\n"
+	_, err := parseAll(h, []byte(block))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"session=abc; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Path=/",
+		"theme=dark, light",
+	}, h.Values("Set-Cookie"))
+	assert.Equal(t, "session=abc; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Path=/", h.Get("set-cookie"))
+	assert.Equal(t, []string{"text/plain"}, h.Values("content-type"))
+	assert.Nil(t, h.Values("x-missing"))
+	assert.Empty(t, h.Get("x-missing"))
+
+	// Test: Replace leaves one value
+	h.Replace("Set-Cookie", "only=1")
+	assert.Equal(t, []string{"only=1"}, h.Values("set-cookie"))
+
+	// Test: Clones don't share values
+	c := h.Clone()
+	c.Set("set-cookie", "more=2")
+	c["content-type"][0] = "text/html"
+	assert.Equal(t, []string{"only=1"}, h.Values("set-cookie"))
+	assert.Equal(t, "text/plain", h.Get("content-type"))
+}
+
+func TestRemoveHopByHop(t *testing.T) {
+	h := NewHeaders()
+	h.Set("Connection", "close, X-Custom")
+	h.Set("Connection", " x-other ")
+	h.Set("X-Custom", "1")
+	h.Set("X-Other", "2")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("TE", "trailers")
+	h.Set("Trailer", "Expires")
+	h.Set("Upgrade", "websocket")
+	h.Set("Proxy-Authorization", "Basic abc")
+	h.Set("Proxy-Connection", "keep-alive")
+	h.Set("Content-Type", "text/plain")
+	h.Set("X-Kept", "3")
+
+	h.RemoveHopByHop()
+
+	// Test: Fields named in Connection go along with the standard set
+	assert.Equal(t, Headers{
+		"content-type": {"text/plain"},
+		"x-kept":       {"3"},
+	}, h)
+
+	// Test: Without a Connection header only the standard set goes
+	h = NewHeaders()
+	h.Set("Upgrade", "h2c")
+	h.Set("X-Custom", "1")
+	h.RemoveHopByHop()
+	assert.Equal(t, Headers{"x-custom": {"1"}}, h)
+}
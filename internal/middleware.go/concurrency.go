@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// PerClientConcurrency caps how many requests from one client IP may be in
+// flight at once, so a single client can't tie up every worker with slow
+// requests. Requests past the cap get a 429 straight away; a slot is freed
+// when the handler holding it returns. Clients are told apart by the IP of
+// req.RemoteAddr, which the server takes from forwarding headers only for
+// its TrustedProxies.
+func PerClientConcurrency(limit int) MiddlewareHandler {
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+
+	return func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			ip := clientIP(req)
+
+			mu.Lock()
+			if inFlight[ip] >= limit {
+				mu.Unlock()
+				w.RetryAfter(time.Second)
+				w.Respond(response.StatusTooManyRequests, []byte("Too many concurrent requests"))
+				return
+			}
+			inFlight[ip]++
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				// Drop clients with nothing in flight, the map would
+				// otherwise keep every IP ever seen
+				if inFlight[ip]--; inFlight[ip] == 0 {
+					delete(inFlight, ip)
+				}
+				mu.Unlock()
+			}()
+			next(w, req)
+		}
+	}
+}
+
+// clientIP is the IP part of req.RemoteAddr, which may come without a port
+func clientIP(req *request.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
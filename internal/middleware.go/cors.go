@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// CORSOptions configures CORS. Empty fields take the defaults shown.
+type CORSOptions struct {
+	AllowedOrigins   []string      // Origins allowed to call, "*" for any; none by default
+	AllowedMethods   []string      // GET, HEAD and POST
+	AllowedHeaders   []string      // Whatever the preflight asks for
+	ExposedHeaders   []string      // Response headers scripts may read besides the simple ones
+	AllowCredentials bool          // Let cookies and auth headers through; "*" then echoes the origin
+	MaxAge           time.Duration // How long browsers may cache a preflight, 0 leaves it to them
+}
+
+// CORS lets pages from AllowedOrigins call the server from scripts.
+//
+// Preflights, OPTIONS requests with an Origin and an
+// Access-Control-Request-Method, are answered here with 204 No Content and
+// never reach the route. A plain OPTIONS request, without those headers, goes
+// on to the route like any other request and gets the automatic 204 with an
+// Allow header, or the route's own OPTIONS handler. Preflights from origins
+// that aren't allowed get the 204 without any Access-Control headers, which
+// the browser takes as a refusal.
+//
+// Other requests from an allowed origin run as usual with
+// Access-Control-Allow-Origin added to the response.
+//
+//	srv.Use(middleware.CORS(middleware.CORSOptions{
+//		AllowedOrigins: []string{"https://app.example.com"},
+//		AllowedMethods: []string{"GET", "POST", "DELETE"},
+//	}))
+func CORS(opts CORSOptions) MiddlewareHandler {
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = []string{"GET", "HEAD", "POST"}
+	}
+	anyOrigin := slices.Contains(opts.AllowedOrigins, "*")
+
+	return func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			origin := req.Headers.Get("origin")
+			preflight := req.RequestLine.Method == "OPTIONS" && origin != "" &&
+				req.Headers.Get("access-control-request-method") != ""
+
+			// The answer depends on the origin, and for preflights on what
+			// they ask for, even when no CORS headers end up being sent
+			w.AddVary("Origin")
+			if preflight {
+				w.AddVary("Access-Control-Request-Method", "Access-Control-Request-Headers")
+			}
+
+			allowed := origin != "" && (anyOrigin || slices.Contains(opts.AllowedOrigins, origin))
+			if allowed {
+				if anyOrigin && !opts.AllowCredentials {
+					w.ReplaceHeader("access-control-allow-origin", "*")
+				} else {
+					w.ReplaceHeader("access-control-allow-origin", origin)
+				}
+				if opts.AllowCredentials {
+					w.ReplaceHeader("access-control-allow-credentials", "true")
+				}
+			}
+
+			if !preflight {
+				if allowed && len(opts.ExposedHeaders) > 0 {
+					w.ReplaceHeader("access-control-expose-headers", strings.Join(opts.ExposedHeaders, ", "))
+				}
+				next(w, req)
+				return
+			}
+
+			if allowed {
+				w.ReplaceHeader("access-control-allow-methods", strings.Join(opts.AllowedMethods, ", "))
+				requested := req.Headers.Joined("access-control-request-headers")
+				if len(opts.AllowedHeaders) > 0 {
+					w.ReplaceHeader("access-control-allow-headers", strings.Join(opts.AllowedHeaders, ", "))
+				} else if requested != "" {
+					w.ReplaceHeader("access-control-allow-headers", requested)
+				}
+				if opts.MaxAge > 0 {
+					w.ReplaceHeader("access-control-max-age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+				}
+			}
+			w.WriteStatus(response.StatusNoContent)
+		}
+	}
+}
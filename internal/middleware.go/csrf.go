@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// CSRFOptions configures CSRF. Empty fields take the defaults shown.
+type CSRFOptions struct {
+	CookieName string // "csrf_token"
+	HeaderName string // "X-CSRF-Token"
+	FieldName  string // "csrf_token", the urlencoded form field
+	Path       string // "/", the cookie's Path
+}
+
+// csrfSafeMethods don't change anything, so they are never checked
+var csrfSafeMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+type csrfTokenKey struct{}
+
+// CSRF guards against cross-site request forgery with the double-submit
+// pattern. Every client gets a random token in a cookie. Requests with an
+// unsafe method, such as POST, PUT, PATCH and DELETE, must send the same
+// token back in the header or form field, which another site can't do as it
+// can't read the cookie; if it is missing or differs they get a 403.
+//
+// Handlers rendering forms put the token in them with CSRFToken:
+//
+//	srv.Use(middleware.CSRF(middleware.CSRFOptions{}))
+//	...
+//	fmt.Fprintf(&page, `<input type="hidden" name="csrf_token" value="%s">`, middleware.CSRFToken(req))
+func CSRF(opts CSRFOptions) MiddlewareHandler {
+	if opts.CookieName == "" {
+		opts.CookieName = "csrf_token"
+	}
+	if opts.HeaderName == "" {
+		opts.HeaderName = "X-CSRF-Token"
+	}
+	if opts.FieldName == "" {
+		opts.FieldName = "csrf_token"
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+
+	return func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			token, _ := req.Cookie(opts.CookieName)
+
+			if !csrfSafeMethods[req.RequestLine.Method] {
+				sent := req.Headers.Get(opts.HeaderName)
+				if sent == "" {
+					sent = req.PostFormValue(opts.FieldName)
+				}
+				if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+					w.Respond(response.StatusForbidden, []byte("invalid CSRF token"))
+					return
+				}
+			}
+
+			if token == "" {
+				token = newCSRFToken()
+				w.SetCookie(&http.Cookie{
+					Name:     opts.CookieName,
+					Value:    token,
+					Path:     opts.Path,
+					Secure:   req.Scheme == "https",
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			ctx := context.WithValue(req.Context(), csrfTokenKey{}, token)
+			next(w, req.WithContext(ctx))
+		}
+	}
+}
+
+// CSRFToken returns the token requests handled under CSRF must send back,
+// for embedding in forms or pages. It is "" outside of CSRF.
+func CSRFToken(req *request.Request) string {
+	token, _ := req.Context().Value(csrfTokenKey{}).(string)
+	return token
+}
+
+// newCSRFToken returns 32 random bytes, base64 encoded for cookies and URLs
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
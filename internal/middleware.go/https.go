@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// HTTPSMode is what RequireHTTPS does with a plaintext request.
+type HTTPSMode int
+
+const (
+	// HTTPSRedirect sends the client to the same URL over https, with a 301
+	// for GET and HEAD and a 308 for other methods so they are repeated with
+	// their body. Requests without a Host to redirect to are rejected.
+	HTTPSRedirect HTTPSMode = iota
+	// HTTPSReject answers with 403 Forbidden.
+	HTTPSReject
+)
+
+// RequireHTTPS lets through only requests the client made over https,
+// according to req.Scheme. The server sets that from the connection, or
+// from X-Forwarded-Proto and Forwarded when the request came through one of
+// its TrustedProxies, so a TLS-terminating proxy in front works too.
+//
+//	srv.Use(middleware.RequireHTTPS(middleware.HTTPSRedirect))
+func RequireHTTPS(mode HTTPSMode) MiddlewareHandler {
+	return func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			if req.Scheme == "https" {
+				next(w, req)
+				return
+			}
+
+			if mode == HTTPSRedirect && req.Host != "" {
+				u := req.URL()
+				u.Scheme = "https"
+				status := response.StatusPermanentRedirect
+				if method := req.RequestLine.Method; method == "GET" || method == "HEAD" {
+					status = response.StatusMovedPermanently
+				}
+				w.Redirect(status, u.String())
+				return
+			}
+
+			w.Respond(response.StatusForbidden, []byte("HTTPS required"))
+		}
+	}
+}
@@ -7,3 +7,22 @@ import (
 
 type MiddlewareFunc func(w *response.Writer, req *request.Request)
 type MiddlewareHandler func(next MiddlewareFunc) MiddlewareFunc
+
+// When applies m only to requests for which pred returns true, every other
+// request goes straight to next.
+//
+//	server.Use(middleware.When(func(req *request.Request) bool {
+//		return strings.HasPrefix(req.Path(), "/api")
+//	}, loggingMiddleware))
+func When(pred func(*request.Request) bool, m MiddlewareHandler) MiddlewareHandler {
+	return func(next MiddlewareFunc) MiddlewareFunc {
+		wrapped := m(next)
+		return func(w *response.Writer, req *request.Request) {
+			if pred(req) {
+				wrapped(w, req)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRequest parses a raw request for feeding straight into a middleware chain
+func newRequest(t *testing.T, raw string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+func TestWhen(t *testing.T) {
+	var seen []string
+	recorder := func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			seen = append(seen, req.Path())
+			next(w, req)
+		}
+	}
+
+	handled := 0
+	chain := When(func(req *request.Request) bool {
+		return strings.HasPrefix(req.Path(), "/api")
+	}, recorder)(func(w *response.Writer, req *request.Request) {
+		handled++
+	})
+
+	for _, path := range []string{"/api/users", "/home", "/api/posts?page=2", "/about"} {
+		req := newRequest(t, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		chain(response.NewResponseWriter(&bytes.Buffer{}), req)
+	}
+
+	assert.Equal(t, []string{"/api/users", "/api/posts"}, seen)
+	assert.Equal(t, 4, handled)
+}
+
+func TestMiddlewareReadsBody(t *testing.T) {
+	const body = `{"amount": 42}`
+	var verified string
+	verifySignature := func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			data, err := io.ReadAll(req.BodyReader())
+			require.NoError(t, err)
+			verified = string(data)
+			req.RewindBody()
+			next(w, req)
+		}
+	}
+
+	var handled, raw string
+	chain := verifySignature(func(w *response.Writer, req *request.Request) {
+		data, err := io.ReadAll(req.BodyReader())
+		require.NoError(t, err)
+		handled = string(data)
+		raw = string(req.Body)
+	})
+
+	req := newRequest(t, "POST /pay HTTP/1.1\r\nHost: localhost\r\nContent-Length: 14\r\n\r\n"+body)
+	chain(response.NewResponseWriter(&bytes.Buffer{}), req)
+
+	assert.Equal(t, body, verified)
+	assert.Equal(t, body, handled)
+	assert.Equal(t, body, raw)
+
+	// Test: Without a rewind the reader stays at the end
+	data, err := io.ReadAll(req.BodyReader())
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestWriteAfterBody(t *testing.T) {
+	var headerErr, respondErr error
+	late := func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			w.ReplaceHeader("x-elapsed", "12ms")
+			headerErr = w.Err()
+			respondErr = w.Respond(response.StatusInternalServerError, []byte("late"))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	w := response.NewResponseWriter(buf)
+	late(func(w *response.Writer, req *request.Request) {
+		require.NoError(t, w.Respond(response.StatusOK, []byte("done")))
+	})(w, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	require.ErrorIs(t, headerErr, response.ErrWriteOrder)
+	require.ErrorIs(t, respondErr, response.ErrWriteOrder)
+	// Test: Err keeps the first violation
+	assert.Equal(t, headerErr, w.Err())
+	assert.NotContains(t, buf.String(), "X-Elapsed")
+	assert.NotContains(t, buf.String(), "late")
+}
+
+func TestStatusCodeAfterNext(t *testing.T) {
+	var before, after response.StatusCode
+	logger := func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			before = w.StatusCode()
+			next(w, req)
+			after = w.StatusCode()
+		}
+	}
+
+	chain := logger(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusImATeapot)
+		w.WriteHeaders()
+		w.WriteBody([]byte("short and stout"))
+	})
+	chain(response.NewResponseWriter(&bytes.Buffer{}), newRequest(t, "GET /tea HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	assert.Equal(t, response.StatusCode(0), before)
+	assert.Equal(t, response.StatusImATeapot, after)
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	handled := false
+	handler := func(w *response.Writer, req *request.Request) {
+		handled = true
+		w.Respond(response.StatusOK, []byte("secret"))
+	}
+	serve := func(mode HTTPSMode, scheme, raw string) string {
+		handled = false
+		req := newRequest(t, raw)
+		req.Scheme = scheme
+		buf := &bytes.Buffer{}
+		RequireHTTPS(mode)(handler)(response.NewResponseWriter(buf), req)
+		return buf.String()
+	}
+
+	// Test: Plaintext GET is redirected to the same URL over https
+	out := serve(HTTPSRedirect, "http", "GET /account?tab=billing HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.False(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301"), out)
+	assert.Contains(t, out, "Location: https://example.com/account?tab=billing\r\n")
+
+	// Test: Other methods keep their method and body
+	out = serve(HTTPSRedirect, "http", "POST /login HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 308"), out)
+
+	// Test: TLS requests pass through
+	out = serve(HTTPSRedirect, "https", "GET /account HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, handled)
+	assert.Contains(t, out, "secret")
+
+	// Test: Reject mode
+	out = serve(HTTPSReject, "http", "GET /account HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.False(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403"), out)
+}
+
+func TestCSRF(t *testing.T) {
+	var token string
+	handled := false
+	chain := CSRF(CSRFOptions{})(func(w *response.Writer, req *request.Request) {
+		handled = true
+		token = CSRFToken(req)
+		w.Respond(response.StatusOK, []byte("ok"))
+	})
+	serve := func(raw string) string {
+		handled = false
+		buf := &bytes.Buffer{}
+		chain(response.NewResponseWriter(buf), newRequest(t, raw))
+		return buf.String()
+	}
+
+	// Test: A safe request is given a token in a cookie
+	out := serve("GET /form HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.True(t, handled)
+	require.NotEmpty(t, token)
+	assert.Contains(t, out, "Set-Cookie: csrf_token="+token+"; Path=/; SameSite=Lax\r\n")
+
+	// Test: The token sent back in the header or form passes
+	cookie := "Cookie: csrf_token=" + token + "\r\n"
+	out = serve("POST /form HTTP/1.1\r\nHost: localhost\r\n" + cookie + "X-CSRF-Token: " + token + "\r\nContent-Length: 0\r\n\r\n")
+	assert.True(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200"), out)
+	assert.NotContains(t, out, "Set-Cookie")
+
+	body := "name=tea&csrf_token=" + token
+	out = serve("POST /form HTTP/1.1\r\nHost: localhost\r\n" + cookie +
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+	assert.True(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200"), out)
+
+	// Test: A missing token is refused
+	out = serve("DELETE /form HTTP/1.1\r\nHost: localhost\r\n" + cookie + "\r\n")
+	assert.False(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403"), out)
+
+	// Test: So is one that doesn't match the cookie, or no cookie at all
+	out = serve("POST /form HTTP/1.1\r\nHost: localhost\r\n" + cookie + "X-CSRF-Token: forged\r\nContent-Length: 0\r\n\r\n")
+	assert.False(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403"), out)
+
+	out = serve("POST /form HTTP/1.1\r\nHost: localhost\r\nX-CSRF-Token: " + token + "\r\nContent-Length: 0\r\n\r\n")
+	assert.False(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403"), out)
+}
+
+func TestPerClientConcurrency(t *testing.T) {
+	const limit = 2
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	chain := PerClientConcurrency(limit)(func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.Respond(response.StatusOK, []byte("ok"))
+	})
+	serve := func(path, remoteAddr string) string {
+		req := newRequest(t, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		req.RemoteAddr = remoteAddr
+		buf := &bytes.Buffer{}
+		chain(response.NewResponseWriter(buf), req)
+		return buf.String()
+	}
+
+	// Test: limit slow requests from one IP, on different ports, fill its slots
+	var wg sync.WaitGroup
+	for i := range limit {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve("/slow", "10.0.0.1:"+strconv.Itoa(50000+i))
+		}()
+		<-entered
+	}
+
+	out := serve("/fast", "10.0.0.1:50009")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 429"), out)
+	assert.Contains(t, out, "Retry-After: 1\r\n")
+
+	// Test: Other clients aren't affected
+	out = serve("/fast", "10.0.0.2:50000")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200"), out)
+
+	// Test: Slots are given back when the handlers return
+	close(release)
+	wg.Wait()
+	out = serve("/fast", "10.0.0.1:50010")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200"), out)
+}
+
+func TestCORS(t *testing.T) {
+	handled := false
+	chain := CORS(CORSOptions{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "DELETE"},
+		ExposedHeaders: []string{"X-Total"},
+		MaxAge:         10 * time.Minute,
+	})(func(w *response.Writer, req *request.Request) {
+		handled = true
+		w.Respond(response.StatusOK, []byte("ok"))
+	})
+	serve := func(raw string) string {
+		handled = false
+		buf := &bytes.Buffer{}
+		chain(response.NewResponseWriter(buf), newRequest(t, raw))
+		return buf.String()
+	}
+
+	// Test: A preflight from an allowed origin is answered without the route
+	out := serve("OPTIONS /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example.com\r\n" +
+		"Access-Control-Request-Method: DELETE\r\nAccess-Control-Request-Headers: x-token\r\n\r\n")
+	assert.False(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204"), out)
+	assert.Contains(t, out, "Access-Control-Allow-Origin: https://app.example.com\r\n")
+	assert.Contains(t, out, "Access-Control-Allow-Methods: GET, DELETE\r\n")
+	assert.Contains(t, out, "Access-Control-Allow-Headers: x-token\r\n")
+	assert.Contains(t, out, "Access-Control-Max-Age: 600\r\n")
+	assert.Contains(t, out, "Vary: Origin, Access-Control-Request-Method, Access-Control-Request-Headers\r\n")
+
+	// Test: One from another origin gets no Access-Control headers
+	out = serve("OPTIONS /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://evil.example\r\n" +
+		"Access-Control-Request-Method: DELETE\r\n\r\n")
+	assert.False(t, handled)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204"), out)
+	assert.NotContains(t, out, "Access-Control-Allow")
+
+	// Test: A plain OPTIONS goes on to the route
+	serve("OPTIONS /items HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, handled)
+
+	// Test: Actual requests run with the origin allowed
+	out = serve("GET /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example.com\r\n\r\n")
+	assert.True(t, handled)
+	assert.Contains(t, out, "Access-Control-Allow-Origin: https://app.example.com\r\n")
+	assert.Contains(t, out, "Access-Control-Expose-Headers: X-Total\r\n")
+	out = serve("GET /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://evil.example\r\n\r\n")
+	assert.True(t, handled)
+	assert.NotContains(t, out, "Access-Control-Allow")
+
+	// Test: "*" allows any origin, echoing it back when credentials are on
+	chain = CORS(CORSOptions{AllowedOrigins: []string{"*"}})(func(w *response.Writer, req *request.Request) {
+		w.Respond(response.StatusOK, []byte("ok"))
+	})
+	out = serve("GET /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://any.example\r\n\r\n")
+	assert.Contains(t, out, "Access-Control-Allow-Origin: *\r\n")
+	chain = CORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})(func(w *response.Writer, req *request.Request) {
+		w.Respond(response.StatusOK, []byte("ok"))
+	})
+	out = serve("GET /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://any.example\r\n\r\n")
+	assert.Contains(t, out, "Access-Control-Allow-Origin: https://any.example\r\n")
+	assert.Contains(t, out, "Access-Control-Allow-Credentials: true\r\n")
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// Timeout bounds how long the rest of the chain may run. The deadline is
+// layered on top of the request context, so a shorter server HandlerTimeout
+// still wins. Handlers are expected to watch req.Context().Done(); if the
+// deadline passes before they have written anything the client gets a 503.
+func Timeout(d time.Duration) MiddlewareHandler {
+	return func(next MiddlewareFunc) MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+
+			next(w, req.WithContext(ctx))
+
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && !w.Started() {
+				w.Respond(response.StatusServiceUnavailable, []byte("Service Unavailable"))
+			}
+		}
+	}
+}
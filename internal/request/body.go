@@ -0,0 +1,116 @@
+package request
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// DefaultMaxJSONSize is the largest body BindJSON accepts.
+const DefaultMaxJSONSize = 1 << 20
+
+var ErrNotJSON = fmt.Errorf("content type is not application/json")
+var ErrBadJSON = fmt.Errorf("malformed JSON body")
+
+// BodyReader returns a reader over the request body for code that wants an
+// io.Reader, like a JSON decoder or a signature check. Every caller gets the
+// same reader, so whatever one reads is gone for the next until RewindBody is
+// called.
+//
+// The body is normally buffered by the parser before the request is
+// dispatched, so Body itself can always be read again; only the reader's
+// position is shared. ParseForm and DecodeJSON read Body without going
+// through the reader, and never change it. A deferred body that hasn't been
+// read with ReadBody is instead streamed off the connection without being
+// kept, and can't be rewound.
+func (r *Request) BodyReader() io.Reader {
+	if r.deferred != nil {
+		if !r.deferred.loaded {
+			return r.deferred
+		}
+		r.ReadBody()
+	}
+	if r.bodyReader == nil {
+		r.bodyReader = bytes.NewReader(r.Body)
+	}
+	return r.bodyReader
+}
+
+// RewindBody resets BodyReader to the start of the body, e.g. in a middleware
+// that reads it before passing the request on. Changes made to Body since the
+// reader was created are picked up.
+func (r *Request) RewindBody() {
+	if r.bodyReader == nil {
+		return
+	}
+	r.bodyReader.Reset(r.Body)
+}
+
+// DecodeJSON unmarshals the body into v. It works on Body directly and
+// leaves both Body and the BodyReader position alone, so the raw bytes stay
+// available, e.g. to check a webhook signature computed over them.
+func (r *Request) DecodeJSON(v any) error {
+	body, err := r.ReadBody()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// BindJSON decodes a JSON request body into v, like DecodeJSON, after
+// checking the request says it is JSON. Bodies over DefaultMaxJSONSize are
+// refused; use BindJSONLimit to pick another limit.
+func (r *Request) BindJSON(v any) error {
+	return r.BindJSONLimit(v, DefaultMaxJSONSize)
+}
+
+// BindJSONLimit is BindJSON with a limit of its own. It fails with
+// ErrNotJSON unless Content-Type is application/json or a +json type, with
+// ErrBodyTooLarge for a body over limit bytes and with ErrBadJSON, wrapping
+// the decoder's error, for a body that doesn't decode into v.
+//
+// The body is decoded as it is read, and no more than limit bytes of it, so
+// a deferred body over the limit is refused without being read to the end.
+// A buffered body is decoded from Body, leaving the BodyReader position
+// alone.
+func (r *Request) BindJSONLimit(v any, limit int64) error {
+	contentType := r.Headers.Get("content-type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return fmt.Errorf("%w: got %q", ErrNotJSON, contentType)
+	}
+
+	var src io.Reader = bytes.NewReader(r.Body)
+	if r.BodyPending() {
+		src = r.BodyReader()
+	}
+	// One byte past the limit is enough to tell the body is over it
+	body := &io.LimitedReader{R: src, N: limit + 1}
+	tooLarge := func() error {
+		return fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, limit)
+	}
+
+	dec := json.NewDecoder(body)
+	err = dec.Decode(v)
+	if body.N == 0 {
+		return tooLarge()
+	}
+	if err == io.EOF {
+		return fmt.Errorf("%w: empty body", ErrBadJSON)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadJSON, err)
+	}
+	// Like json.Unmarshal, only whitespace may follow the value
+	_, err = dec.Token()
+	if body.N == 0 {
+		return tooLarge()
+	}
+	if err != io.EOF {
+		return fmt.Errorf("%w: data after the JSON value", ErrBadJSON)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/noelw19/tcptohttp/internal/headers"
+)
+
+// ErrBadChunk is returned for a chunked body that doesn't follow the
+// chunked coding, like a size that isn't hex or chunk data not ending in CRLF.
+var ErrBadChunk = fmt.Errorf("malformed chunked body")
+
+// framingHeaders may not be set from trailers, they describe the message
+// itself and were settled before the body was read
+var framingHeaders = map[string]bool{
+	"content-length":    true,
+	"transfer-encoding": true,
+	"trailer":           true,
+	"host":              true,
+}
+
+// isChunked reports whether the body is sent with the chunked coding, which
+// has to be the last one applied
+func (r *Request) isChunked() bool {
+	te := r.Headers.Joined("transfer-encoding")
+	if te == "" {
+		return false
+	}
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// parseChunked decodes as much of a chunked body as data holds, appending
+// chunk data to r.Body. Data is taken as it arrives, so a deferred body
+// streams even when it is sent as one huge chunk, rather than waiting in the
+// read buffer until the whole chunk is in. Trailer fields after the last
+// chunk are merged into r.Headers. It reports done after the final CRLF.
+func (r *Request) parseChunked(data []byte) (n int, done bool, err error) {
+	read := 0
+	for {
+		if r.trailers != nil {
+			n, done, err := r.trailers.ParseWithOptions(data[read:], r.lineOpts)
+			if err != nil {
+				return read, false, err
+			}
+			read += n
+			if done {
+				r.mergeTrailers()
+				return read, true, nil
+			}
+			if n == 0 {
+				return read, false, nil
+			}
+			continue
+		}
+
+		if r.chunkLeft > 0 {
+			n := min(r.chunkLeft, len(data)-read)
+			if n == 0 {
+				return read, false, nil
+			}
+			r.Body = append(r.Body, data[read:read+n]...)
+			read += n
+			r.chunkLeft -= n
+			if r.chunkLeft > 0 {
+				return read, false, nil
+			}
+			r.chunkEnd = true
+		}
+		if r.chunkEnd {
+			end := data[read:]
+			if len(end) < len(headers.CRLF) {
+				return read, false, nil
+			}
+			if !bytes.HasPrefix(end, []byte(headers.CRLF)) {
+				return read, false, ErrBadChunk
+			}
+			read += len(headers.CRLF)
+			r.chunkEnd = false
+			continue
+		}
+
+		line, n, err := headers.NextLine(data[read:], r.lineOpts)
+		if err != nil {
+			return read, false, err
+		}
+		if n == 0 {
+			if len(data)-read > headers.MaxLineLength {
+				return read, false, headers.ErrHeaderLineTooLong
+			}
+			return read, false, nil
+		}
+
+		size, err := parseChunkSize(line)
+		if err != nil {
+			return read, false, err
+		}
+		if size == 0 {
+			// The last chunk, what follows is the trailer section
+			read += n
+			r.trailers = headers.NewHeaders()
+			continue
+		}
+
+		read += n
+		r.chunkLeft = size
+	}
+}
+
+// parseChunkSize reads the hex size from a chunk size line, ignoring any chunk
+// extensions after it
+func parseChunkSize(line []byte) (int, error) {
+	hex, _, _ := bytes.Cut(line, []byte(";"))
+	hex = bytes.TrimRight(hex, " \t")
+	// Sizes are capped at 31 bits, which keeps them in an int anywhere
+	size, err := strconv.ParseUint(string(hex), 16, 31)
+	if err != nil {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrBadChunk, hex)
+	}
+	return int(size), nil
+}
+
+// mergeTrailers adds the trailer fields to the request headers, apart from
+// those that could change how the message was framed
+func (r *Request) mergeTrailers() {
+	for key, values := range r.trailers {
+		if framingHeaders[key] {
+			continue
+		}
+		for _, value := range values {
+			r.Headers.Set(key, value)
+		}
+	}
+	r.trailers = nil
+}
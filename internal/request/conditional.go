@@ -0,0 +1,45 @@
+package request
+
+import "strings"
+
+// CheckIfMatch evaluates the request's If-Match precondition against the
+// current ETag of the target resource. Handlers guarding a PUT/PATCH/DELETE
+// should call it before applying the change and, when it returns false,
+// answer 412 Precondition Failed without touching the resource:
+//
+//	if !request.CheckIfMatch(req, item.ETag) {
+//		w.Respond(response.StatusPreconditionFailed, body)
+//		return
+//	}
+//
+// A request without If-Match always passes. "*" passes for any existing
+// resource, i.e. when currentETag is not empty. Otherwise one of the listed
+// tags has to match using strong comparison, so weak (W/) tags never match.
+// currentETag may be given with or without its surrounding quotes.
+func CheckIfMatch(req *Request, currentETag string) (ok bool) {
+	ifMatch := strings.TrimSpace(req.Headers.Joined("if-match"))
+	if ifMatch == "" {
+		return true
+	}
+	if currentETag == "" {
+		return false
+	}
+	if ifMatch == "*" {
+		return true
+	}
+
+	if !strings.HasPrefix(currentETag, `"`) {
+		currentETag = `"` + currentETag + `"`
+	}
+
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if tag == currentETag {
+			return true
+		}
+	}
+	return false
+}
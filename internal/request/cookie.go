@@ -0,0 +1,48 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrNoCookie is returned by Cookie when the request has no cookie by that
+// name.
+var ErrNoCookie = fmt.Errorf("named cookie not present")
+
+// Cookies returns the cookies sent in the Cookie header by name. Browsers put
+// the cookie with the most specific path first, so when a name is sent more
+// than once the first value is the one kept. Values in double quotes are
+// returned without them, and pairs without a name or an '=' are skipped.
+func (r *Request) Cookies() map[string]string {
+	cookies := make(map[string]string)
+	// Clients send one Cookie line, but several are read as one list
+	header := strings.Join(r.Headers.Values("cookie"), "; ")
+	for header != "" {
+		var pair string
+		pair, header, _ = strings.Cut(header, ";")
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			continue
+		}
+		if _, seen := cookies[name]; seen {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		cookies[name] = value
+	}
+	return cookies
+}
+
+// Cookie returns the value of the named cookie, or ErrNoCookie if the request
+// didn't send it. See Cookies for how the header is read.
+func (r *Request) Cookie(name string) (string, error) {
+	value, ok := r.Cookies()[name]
+	if !ok {
+		return "", ErrNoCookie
+	}
+	return value, nil
+}
@@ -0,0 +1,65 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/noelw19/tcptohttp/internal/decompress"
+)
+
+var ErrBodyTooLarge = decompress.ErrTooLarge
+var ErrUnsupportedEncoding = decompress.ErrUnsupportedEncoding
+
+// Decompress replaces a gzip or deflate encoded body with its decoded form,
+// so handlers see plain bytes in r.Body. Content-Encoding is dropped and
+// Content-Length updated to match. Decoding stops with ErrBodyTooLarge as soon
+// as the output exceeds limit bytes, which keeps small payloads that expand
+// enormously (zip bombs) from exhausting memory.
+//
+// A deferred body still on the connection is not read here. It is decoded as
+// it is read instead, through BodyReader or ReadBody, and it is those reads
+// that fail with ErrBodyTooLarge. Content-Length is dropped rather than
+// updated, as the decoded length isn't known yet. Call Decompress before
+// reading any of the body.
+//
+// Bodies without a Content-Encoding, or with "identity", are left untouched.
+func (r *Request) Decompress(limit int64) error {
+	encoding := r.Headers.Joined("content-encoding")
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+
+	if r.BodyPending() {
+		if !decompress.Supported(encoding) {
+			return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+		}
+		r.deferred.encoding = encoding
+		r.deferred.limit = limit
+		r.Headers.Delete("content-encoding")
+		r.Headers.Delete("content-length")
+		return nil
+	}
+
+	body, err := r.ReadBody()
+	if err != nil {
+		return err
+	}
+	decoder, err := decompress.NewReader(bytes.NewReader(body), encoding, limit)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	body, err = io.ReadAll(decoder)
+	if err != nil {
+		return err
+	}
+
+	r.Body = body
+	r.bodyReader = nil
+	r.Headers.Delete("content-encoding")
+	r.Headers.Replace("content-length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,172 @@
+package request
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/noelw19/tcptohttp/internal/decompress"
+)
+
+// deferredBody is a body left on the connection by Options.DeferBody. The
+// parser is a request of its own holding just the body state, decoded bytes
+// collect in its Body until they are handed out.
+type deferredBody struct {
+	rd     *Reader
+	opts   Options
+	parser *Request
+	loaded bool  // The whole body is in parser.Body
+	err    error // The read that failed, it fails every read after it
+	// encoding is the Content-Encoding to decode the body from, set by
+	// Request.Decompress, with limit capping the decoded size. decoder is
+	// made on the first read, so nothing is read before the body is wanted.
+	encoding   string
+	limit      int64
+	decoder    io.ReadCloser
+	decoderErr error
+}
+
+// rawBody reads a deferred body as it is on the wire, for its decoder
+type rawBody struct{ d *deferredBody }
+
+func (r rawBody) Read(p []byte) (int, error) {
+	return r.d.readRaw(p)
+}
+
+// decoded returns the reader decoding the body, making it the first time
+func (d *deferredBody) decoded() (io.Reader, error) {
+	if d.decoder == nil && d.decoderErr == nil {
+		d.decoder, d.decoderErr = decompress.NewReader(rawBody{d}, d.encoding, d.limit)
+	}
+	return d.decoder, d.decoderErr
+}
+
+// unread reports whether some of the body is still on the connection. It is
+// false for a nil body.
+func (d *deferredBody) unread() bool {
+	return d != nil && !d.parser.done()
+}
+
+// next reads until more of the body is decoded or it is complete
+func (d *deferredBody) next() error {
+	if d.err != nil || d.parser.done() {
+		return d.err
+	}
+	before := len(d.parser.Body)
+	d.parser.holdBody = false
+	d.err = d.rd.fill(d.parser, d.opts, func() bool {
+		return d.parser.done() || len(d.parser.Body) > before
+	})
+	return d.err
+}
+
+// readAll reads the rest of the body into parser.Body, decoded when it is
+// encoded
+func (d *deferredBody) readAll() error {
+	if d.loaded {
+		return nil
+	}
+	if d.encoding != "" {
+		decoder, err := d.decoded()
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(decoder)
+		if err != nil {
+			return err
+		}
+		d.parser.Body = body
+		d.loaded = true
+		return nil
+	}
+	for !d.parser.done() {
+		if err := d.next(); err != nil {
+			return err
+		}
+	}
+	d.loaded = true
+	return nil
+}
+
+// discard reads the rest of the body and drops it. It fails with
+// ErrBodyTooLarge once more than limit bytes were dropped with more still to
+// come, leaving that unread; a negative limit means no limit.
+func (d *deferredBody) discard(limit int64) error {
+	var dropped int64
+	for {
+		dropped += int64(len(d.parser.Body))
+		d.parser.Body = d.parser.Body[:0]
+		if d.parser.done() {
+			return nil
+		}
+		if limit >= 0 && dropped > limit {
+			return fmt.Errorf("%w: more than %d bytes left unread", ErrBodyTooLarge, limit)
+		}
+		if err := d.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// Read hands out the body as it comes off the connection, without keeping
+// what it returns
+func (d *deferredBody) Read(p []byte) (int, error) {
+	if d.encoding != "" {
+		decoder, err := d.decoded()
+		if err != nil {
+			return 0, err
+		}
+		return decoder.Read(p)
+	}
+	return d.readRaw(p)
+}
+
+// readRaw is Read before any decoding
+func (d *deferredBody) readRaw(p []byte) (int, error) {
+	for len(d.parser.Body) == 0 {
+		if d.parser.done() {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.parser.Body)
+	d.parser.Body = d.parser.Body[:copy(d.parser.Body, d.parser.Body[n:])]
+	return n, nil
+}
+
+// ReadBody returns the request body. For a request read with
+// Options.DeferBody it first reads whatever of the body is still on the
+// connection into Body; for any other request Body is already complete and
+// is returned as is. Bytes already taken with BodyReader are not part of it.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.deferred == nil {
+		return r.Body, nil
+	}
+	if err := r.deferred.readAll(); err != nil {
+		return nil, err
+	}
+	// Copies of the request share the body, the first to ask reads it
+	if r.Body == nil {
+		r.Body = r.deferred.parser.Body
+	}
+	return r.Body, nil
+}
+
+// BodyPending reports whether the request has a deferred body that is still,
+// at least partly, on the connection.
+func (r *Request) BodyPending() bool {
+	return r.deferred.unread()
+}
+
+// DiscardBody reads what is left of a deferred body and drops it, so the
+// connection is ready for the next request. Once more than limit bytes were
+// dropped with more still to come it gives up with ErrBodyTooLarge, and the
+// connection should be closed instead. Requests without a pending body
+// return nil.
+func (r *Request) DiscardBody(limit int64) error {
+	if !r.BodyPending() {
+		return nil
+	}
+	return r.deferred.discard(limit)
+}
@@ -0,0 +1,81 @@
+package request
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+)
+
+// ErrBadForm is returned by ParseForm for a urlencoded body that can't be
+// decoded, such as one with broken percent-encoding.
+var ErrBadForm = fmt.Errorf("malformed form body")
+
+// formMethods are the methods whose body ParseForm reads
+var formMethods = map[string]bool{
+	"POST":  true,
+	"PUT":   true,
+	"PATCH": true,
+}
+
+// ParseForm fills in PostForm and Form. For POST, PUT and PATCH requests
+// with an application/x-www-form-urlencoded body, PostForm holds the values
+// from the body. Form holds those followed by the query string parameters,
+// so for a key given in both the body's value comes first.
+//
+// It only does the work once, later calls return straight away. On a
+// malformed body Form still gets the query parameters and an error wrapping
+// ErrBadForm is returned, as is the error of a deferred body that couldn't be
+// read.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+
+	var err error
+	r.PostForm = make(map[string][]string)
+	if formMethods[r.RequestLine.Method] && r.isURLEncoded() {
+		body, readErr := r.ReadBody()
+		values, parseErr := url.ParseQuery(string(body))
+		if readErr != nil {
+			err = readErr
+		} else if parseErr != nil {
+			err = fmt.Errorf("%w: %w", ErrBadForm, parseErr)
+		} else {
+			r.PostForm = values
+		}
+	}
+
+	r.Form = make(map[string][]string, len(r.PostForm)+len(r.ParamsMulti))
+	for key, values := range r.PostForm {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	for key, values := range r.ParamsMulti {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	return err
+}
+
+// FormValue returns the first value for key in Form, parsing the form first
+// if needed, or "" if there is none. Parse errors are ignored; call ParseForm
+// to see them.
+func (r *Request) FormValue(key string) string {
+	r.ParseForm()
+	if values := r.Form[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// PostFormValue is like FormValue but only looks at values from the body.
+func (r *Request) PostFormValue(key string) string {
+	r.ParseForm()
+	if values := r.PostForm[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (r *Request) isURLEncoded() bool {
+	mediaType, _, err := mime.ParseMediaType(r.Headers.Get("content-type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
@@ -0,0 +1,50 @@
+package request
+
+import (
+	"fmt"
+	"io"
+)
+
+// forwardBufferSize is how much of the body ForwardBody holds at a time
+const forwardBufferSize = 32 << 10
+
+// ErrForwardWrite is returned by ForwardBody, wrapping the writer's error,
+// when the body can't be written to where it is being forwarded.
+var ErrForwardWrite = fmt.Errorf("forwarding the request body failed")
+
+// ForwardBody copies the body to dst, e.g. the connection to an upstream
+// server, through BodyReader. A deferred body, see Options.DeferBody, goes
+// across as it comes off the connection, so a large upload is never held in
+// memory more than a buffer at a time, even sent as a single chunk. dst gets
+// the body decoded, a chunked one included; framing it for the upstream is up
+// to the caller.
+//
+// A failure writing to dst is returned wrapping ErrForwardWrite, with the rest
+// of the body left unread. A handler should answer it with 502 Bad Gateway and
+// return: the server then drops what is left of a small body, or closes the
+// connection rather than read a large one to the end. Other errors come from
+// reading the body, the client's side.
+func (r *Request) ForwardBody(dst io.Writer) (int64, error) {
+	src := r.BodyReader()
+	buf := make([]byte, forwardBufferSize)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			if werr == nil && w < n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return written, fmt.Errorf("%w: %w", ErrForwardWrite, werr)
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
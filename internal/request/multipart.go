@@ -0,0 +1,128 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+
+	"github.com/noelw19/tcptohttp/internal/headers"
+)
+
+// DefaultMaxMultipartMemory is how much of a multipart form MultipartForm
+// keeps in memory, file contents past it go to temporary files.
+const DefaultMaxMultipartMemory = 32 << 20
+
+var ErrNotMultipart = fmt.Errorf("request is not multipart/form-data")
+var ErrBadMultipart = fmt.Errorf("malformed multipart body")
+
+// MultipartForm is a parsed multipart/form-data body: the text fields in
+// Value and the uploaded files in File, both by field name.
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+
+	form *multipart.Form
+}
+
+// FileHeader describes one uploaded file.
+type FileHeader struct {
+	Filename string
+	Header   headers.Headers // The part's own headers, e.g. its content-type
+	Size     int64
+
+	fh *multipart.FileHeader
+}
+
+// Open returns the file's contents. Close it when done, a file larger than
+// the memory threshold is read from disk.
+func (f *FileHeader) Open() (io.ReadCloser, error) {
+	return f.fh.Open()
+}
+
+// MultipartForm parses a multipart/form-data body with
+// DefaultMaxMultipartMemory as the memory threshold, see ParseMultipartForm.
+func (r *Request) MultipartForm() (*MultipartForm, error) {
+	return r.ParseMultipartForm(DefaultMaxMultipartMemory)
+}
+
+// ParseMultipartForm parses a multipart/form-data body. Parts are decoded one
+// at a time, and once maxMemory bytes of them are held in memory the contents
+// of further files are written to temporary files instead, so a large upload
+// isn't kept twice over. The server removes those files when the request is
+// done, see RemoveTempFiles.
+//
+// A deferred body, see Options.DeferBody, is streamed into the form and
+// consumed by it, ReadBody returns nothing of it afterwards. The form is
+// parsed once; later calls return it whatever their maxMemory.
+// Requests of another content type fail with ErrNotMultipart, bodies that
+// don't parse with an error wrapping ErrBadMultipart.
+func (r *Request) ParseMultipartForm(maxMemory int64) (*MultipartForm, error) {
+	if r.uploads == nil {
+		r.uploads = &uploads{}
+	}
+	if r.uploads.form != nil {
+		return r.uploads.form, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Headers.Get("content-type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: no boundary", ErrBadMultipart)
+	}
+
+	// A body still on the connection is parsed as it comes off it, so only
+	// maxMemory of it is ever held; one already read is parsed from Body
+	var body io.Reader
+	if r.BodyPending() {
+		body = r.BodyReader()
+	} else {
+		body = bytes.NewReader(r.Body)
+	}
+	form, err := multipart.NewReader(body, boundary).ReadForm(maxMemory)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadMultipart, err)
+	}
+
+	mf := &MultipartForm{
+		Value: form.Value,
+		File:  make(map[string][]*FileHeader, len(form.File)),
+		form:  form,
+	}
+	for field, files := range form.File {
+		for _, fh := range files {
+			h := headers.NewHeaders()
+			for key, values := range fh.Header {
+				for _, value := range values {
+					h.Set(key, value)
+				}
+			}
+			mf.File[field] = append(mf.File[field], &FileHeader{
+				Filename: fh.Filename,
+				Header:   h,
+				Size:     fh.Size,
+				fh:       fh,
+			})
+		}
+	}
+	r.uploads.form = mf
+	return mf, nil
+}
+
+// RemoveTempFiles deletes the temporary files a parsed multipart form put
+// uploads in. The server calls it once the request has been handled.
+func (r *Request) RemoveTempFiles() error {
+	if r.uploads == nil || r.uploads.form == nil {
+		return nil
+	}
+	return r.uploads.form.form.RemoveAll()
+}
+
+// uploads is the multipart form state shared between copies of a request
+type uploads struct {
+	form *MultipartForm
+}
@@ -0,0 +1,135 @@
+package request
+
+import (
+	"strconv"
+	"strings"
+)
+
+// mediaRange is a single entry of an Accept header.
+type mediaRange struct {
+	mainType string
+	subType  string
+	q        float64
+}
+
+// parseAccept splits an Accept header into its media ranges. Entries that do
+// not look like type/subtype are skipped.
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		mainType, subType, ok := strings.Cut(mediaType, "/")
+		if !ok || mainType == "" || subType == "" {
+			continue
+		}
+
+		ranges = append(ranges, mediaRange{mainType: mainType, subType: subType, q: qValue(params[1:])})
+	}
+	return ranges
+}
+
+// qValue reads the q parameter out of an entry's parameters, 1 if it has none
+func qValue(params []string) float64 {
+	q := 1.0
+	for _, param := range params {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.ToLower(strings.TrimSpace(key)) != "q" {
+			continue
+		}
+		if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			q = parsed
+		}
+	}
+	return q
+}
+
+// quality returns the q-value the ranges give contentType, taken from the most
+// specific matching range, or 0 if none match.
+func quality(ranges []mediaRange, contentType string) float64 {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mainType, subType, _ := strings.Cut(strings.ToLower(strings.TrimSpace(mediaType)), "/")
+
+	best, bestSpecificity := 0.0, -1
+	for _, r := range ranges {
+		specificity := -1
+		switch {
+		case r.mainType == mainType && r.subType == subType:
+			specificity = 2
+		case r.mainType == mainType && r.subType == "*":
+			specificity = 1
+		case r.mainType == "*" && r.subType == "*":
+			specificity = 0
+		}
+		if specificity > bestSpecificity {
+			best, bestSpecificity = r.q, specificity
+		}
+	}
+	return best
+}
+
+// Accepts reports whether the request's Accept header allows contentType. A
+// request without an Accept header accepts anything.
+func (r *Request) Accepts(contentType string) bool {
+	return r.Negotiate([]string{contentType}) != ""
+}
+
+// Negotiate picks the offered content type the client prefers according to
+// its Accept header, or "" when it accepts none of them. Ties go to the type
+// offered first.
+func (r *Request) Negotiate(offers []string) string {
+	accept := strings.TrimSpace(r.Headers.Joined("accept"))
+	if accept == "" {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := quality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// AcceptsEncoding reports whether the client's Accept-Encoding header allows
+// a body in the content coding enc, such as "gzip". A coding listed by name
+// is judged by its own q-value, anything else by a "*" entry if there is one;
+// q=0 refuses. "identity", the body as is, is allowed unless refused outright.
+// Without the header only identity is assumed, since plenty of clients that
+// can't decompress don't send one.
+func (r *Request) AcceptsEncoding(enc string) bool {
+	enc = strings.ToLower(strings.TrimSpace(enc))
+	identity := enc == "identity"
+
+	header := strings.TrimSpace(r.Headers.Joined("accept-encoding"))
+	if header == "" {
+		return identity
+	}
+
+	wildcard := -1.0
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := qValue(params[1:])
+		switch coding {
+		case enc:
+			return q > 0
+		case "*":
+			wildcard = q
+		}
+	}
+
+	if wildcard >= 0 {
+		return wildcard > 0
+	}
+	return identity
+}
@@ -0,0 +1,67 @@
+package request
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ErrNoParam is returned by the Param accessors when the route has no path
+// variable by that name.
+var ErrNoParam = fmt.Errorf("path parameter not present")
+
+// ErrBadParam is returned by the Param accessors when the path variable
+// doesn't parse as the type asked for.
+var ErrBadParam = fmt.Errorf("malformed path parameter")
+
+// ParamInt returns the path variable name, e.g. id in "/users/{id}", as an
+// int. It fails with ErrNoParam when there is no such variable and with an
+// error wrapping ErrBadParam when it isn't a base 10 integer that fits.
+func (r *Request) ParamInt(name string) (int, error) {
+	value, err := r.param(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s %q is not an integer", ErrBadParam, name, value)
+	}
+	return n, nil
+}
+
+// ParamInt64 is like ParamInt for values that need 64 bits whatever the
+// platform, such as database ids.
+func (r *Request) ParamInt64(name string) (int64, error) {
+	value, err := r.param(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s %q is not a 64-bit integer", ErrBadParam, name, value)
+	}
+	return n, nil
+}
+
+// ParamBool returns the path variable name as a bool. It takes what
+// strconv.ParseBool does: 1, t, true, 0, f, false and their upper case forms.
+// Errors are as for ParamInt.
+func (r *Request) ParamBool(name string) (bool, error) {
+	value, err := r.param(name)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s %q is not a boolean", ErrBadParam, name, value)
+	}
+	return b, nil
+}
+
+// param looks up the path variable the accessors parse
+func (r *Request) param(name string) (string, error) {
+	value, ok := r.Vars[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNoParam, name)
+	}
+	return value, nil
+}
@@ -0,0 +1,238 @@
+package request
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/noelw19/tcptohttp/internal/headers"
+)
+
+// DefaultReadBufferSize is the read buffer a Reader starts with. It grows to
+// fit whatever a request needs at once, such as a large body.
+const DefaultReadBufferSize = 1024
+
+// Reader reads consecutive requests off one connection through a single
+// buffer, so a keep-alive connection doesn't allocate a new one for every
+// request. Bytes read past the end of one request are kept for the next,
+// which is what makes pipelined requests work.
+type Reader struct {
+	r    io.Reader
+	size int
+	buf  []byte
+	n    int  // Bytes in buf not parsed yet
+	eof  bool // r returned io.EOF, nothing more will arrive
+	// deadline is when the request being read times out, zero until its
+	// first byte arrives or when there is no timeout
+	deadline time.Time
+	// pending is the deferred body of the last request, if it has one
+	pending *deferredBody
+}
+
+// aLongTimeAgo is a read deadline that has always passed, setting it wakes a
+// blocked Read straight away
+var aLongTimeAgo = time.Unix(1, 0)
+
+// NewReader returns a Reader reading requests from r.
+func NewReader(r io.Reader) *Reader {
+	return NewReaderSize(r, DefaultReadBufferSize)
+}
+
+// NewReaderSize returns a Reader whose buffer starts at size bytes. Sizes
+// below 1 mean DefaultReadBufferSize.
+func NewReaderSize(r io.Reader, size int) *Reader {
+	if size < 1 {
+		size = DefaultReadBufferSize
+	}
+	return &Reader{r: r, size: size}
+}
+
+// Buffered returns how many bytes have been read off the underlying reader
+// but not parsed yet, the start of the next request when there are any.
+func (rd *Reader) Buffered() int {
+	return rd.n
+}
+
+// ReadRequest reads the next request, applying opts while doing so. Once the
+// underlying reader is exhausted between requests it returns an empty
+// request, one that ends partway fails with ErrIncompleteRequest.
+//
+// With opts.DeferBody the request is returned as soon as its headers are in,
+// see Request.ReadBody. Whatever of that body is still unread when the next
+// request is read gets read and dropped first.
+func (rd *Reader) ReadRequest(opts Options) (*Request, error) {
+	if rd.pending != nil {
+		err := rd.pending.discard(-1)
+		rd.pending = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Drop a buffer a big request grew, rather than hold it for the life of
+	// the connection
+	if rd.buf == nil || (rd.n == 0 && len(rd.buf) > 64*rd.size) {
+		rd.buf = make([]byte, rd.size)
+	}
+
+	request := newRequest()
+	request.lineOpts = headers.ParseOptions{AllowBareLF: opts.AllowBareLF}
+	request.holdBody = opts.DeferBody
+	rd.deadline = time.Time{}
+
+	err := rd.fill(request, opts, func() bool {
+		return request.done() || (request.holdBody && request.state == parserBody)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if request.done() {
+		return request, nil
+	}
+
+	// The headers are in, the body stays on the wire until it is asked for
+	_, done, err := request.parseBody(nil)
+	if err != nil {
+		return nil, err
+	}
+	if done {
+		request.state = parserDone
+		return request, nil
+	}
+	request.deferred = &deferredBody{
+		rd:   rd,
+		opts: opts,
+		parser: &Request{
+			state:      parserBody,
+			Headers:    request.Headers,
+			lineOpts:   request.lineOpts,
+			bodyLength: request.bodyLength,
+			lengthSet:  request.lengthSet,
+		},
+	}
+	rd.pending = request.deferred
+	return request, nil
+}
+
+// fill parses what is buffered into request, reading more off the underlying
+// reader until stop reports true.
+func (rd *Reader) fill(request *Request, opts Options, stop func() bool) error {
+	// The clock starts with the first byte of the request, time spent idle
+	// before that is the caller's business
+	startClock := func() {
+		if opts.Timeout <= 0 || !rd.deadline.IsZero() || rd.n == 0 {
+			return
+		}
+		rd.deadline = time.Now().Add(opts.Timeout)
+		if d, ok := rd.r.(deadliner); ok {
+			d.SetReadDeadline(rd.deadline)
+		}
+	}
+
+	for {
+		// What is buffered may already hold the request, e.g. when it was
+		// pipelined behind the previous one
+		readN, err := request.parse(rd.buf[:rd.n])
+		if err != nil {
+			return err
+		}
+		copy(rd.buf, rd.buf[readN:rd.n])
+		rd.n -= readN
+		// Lines are capped one at a time, the head as a whole is capped here
+		if request.readingHead() && request.headRead+rd.n > MaxHeadSize {
+			return ErrHeadTooLarge
+		}
+
+		if stop() {
+			return nil
+		}
+		if rd.eof {
+			// A reader closed between requests just has nothing more to say
+			if request.state == parserInit && rd.n == 0 {
+				request.state = parserDone
+				return nil
+			}
+			return ErrIncompleteRequest
+		}
+
+		startClock()
+
+		// Grow the buffer once it is full, whatever is in it is still needed
+		if rd.n == len(rd.buf) {
+			rd.buf = append(rd.buf, make([]byte, len(rd.buf))...)
+		}
+
+		n, err := rd.r.Read(rd.buf[rd.n:])
+		rd.n += n
+		startClock()
+		if !rd.deadline.IsZero() && (errors.Is(err, os.ErrDeadlineExceeded) || time.Now().After(rd.deadline)) {
+			return ErrRequestTimeout
+		}
+
+		if err == io.EOF {
+			rd.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// WatchClose reads ahead in the background while a request is handled, and
+// calls onClose if the connection is closed by the peer or fails, so the
+// handler's context can be cancelled. A read that returns data instead means
+// the client is still there, e.g. pipelining its next request; the data is
+// kept for ReadRequest and watching stops.
+//
+// The read deadline is cleared for the watch, as the deadline set for reading
+// the request, or for the connection to sit idle, says nothing about how
+// long the handler may take. The returned stop func ends the watch and must
+// be called before the next ReadRequest. It leaves the read deadline clear,
+// set a new one afterwards if needed. Readers that can't have a deadline set
+// aren't watched, as the background read could not be interrupted, and
+// neither are requests whose deferred body is still unread, as the handler
+// may yet read it.
+func (rd *Reader) WatchClose(onClose func()) (stop func()) {
+	d, ok := rd.r.(deadliner)
+	// The handler may still read a deferred body, a read here would race it
+	if !ok || rd.pending.unread() {
+		return func() {}
+	}
+	if rd.eof {
+		onClose()
+		return func() {}
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	d.SetReadDeadline(time.Time{})
+	done := make(chan result, 1)
+	go func() {
+		data := make([]byte, rd.size)
+		n, err := rd.r.Read(data)
+		// Only stop sets a deadline now, that isn't the client going away
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			onClose()
+		}
+		done <- result{data[:n], err}
+	}()
+
+	return func() {
+		d.SetReadDeadline(aLongTimeAgo)
+		res := <-done
+		d.SetReadDeadline(time.Time{})
+
+		if rd.buf == nil {
+			rd.buf = make([]byte, rd.size)
+		}
+		if rd.n+len(res.data) > len(rd.buf) {
+			rd.buf = append(rd.buf[:rd.n], make([]byte, len(res.data))...)
+		}
+		rd.n += copy(rd.buf[rd.n:], res.data)
+		if res.err == io.EOF {
+			rd.eof = true
+		}
+	}
+}
@@ -2,10 +2,14 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"maps"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/noelw19/tcptohttp/internal/headers"
 )
@@ -25,7 +29,52 @@ type Request struct {
 	Headers     headers.Headers
 	Body        []byte
 	Vars        map[string]string // Path parameters from dynamic routes
-	Params      map[string]string // Query string parameters
+	Params      map[string]string // Query string parameters, the last value of each
+	// ParamsMulti holds every value of each query string parameter, in the
+	// order they appear. Params is its last value per key.
+	ParamsMulti map[string][]string
+	// Form and PostForm hold the parsed form data, they are nil until
+	// ParseForm or FormValue is called.
+	Form     map[string][]string
+	PostForm map[string][]string
+	// RemoteAddr is the client's address. The server sets it to the peer
+	// address, or to the client named in forwarding headers when the peer is
+	// a trusted proxy, in which case it may lack a port.
+	RemoteAddr string
+	// Host is the host the request was sent to, from the Host header or an
+	// absolute-form target, or as forwarded by a trusted proxy.
+	Host string
+	// Scheme is "http" or "https" as seen by the client. Empty means "http".
+	Scheme     string
+	ctx        context.Context
+	bodyReader *bytes.Reader
+	lineOpts   headers.ParseOptions
+	// trailers collects the trailer section of a chunked body, it is set
+	// once the last chunk has been read
+	trailers headers.Headers
+	// bodyRead counts the Content-Length body bytes taken so far
+	bodyRead int
+	// bodyLength is the Content-Length the body is framed by, settled once
+	// lengthSet is, so later header changes can't move the end of the body
+	bodyLength int
+	lengthSet  bool
+	// chunkLeft counts the data bytes of the current chunk still to come,
+	// and chunkEnd is set once they are in and the CRLF after them is due
+	chunkLeft int
+	chunkEnd  bool
+	// headRead counts the request line and header bytes taken so far
+	headRead int
+	// holdBody stops parse at the body, which is then read on demand
+	holdBody bool
+	// deferred is the body left on the connection by Options.DeferBody. It
+	// is a pointer so every copy of the request reads the one body.
+	deferred *deferredBody
+	// routePattern is the pattern of the route the request was matched to
+	routePattern string
+	// uploads holds the form parsed by ParseMultipartForm. It is a pointer
+	// so copies made by WithContext share it and the temporary files get
+	// cleaned up whichever copy parsed them.
+	uploads *uploads
 }
 
 type RequestLine struct {
@@ -35,128 +84,226 @@ type RequestLine struct {
 }
 
 var ErrBadStartLine = fmt.Errorf("bad start line")
+var ErrRequestTimeout = fmt.Errorf("request timeout")
+var ErrMissingHost = fmt.Errorf("missing host header")
+var ErrDuplicateHost = fmt.Errorf("more than one host header")
+var ErrUnsupportedVersion = fmt.Errorf("unsupported HTTP version")
+var ErrBadContentLength = fmt.Errorf("invalid content length")
+var ErrIncompleteRequest = fmt.Errorf("connection closed before the request was complete")
+var ErrURITooLong = fmt.Errorf("request line too long")
+var ErrHeadTooLarge = fmt.Errorf("request head too large")
 var SEPARATOR = []byte("\r\n")
 
+// MaxHeadSize caps the request line and headers together. Each line is
+// capped at headers.MaxLineLength on its own, this stops a client sending
+// line after line of headers.
+const MaxHeadSize = 1 << 20
+
+// Options tunes how a request is read off the wire.
+type Options struct {
+	// Timeout bounds the time spent reading one request, measured from its
+	// first byte until the end of its body. Zero means no limit.
+	Timeout time.Duration
+	// AllowBareLF accepts lines ending in a lone LF in the request line and
+	// headers. By default only CRLF is accepted and anything else fails with
+	// headers.ErrBareLF, since parsers disagreeing on line ends is how
+	// requests get smuggled past proxies.
+	AllowBareLF bool
+	// DeferBody returns the request once its headers are read and leaves the
+	// body on the connection until the handler asks for it, see ReadBody.
+	// Timeout still counts from the first byte of the request, so a slow
+	// handler can run out of time to read the body.
+	DeferBody bool
+}
+
+// deadliner is implemented by readers such as net.Conn that can abort a
+// blocked Read once a deadline passes.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
 func newRequest() *Request {
 	return &Request{
-		state:   parserInit,
-		Headers: headers.NewHeaders(),
-		Vars:    make(map[string]string),
-		Params:  make(map[string]string),
+		state:       parserInit,
+		Headers:     headers.NewHeaders(),
+		Vars:        make(map[string]string),
+		Params:      make(map[string]string),
+		ParamsMulti: make(map[string][]string),
+		uploads:     &uploads{},
 	}
 }
 
-func parseRequestLine(req []byte) (*RequestLine, int, error) {
-	idx := bytes.Index(req, SEPARATOR)
-	if idx == -1 {
+func parseRequestLine(req []byte, opts headers.ParseOptions) (*RequestLine, int, error) {
+	startLine, read, err := headers.NextLine(req, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Like header lines, a request line that goes on and on is refused
+	// rather than buffered while waiting for its end. A line at the cap may
+	// be waiting for the LF after its CR.
+	if read == 0 {
+		if len(req) > headers.MaxLineLength+1 {
+			return nil, 0, ErrURITooLong
+		}
 		return nil, 0, nil
 	}
-
-	startLine := req[:idx]
-	read := idx + len(SEPARATOR)
+	if len(startLine) > headers.MaxLineLength {
+		return nil, 0, ErrURITooLong
+	}
 
 	parts := bytes.Split(startLine, []byte(" "))
 	if len(parts) != 3 {
-		return nil, len(startLine), ErrBadStartLine
+		return nil, read, ErrBadStartLine
 	}
 
 	method := parts[0]
 	target := parts[1]
+	if !validMethod(method) {
+		return nil, read, ErrBadStartLine
+	}
 
-	httpParts := bytes.Split(parts[2], []byte("/"))
-	capMethod := strings.ToUpper(string(method))
-	if string(method) != capMethod && string(httpParts[0]) != "HTTP" && string(httpParts[1]) != "1.1" {
+	// The protocol is exactly "HTTP" and a version, one slash between them
+	protocol := bytes.Split(parts[2], []byte("/"))
+	if len(protocol) != 2 || string(protocol[0]) != "HTTP" || !validVersion(protocol[1]) {
 		return nil, read, ErrBadStartLine
 	}
+	version := protocol[1]
+	// Only HTTP/1.x is spoken here, anything else is well formed but can't
+	// be answered in the client's protocol
+	if v := string(version); v != "1.0" && v != "1.1" {
+		return nil, read, fmt.Errorf("%w: HTTP/%s", ErrUnsupportedVersion, v)
+	}
+
+	if err := validateTarget(string(method), string(target)); err != nil {
+		return nil, read, err
+	}
 
 	return &RequestLine{
 		Method:        string(method),
 		RequestTarget: string(target),
-		HttpVersion:   string(httpParts[1]),
+		HttpVersion:   string(version),
 	}, read, nil
 }
 
+// validMethod reports whether method is a non-empty run of upper case
+// letters and dashes, which covers every registered method. Methods are case
+// sensitive, so "get" is not GET and is refused rather than guessed at.
+func validMethod(method []byte) bool {
+	if len(method) == 0 {
+		return false
+	}
+	for _, c := range method {
+		if (c < 'A' || c > 'Z') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validVersion reports whether version looks like "1.1" or "2", the digits
+// of an HTTP-version after "HTTP/"
+func validVersion(version []byte) bool {
+	major, minor, hasMinor := bytes.Cut(version, []byte("."))
+	if len(major) != 1 || !isDigit(major[0]) {
+		return false
+	}
+	return !hasMinor || (len(minor) == 1 && isDigit(minor[0]))
+}
+
 // parseParams extracts query string parameters from the RequestTarget
 // and stores them in r.Params
 func (r *Request) parseParams() {
 	target := r.RequestLine.RequestTarget
-	
+
 	// Split path and query string (separated by ?)
 	parts := strings.SplitN(target, "?", 2)
 	if len(parts) < 2 {
 		// No query string
 		return
 	}
-	
+
 	queryString := parts[1]
 	if queryString == "" {
 		return
 	}
-	
+
 	// Parse query string using net/url
 	values, err := url.ParseQuery(queryString)
 	if err != nil {
 		// If parsing fails, just return (don't break the request)
 		return
 	}
-	
+
 	// Store parameters in the Params map
 	// If a parameter appears multiple times, we'll use the last value
 	for key, val := range values {
 		if len(val) > 0 {
 			r.Params[key] = val[len(val)-1]
+			r.ParamsMulti[key] = val
 		}
 	}
 }
 
-func (r *Request) parseBody(data []byte) (int, error) {
-	cl := r.Headers.Get("content-length")
-	if cl == "" {
-		r.state = parserDone
-	}
-
-	clength, ok := r.Headers.HasContentLength()
-	if !ok {
-		return 0, nil
-	}
-
-	if clength != len(data) {
-		return 0, fmt.Errorf("content length and body length mismatch")
-	}
-
-	r.Body = data
-	return len(data), nil
+// QueryAll returns every value of the query string parameter key, e.g. both
+// tags of "?tag=go&tag=http", or nil if it wasn't given. Params[key] is the
+// last of them.
+func (r *Request) QueryAll(key string) []string {
+	return r.ParamsMulti[key]
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-
-	bufferSize := 1024
-	buffer := make([]byte, bufferSize)
-	idx := 0
-
-	request := newRequest()
-
-	for !request.done() {
+// parseBody takes the body off data as it arrives, however many reads that
+// takes, decoding it when it is chunked. It reports done when the body is
+// complete, which for a request without one is right away.
+func (r *Request) parseBody(data []byte) (n int, done bool, err error) {
+	if r.isChunked() {
+		// Transfer-Encoding wins over a Content-Length sent alongside it,
+		// which is dropped so nothing downstream trusts it
+		r.Headers.Delete("content-length")
+		return r.parseChunked(data)
+	}
 
-		n, err := reader.Read(buffer[idx:])
-		if err == io.EOF {
-			request.state = parserDone
-		} else if err != nil {
-			return nil, err
+	if !r.lengthSet {
+		// Repeats of the same length are harmless, differing ones leave the
+		// end of the body open to interpretation
+		if lengths := r.Headers.Values("content-length"); len(lengths) > 1 {
+			for _, l := range lengths[1:] {
+				if l != lengths[0] {
+					return 0, false, ErrBadContentLength
+				}
+			}
+			r.Headers.Replace("content-length", lengths[0])
 		}
 
-		idx += n
-		readN, err := request.parse(buffer[:idx])
-		if err != nil {
-			return nil, err
+		clength, ok := r.Headers.HasContentLength()
+		if !ok {
+			clength = 0
 		}
+		if clength < 0 {
+			return 0, false, ErrBadContentLength
+		}
+		r.bodyLength = clength
+		r.lengthSet = true
+	}
+	if r.bodyLength == 0 {
+		return 0, true, nil
+	}
 
-		copy(buffer, buffer[readN:idx])
-		idx -= readN
+	n = min(len(data), r.bodyLength-r.bodyRead)
+	r.Body = append(r.Body, data[:n]...)
+	r.bodyRead += n
+	return n, r.bodyRead == r.bodyLength, nil
+}
 
-	}
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return RequestFromReaderWithOptions(reader, Options{})
+}
 
-	return request, nil
+// RequestFromReaderWithOptions reads a single request from reader like
+// RequestFromReader, applying opts while doing so. Bytes read past the end
+// of the request are lost; use a Reader to read several requests off one
+// connection.
+func RequestFromReaderWithOptions(reader io.Reader, opts Options) (*Request, error) {
+	return NewReader(reader).ReadRequest(opts)
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -165,7 +312,7 @@ outer:
 	for {
 		switch r.state {
 		case parserInit:
-			rl, n, err := parseRequestLine(data[read:])
+			rl, n, err := parseRequestLine(data[read:], r.lineOpts)
 			if err != nil {
 				return 0, err
 			}
@@ -176,14 +323,15 @@ outer:
 
 			r.RequestLine = *rl
 			read += n
-			
+			r.headRead += n
+
 			// Parse query string parameters
 			r.parseParams()
 
 			r.state = parserHeaders
 
 		case parserHeaders:
-			n, done, err := r.Headers.Parse(data[read:])
+			n, done, err := r.Headers.ParseWithOptions(data[read:], r.lineOpts)
 			if err != nil {
 				return read, err
 			}
@@ -193,20 +341,31 @@ outer:
 			}
 
 			read += n
+			r.headRead += n
 
 			if done {
+				if err := r.validateHost(); err != nil {
+					return read, err
+				}
+				r.Host = r.targetHost()
+				if r.Host == "" {
+					r.Host = r.Headers.Get("host")
+				}
 				r.state = parserBody
 			}
 		case parserBody:
-			n, err := r.parseBody(data[read:])
+			if r.holdBody {
+				break outer
+			}
+			n, done, err := r.parseBody(data[read:])
 			if err != nil {
 				return read, err
 			}
 
-			if n == 0 {
+			read += n
+			if !done {
 				break outer
 			}
-
 			r.state = parserDone
 
 		case parserDone:
@@ -216,14 +375,185 @@ outer:
 	return read, nil
 }
 
+// validateHost enforces RFC 7230 section 5.4: an HTTP/1.1 request carries
+// exactly one Host header.
+func (r *Request) validateHost() error {
+	if r.RequestLine.HttpVersion != "1.1" {
+		return nil
+	}
+
+	hosts := r.Headers.Values("host")
+	if len(hosts) == 0 {
+		return ErrMissingHost
+	}
+	// A comma means a list of hosts sent on one line
+	if len(hosts) > 1 || strings.Contains(hosts[0], ",") {
+		return ErrDuplicateHost
+	}
+	return nil
+}
+
 func (r *Request) done() bool {
 	return r.state == parserDone
 }
 
+// readingHead reports whether the request line or headers are still to come
+func (r *Request) readingHead() bool {
+	return r.state == parserInit || r.state == parserHeaders
+}
+
+// Context returns the request's context. It is never nil; requests that were
+// not given one by the server use context.Background().
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context replaced by ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// Clone returns a deep copy of r: headers, path and query parameters and the
+// body can all be changed on the copy without affecting r. The context is
+// shared with r unless replaced on the copy with WithContext.
+func (r *Request) Clone() *Request {
+	r2 := *r
+	r2.Headers = r.Headers.Clone()
+	r2.Vars = maps.Clone(r.Vars)
+	r2.Params = maps.Clone(r.Params)
+	r2.ParamsMulti = cloneValues(r.ParamsMulti)
+	r2.Form = cloneValues(r.Form)
+	r2.PostForm = cloneValues(r.PostForm)
+	r2.Body = bytes.Clone(r.Body)
+	r2.bodyReader = nil
+	return &r2
+}
+
+// cloneValues deep copies a map of values, keeping nil as nil
+func cloneValues(m map[string][]string) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	m2 := make(map[string][]string, len(m))
+	for key, values := range m {
+		m2[key] = slices.Clone(values)
+	}
+	return m2
+}
+
+// AcceptsTrailers reports whether the client advertised "TE: trailers", i.e.
+// that it is willing to receive trailer fields in a chunked response.
+func (r *Request) AcceptsTrailers() bool {
+	for _, token := range strings.Split(r.Headers.Joined("te"), ",") {
+		name, _, _ := strings.Cut(token, ";")
+		if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+// UserAgent returns the client's User-Agent header, or "" if it sent none.
+func (r *Request) UserAgent() string {
+	return r.Headers.Get("user-agent")
+}
+
+// Referer returns the Referer header, the page that linked to this request.
+// The standard's misspelling is the one clients send, but "Referrer" is
+// accepted too.
+func (r *Request) Referer() string {
+	if referer := r.Headers.Get("referer"); referer != "" {
+		return referer
+	}
+	return r.Headers.Get("referrer")
+}
+
+// RoutePattern returns the pattern of the route that matched the request,
+// e.g. "/users/{id}" for "/users/123", which groups requests by endpoint for
+// logging and metrics without a label per id. It is "" until the request has
+// been routed, such as in a rewriter or a 404 handler.
+func (r *Request) RoutePattern() string {
+	return r.routePattern
+}
+
+// SetRoutePattern records the pattern of the route that matched the request.
+// The server calls it before running the route's middleware and handler.
+func (r *Request) SetRoutePattern(pattern string) {
+	r.routePattern = pattern
+}
+
+// SetTarget replaces the request target, e.g. to rewrite a URL before
+// routing, and re-reads the query string parameters from it. A parsed form is
+// dropped, to be parsed again with the new parameters.
+func (r *Request) SetTarget(target string) {
+	r.RequestLine.RequestTarget = target
+	r.Params = make(map[string]string)
+	r.ParamsMulti = make(map[string][]string)
+	r.Form, r.PostForm = nil, nil
+	r.parseParams()
+}
+
 // Path returns just the path portion of the RequestTarget, without the query string
 func (r *Request) Path() string {
 	target := r.RequestLine.RequestTarget
+	// Absolute-form targets ("http://host/path") route on their path
+	if !strings.HasPrefix(target, "/") {
+		if _, after, ok := strings.Cut(target, "://"); ok {
+			target = "/"
+			if i := strings.IndexAny(after, "/?"); i >= 0 {
+				target = after[i:]
+				if target[0] == '?' {
+					target = "/" + target
+				}
+			}
+		}
+	}
 	// Split path and query string (separated by ?)
 	parts := strings.SplitN(target, "?", 2)
 	return parts[0]
 }
+
+// targetHost returns the authority of an absolute-form target, "" otherwise
+func (r *Request) targetHost() string {
+	target := r.RequestLine.RequestTarget
+	if strings.HasPrefix(target, "/") {
+		return ""
+	}
+	_, after, ok := strings.Cut(target, "://")
+	if !ok {
+		return ""
+	}
+	if i := strings.IndexAny(after, "/?"); i >= 0 {
+		return after[:i]
+	}
+	return after
+}
+
+// URL returns the full URL the client requested, built from Scheme, Host and
+// the request target.
+func (r *Request) URL() *url.URL {
+	u, err := url.ParseRequestURI(r.RequestLine.RequestTarget)
+	if err != nil {
+		// Asterisk-form has no URI to parse
+		u = &url.URL{Path: r.Path()}
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if r.Scheme != "" {
+		u.Scheme = r.Scheme
+	} else if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	u.Host = r.Host
+	return u
+}
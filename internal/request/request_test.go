@@ -1,9 +1,24 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"mime/multipart"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 
+	"github.com/noelw19/tcptohttp/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -54,6 +69,35 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, "GET", r.RequestLine.Method)
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
+
+	// Test: HTTP/1.0
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+
+	// Test: Well formed versions other than 1.x
+	for _, version := range []string{"HTTP/0.9", "HTTP/2", "HTTP/3.0"} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\nHost: localhost\r\n\r\n"))
+		require.ErrorIs(t, err, ErrUnsupportedVersion, version)
+	}
+
+	// Test: Malformed versions
+	for _, version := range []string{"HTTP", "HTTP/", "HTTP/1.1.1", "HTTP/11", "http/1.1", "HTTP/1.x",
+		"FTP/9", "FTP/1.1", "HTTP/1.1/1", "HTTP//1.1", "/1.1", ""} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\nHost: localhost\r\n\r\n"))
+		require.ErrorIs(t, err, ErrBadStartLine, version)
+	}
+
+	// Test: Malformed methods
+	for _, line := range []string{" / HTTP/1.1", "get / HTTP/1.1", "G3T / HTTP/1.1", "GET\t/ HTTP/1.1", "GET  / HTTP/1.1"} {
+		_, err = RequestFromReader(strings.NewReader(line + "\r\nHost: localhost\r\n\r\n"))
+		require.ErrorIs(t, err, ErrBadStartLine, line)
+	}
+
+	// Test: Extension methods
+	r, err = RequestFromReader(strings.NewReader("PROPFIND /files HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "PROPFIND", r.RequestLine.Method)
 }
 
 func TestStandardHeaders(t *testing.T) {
@@ -65,9 +109,9 @@ func TestStandardHeaders(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
+	assert.Equal(t, "*/*", r.Headers.Get("accept"))
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -123,6 +167,7 @@ func TestEmptyBody(t *testing.T) {
 	reader = &chunkReader{
 		data: "POST /submit HTTP/1.1\r\n" +
 			"Host: localhost:42069\r\n" +
+			"Content-Length: 20\r\n" +
 			"\r\n" +
 			"partial content",
 		numBytesPerRead: 3,
@@ -130,3 +175,1080 @@ func TestEmptyBody(t *testing.T) {
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+// strictReader serves data and fails the test if read again afterwards, as a
+// connection with nothing more to send would block
+type strictReader struct {
+	t    *testing.T
+	data *strings.Reader
+}
+
+func (sr *strictReader) Read(p []byte) (int, error) {
+	if sr.data.Len() == 0 {
+		sr.t.Errorf("read past the end of the request")
+		return 0, io.EOF
+	}
+	return sr.data.Read(p)
+}
+
+func TestBodyAcrossReads(t *testing.T) {
+	body := strings.Repeat("0123456789", 500)
+
+	// Test: Body arriving a few bytes per read
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5000\r\n" +
+			"\r\n" + body,
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(r.Body))
+
+	// Test: Complete without another read once Content-Length bytes are in
+	r, err = RequestFromReader(&strictReader{t: t, data: strings.NewReader(
+		"POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello")})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Nor with an empty body
+	r, err = RequestFromReader(&strictReader{t: t, data: strings.NewReader(
+		"POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 0\r\n\r\n")})
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	// Test: Connection closed partway through the body or headers
+	_, err = RequestFromReader(strings.NewReader(
+		"POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5000\r\n\r\n" + body[:4999]))
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: local"))
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: Negative length
+	_, err = RequestFromReader(strings.NewReader(
+		"POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: -1\r\n\r\n"))
+	require.ErrorIs(t, err, ErrBadContentLength)
+}
+
+func TestOneBytePerRead(t *testing.T) {
+	const post = "POST /submit?draft=1 HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\n" +
+		"Content-Length: 22\r\n" +
+		"\r\n" +
+		"name=tea&size=large&x="
+	check := func(r *Request) {
+		t.Helper()
+		assert.Equal(t, "POST", r.RequestLine.Method)
+		assert.Equal(t, "/submit", r.Path())
+		assert.Equal(t, "1", r.Params["draft"])
+		assert.Equal(t, "localhost:42069", r.Host)
+		assert.Equal(t, "application/x-www-form-urlencoded", r.Headers.Get("content-type"))
+		assert.Equal(t, "name=tea&size=large&x=", string(r.Body))
+	}
+
+	// Test: A whole POST arriving a byte at a time
+	r, err := RequestFromReader(iotest.OneByteReader(strings.NewReader(post)))
+	require.NoError(t, err)
+	check(r)
+
+	// Test: The last byte coming with io.EOF
+	r, err = RequestFromReader(iotest.DataErrReader(iotest.OneByteReader(strings.NewReader(post))))
+	require.NoError(t, err)
+	check(r)
+
+	// Test: A chunked body
+	r, err = RequestFromReader(iotest.OneByteReader(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2;x=y\r\nde\r\n0\r\nX-Sum: 1\r\n\r\n")))
+	require.NoError(t, err)
+	assert.Equal(t, "abcde", string(r.Body))
+	assert.Equal(t, "1", r.Headers.Get("x-sum"))
+
+	// Test: Pipelined requests, deferred bodies included, stay apart
+	for _, opts := range []Options{{}, {DeferBody: true}} {
+		reader := NewReader(iotest.OneByteReader(strings.NewReader(post + post + "GET /last HTTP/1.1\r\nHost: a\r\n\r\n")))
+		for range 2 {
+			r, err = reader.ReadRequest(opts)
+			require.NoError(t, err)
+			_, err = r.ReadBody()
+			require.NoError(t, err)
+			check(r)
+		}
+		r, err = reader.ReadRequest(opts)
+		require.NoError(t, err)
+		assert.Equal(t, "/last", r.Path())
+		assert.Empty(t, r.Body)
+	}
+
+	// Test: Cut off a byte short of the body
+	_, err = RequestFromReader(iotest.OneByteReader(strings.NewReader(post[:len(post)-1])))
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+}
+
+func TestChunkedBody(t *testing.T) {
+	const head = "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	// Test: Chunks arriving a few bytes per read
+	reader := &chunkReader{
+		data:            head + "5\r\nhello\r\n7;ext=1\r\n, world\r\n1A\r\n" + strings.Repeat("!", 26) + "\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world"+strings.Repeat("!", 26), string(r.Body))
+
+	// Test: Trailers are merged into the headers, framing ones are not
+	r, err = RequestFromReader(&strictReader{t: t, data: strings.NewReader(head +
+		"4\r\ndata\r\n0\r\nX-Checksum: abc123\r\nContent-Length: 99\r\n\r\n")})
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(r.Body))
+	assert.Equal(t, "abc123", r.Headers.Get("x-checksum"))
+	assert.Empty(t, r.Headers.Get("content-length"))
+
+	// Test: Empty body
+	r, err = RequestFromReader(strings.NewReader(head + "0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	// Test: Transfer-Encoding wins over Content-Length
+	r, err = RequestFromReader(strings.NewReader("POST /upload HTTP/1.1\r\nHost: localhost:42069\r\n" +
+		"Content-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+	assert.Empty(t, r.Headers.Get("content-length"))
+
+	// Test: Malformed chunks
+	_, err = RequestFromReader(strings.NewReader(head + "zz\r\nhello\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrBadChunk)
+	_, err = RequestFromReader(strings.NewReader(head + "3\r\nhello\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrBadChunk)
+	_, err = RequestFromReader(strings.NewReader(head + "fffffffff\r\n"))
+	require.ErrorIs(t, err, ErrBadChunk)
+
+	// Test: Connection closed before the last chunk
+	_, err = RequestFromReader(strings.NewReader(head + "5\r\nhello\r\n"))
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+}
+
+func TestReaderPipelined(t *testing.T) {
+	reader := NewReaderSize(&chunkReader{
+		data: "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\none" +
+			"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"POST /c HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nthree\r\n0\r\n\r\n",
+		numBytesPerRead: 200,
+	}, 16)
+
+	for _, want := range []struct{ path, body string }{{"/a", "one"}, {"/b", ""}, {"/c", "three"}} {
+		r, err := reader.ReadRequest(Options{})
+		require.NoError(t, err)
+		assert.Equal(t, want.path, r.Path())
+		assert.Equal(t, want.body, string(r.Body))
+	}
+
+	// Test: Nothing left
+	r, err := reader.ReadRequest(Options{})
+	require.NoError(t, err)
+	assert.Empty(t, r.RequestLine.Method)
+}
+
+// repeatReader serves data over and over, never more than one copy per Read
+type repeatReader struct {
+	data []byte
+	pos  int
+}
+
+func (rr *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, rr.data[rr.pos:])
+	rr.pos = (rr.pos + n) % len(rr.data)
+	return n, nil
+}
+
+func BenchmarkKeepAliveRequests(b *testing.B) {
+	raw := []byte("POST /api/items HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n" +
+		"User-Agent: bench\r\nContent-Length: 13\r\n\r\nhello, world!")
+
+	// One Reader for the whole connection
+	b.Run("reader", func(b *testing.B) {
+		b.ReportAllocs()
+		reader := NewReader(&repeatReader{data: raw})
+		for b.Loop() {
+			if _, err := reader.ReadRequest(Options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// A fresh buffer for every request
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		conn := &repeatReader{data: raw}
+		for b.Loop() {
+			if _, err := RequestFromReader(conn); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestQueryAll(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET /search?tag=go&q=tcp&tag=http HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"go", "http"}, r.QueryAll("tag"))
+	assert.Equal(t, []string{"tcp"}, r.QueryAll("q"))
+	assert.Nil(t, r.QueryAll("missing"))
+
+	// Test: Params keeps the last value
+	assert.Equal(t, "http", r.Params["tag"])
+
+	// Test: Clones don't share the value slices
+	clone := r.Clone()
+	clone.ParamsMulti["tag"][0] = "rust"
+	assert.Equal(t, []string{"go", "http"}, r.QueryAll("tag"))
+
+	// Test: SetTarget replaces them
+	r.SetTarget("/search?tag=zig")
+	assert.Equal(t, []string{"zig"}, r.QueryAll("tag"))
+	assert.Nil(t, r.QueryAll("q"))
+}
+
+func TestParseForm(t *testing.T) {
+	post := func(target, contentType, body string) *Request {
+		r, err := RequestFromReader(strings.NewReader("POST " + target + " HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: " + contentType + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+		require.NoError(t, err)
+		return r
+	}
+
+	// Test: Body values come before query values
+	r := post("/signup?name=query&ref=ad", "application/x-www-form-urlencoded; charset=utf-8", "name=Ada+Lovelace&lang=go&lang=zig")
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "Ada Lovelace", r.FormValue("name"))
+	assert.Equal(t, []string{"Ada Lovelace", "query"}, r.Form["name"])
+	assert.Equal(t, []string{"go", "zig"}, r.Form["lang"])
+	assert.Equal(t, "ad", r.FormValue("ref"))
+	assert.Empty(t, r.PostFormValue("ref"))
+	assert.Empty(t, r.FormValue("missing"))
+
+	// Test: Empty body
+	r = post("/signup?ref=ad", "application/x-www-form-urlencoded", "")
+	require.NoError(t, r.ParseForm())
+	assert.Empty(t, r.PostForm)
+	assert.Equal(t, "ad", r.FormValue("ref"))
+
+	// Test: Malformed encoding still leaves the query values
+	r = post("/signup?ref=ad", "application/x-www-form-urlencoded", "name=%zz")
+	require.ErrorIs(t, r.ParseForm(), ErrBadForm)
+	assert.Empty(t, r.FormValue("name"))
+	assert.Equal(t, "ad", r.FormValue("ref"))
+
+	// Test: Other content types aren't read
+	r = post("/signup", "application/json", `{"name":"Ada"}`)
+	require.NoError(t, r.ParseForm())
+	assert.Empty(t, r.PostForm)
+
+	// Test: Nor are GET bodies
+	r, err := RequestFromReader(strings.NewReader("GET /signup?ref=ad HTTP/1.1\r\nHost: localhost:42069\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: 8\r\n\r\nname=Ada"))
+	require.NoError(t, err)
+	assert.Empty(t, r.FormValue("name"))
+	assert.Equal(t, "ad", r.FormValue("ref"))
+}
+
+func TestWebhookSignature(t *testing.T) {
+	secret := []byte("whsec_test")
+	payload := `{"event":"invoice.paid","amount":4200}`
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	r, err := RequestFromReader(strings.NewReader("POST /webhooks HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: application/json\r\n" +
+		"X-Signature: " + signature + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(payload)) + "\r\n\r\n" + payload))
+	require.NoError(t, err)
+
+	var event struct {
+		Event  string `json:"event"`
+		Amount int    `json:"amount"`
+	}
+	require.NoError(t, r.DecodeJSON(&event))
+	assert.Equal(t, "invoice.paid", event.Event)
+	assert.Equal(t, 4200, event.Amount)
+
+	// Test: The raw body is still there to verify after decoding
+	mac = hmac.New(sha256.New, secret)
+	mac.Write(r.Body)
+	assert.Equal(t, r.Headers.Get("x-signature"), hex.EncodeToString(mac.Sum(nil)))
+
+	// Test: So is the reader
+	data, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(data))
+
+	// Test: Parsing a form doesn't consume it either
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, payload, string(r.Body))
+}
+
+func TestMultipartForm(t *testing.T) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("title", "Quarterly report"))
+	require.NoError(t, mw.WriteField("visibility", "team"))
+	fw, err := mw.CreateFormFile("attachment", "report.csv")
+	require.NoError(t, err)
+	fileData := strings.Repeat("region,total\nnorth,42\n", 100)
+	fw.Write([]byte(fileData))
+	require.NoError(t, mw.Close())
+
+	parse := func(contentType string) *Request {
+		r, err := RequestFromReader(strings.NewReader("POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: " + contentType + "\r\n" +
+			"Content-Length: " + strconv.Itoa(body.Len()) + "\r\n\r\n" + body.String()))
+		require.NoError(t, err)
+		return r
+	}
+
+	r := parse(mw.FormDataContentType())
+	form, err := r.MultipartForm()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Quarterly report"}, form.Value["title"])
+	assert.Equal(t, []string{"team"}, form.Value["visibility"])
+	require.Len(t, form.File["attachment"], 1)
+
+	file := form.File["attachment"][0]
+	assert.Equal(t, "report.csv", file.Filename)
+	assert.Equal(t, int64(len(fileData)), file.Size)
+	assert.Equal(t, "application/octet-stream", file.Header.Get("content-type"))
+	f, err := file.Open()
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, fileData, string(data))
+
+	// Test: Parsed once, shared with copies
+	again, err := r.WithContext(context.Background()).MultipartForm()
+	require.NoError(t, err)
+	assert.Same(t, form, again)
+
+	// Test: A file past the memory threshold still reads back whole
+	r = parse(mw.FormDataContentType())
+	form, err = r.ParseMultipartForm(64)
+	require.NoError(t, err)
+	f, err = form.File["attachment"][0].Open()
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, fileData, string(data))
+	require.NoError(t, r.RemoveTempFiles())
+
+	// Test: Not multipart, or missing the boundary
+	_, err = parse("application/json").MultipartForm()
+	require.ErrorIs(t, err, ErrNotMultipart)
+	_, err = parse("multipart/form-data").MultipartForm()
+	require.ErrorIs(t, err, ErrBadMultipart)
+	_, err = parse("multipart/form-data; boundary=wrong").MultipartForm()
+	require.ErrorIs(t, err, ErrBadMultipart)
+}
+
+func TestMultipartFormStreamed(t *testing.T) {
+	const size = 8 << 20
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("title", "backup"))
+	fw, err := mw.CreateFormFile("archive", "backup.tar")
+	require.NoError(t, err)
+	fw.Write(bytes.Repeat([]byte("0123456789abcdef"), size/16))
+	require.NoError(t, mw.Close())
+
+	reader := NewReader(io.MultiReader(strings.NewReader("POST /upload HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Content-Type: "+mw.FormDataContentType()+"\r\n"+
+		"Content-Length: "+strconv.Itoa(body.Len())+"\r\n\r\n"), body))
+	r, err := reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { r.RemoveTempFiles() })
+
+	// Test: The upload goes from the connection to a temporary file without
+	// the body being buffered on the way
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	form, err := r.ParseMultipartForm(1 << 10)
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/4))
+	assert.Empty(t, r.Body)
+	assert.False(t, r.BodyPending())
+	assert.Equal(t, []string{"backup"}, form.Value["title"])
+
+	require.Len(t, form.File["archive"], 1)
+	assert.Equal(t, int64(size), form.File["archive"][0].Size)
+	f, err := form.File["archive"][0].Open()
+	require.NoError(t, err)
+	defer f.Close()
+	_, onDisk := f.(*os.File)
+	assert.True(t, onDisk, "expected a part past maxMemory in a temporary file")
+	n, err := io.Copy(io.Discard, f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+}
+
+func TestBindJSON(t *testing.T) {
+	parse := func(contentType, body string) *Request {
+		r, err := RequestFromReader(strings.NewReader("POST /items HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: " + contentType + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+		require.NoError(t, err)
+		return r
+	}
+	type item struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	// Test: Valid
+	var got item
+	require.NoError(t, parse("application/json; charset=utf-8", `{"name":"widget","count":3}`).BindJSON(&got))
+	assert.Equal(t, item{Name: "widget", Count: 3}, got)
+	require.NoError(t, parse("application/merge-patch+json", `{"count":4}`).BindJSON(&got))
+	assert.Equal(t, 4, got.Count)
+
+	// Test: Malformed, wrong types and empty
+	err := parse("application/json", `{"name":"widget",`).BindJSON(&got)
+	require.ErrorIs(t, err, ErrBadJSON)
+	assert.Contains(t, err.Error(), "unexpected EOF")
+	err = parse("application/json", `{"count":"three"}`).BindJSON(&got)
+	require.ErrorIs(t, err, ErrBadJSON)
+	assert.Contains(t, err.Error(), "count")
+	require.ErrorIs(t, parse("application/json", "").BindJSON(&got), ErrBadJSON)
+	err = parse("application/json", `{"count":5} {"count":6}`).BindJSON(&got)
+	require.ErrorIs(t, err, ErrBadJSON)
+	assert.Contains(t, err.Error(), "data after")
+
+	// Test: Wrong content type
+	err = parse("text/plain", `{"name":"widget"}`).BindJSON(&got)
+	require.ErrorIs(t, err, ErrNotJSON)
+	assert.Contains(t, err.Error(), "text/plain")
+
+	// Test: Over the limit
+	r := parse("application/json", `{"name":"`+strings.Repeat("w", 100)+`"}`)
+	require.ErrorIs(t, r.BindJSONLimit(&got, 64), ErrBodyTooLarge)
+	require.NoError(t, r.BindJSON(&got))
+	require.ErrorIs(t, parse("application/json", `{"count":1}`+strings.Repeat(" ", 100)).BindJSONLimit(&got, 64), ErrBodyTooLarge)
+
+	// Test: A deferred body over the limit is refused without reading it to
+	// the end
+	const size = 64 << 20
+	rest := &io.LimitedReader{R: &repeatReader{data: bytes.Repeat([]byte("w"), 4096)}, N: size}
+	reader := NewReader(io.MultiReader(
+		strings.NewReader("POST /items HTTP/1.1\r\nHost: localhost:42069\r\nContent-Type: application/json\r\n"+
+			"Content-Length: "+strconv.Itoa(size+len(`{"name":""}`))+"\r\n\r\n"+`{"name":"`),
+		rest,
+		strings.NewReader(`"}`),
+	))
+	r, err = reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	require.ErrorIs(t, r.BindJSONLimit(&got, 1<<10), ErrBodyTooLarge)
+	assert.Less(t, int64(size)-rest.N, int64(64<<10))
+	assert.True(t, r.BodyPending())
+}
+
+func TestForwardBody(t *testing.T) {
+	const size = 64 << 20
+	data := func() io.Reader {
+		return io.LimitReader(&repeatReader{data: bytes.Repeat([]byte("x"), 4096)}, size)
+	}
+	upload := func(body ...io.Reader) *Request {
+		reader := NewReader(io.MultiReader(body...))
+		r, err := reader.ReadRequest(Options{DeferBody: true})
+		require.NoError(t, err)
+		return r
+	}
+	sized := func() *Request {
+		return upload(strings.NewReader("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: "+strconv.Itoa(size)+"\r\n\r\n"), data())
+	}
+	// upstream accepts one connection and reports how much it read, after
+	// reading at most limit bytes and hanging up
+	upstream := func(limit int64) (net.Conn, <-chan int64) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		received := make(chan int64, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				received <- -1
+				return
+			}
+			n, _ := io.Copy(io.Discard, io.LimitReader(conn, limit))
+			conn.Close()
+			received <- n
+		}()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn, received
+	}
+	forward := func(r *Request) {
+		conn, received := upstream(size + 1)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		n, err := r.ForwardBody(conn)
+		runtime.ReadMemStats(&after)
+		require.NoError(t, err)
+		conn.(*net.TCPConn).CloseWrite()
+		assert.Equal(t, int64(size), n)
+		assert.Equal(t, int64(size), <-received)
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/16))
+		assert.Empty(t, r.Body)
+		assert.False(t, r.BodyPending())
+	}
+
+	// Test: The whole body reaches the upstream without being buffered
+	forward(sized())
+
+	// Test: So does a body sent as one huge chunk, taken as it arrives
+	// rather than once the whole chunk is in
+	forward(upload(
+		strings.NewReader("POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			strconv.FormatInt(size, 16)+"\r\n"),
+		data(),
+		strings.NewReader("\r\n0\r\n\r\n"),
+	))
+
+	// Test: An upstream hanging up partway stops the copy with
+	// ErrForwardWrite, leaving the rest of the body unread
+	r := sized()
+	conn, received := upstream(1 << 20)
+	n, err := r.ForwardBody(conn)
+	assert.ErrorIs(t, err, ErrForwardWrite)
+	assert.Less(t, n, int64(size))
+	assert.Equal(t, int64(1<<20), <-received)
+	assert.True(t, r.BodyPending())
+}
+
+func TestUserAgentAndReferer(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"User-Agent: curl/8.5.0\r\n" +
+		"Referer: https://example.com/links\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "curl/8.5.0", r.UserAgent())
+	assert.Equal(t, "https://example.com/links", r.Referer())
+
+	// Test: Referrer spelled correctly
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Referrer: https://example.com/spelled\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/spelled", r.Referer())
+
+	// Test: Absent
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.UserAgent())
+	assert.Empty(t, r.Referer())
+}
+
+func TestCookies(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Cookie: session=abc123; theme=dark;  lang=\"en-NZ\" ; session=older; empty=; broken\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"session": "abc123",
+		"theme":   "dark",
+		"lang":    "en-NZ",
+		"empty":   "",
+	}, r.Cookies())
+
+	value, err := r.Cookie("theme")
+	require.NoError(t, err)
+	assert.Equal(t, "dark", value)
+
+	// Test: First of a duplicated name wins
+	value, err = r.Cookie("session")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", value)
+
+	// Test: Missing cookie
+	_, err = r.Cookie("cart")
+	assert.ErrorIs(t, err, ErrNoCookie)
+
+	// Test: No Cookie header
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Cookies())
+	_, err = r.Cookie("session")
+	assert.ErrorIs(t, err, ErrNoCookie)
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	newReq := func(ifMatch string) *Request {
+		reader := &chunkReader{
+			data:            "PUT /items/1 HTTP/1.1\r\nHost: localhost:42069\r\nIf-Match: " + ifMatch + "\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		return r
+	}
+
+	// Test: Matching etag
+	assert.True(t, CheckIfMatch(newReq(`"v2"`), `"v2"`))
+	assert.True(t, CheckIfMatch(newReq(`"v1", "v2"`), "v2"))
+
+	// Test: Non-matching etag
+	assert.False(t, CheckIfMatch(newReq(`"v1"`), `"v2"`))
+	assert.False(t, CheckIfMatch(newReq(`W/"v2"`), `"v2"`))
+
+	// Test: Wildcard matches any existing resource
+	assert.True(t, CheckIfMatch(newReq("*"), `"v2"`))
+	assert.False(t, CheckIfMatch(newReq("*"), ""))
+}
+
+func TestOversizedHeaderLine(t *testing.T) {
+	// Test: A header line longer than any buffer is rejected instead of stalling
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nX-Huge: " + strings.Repeat("a", 1<<20) + "\r\n\r\n",
+		numBytesPerRead: 1024,
+	}
+	_, err := RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrHeaderLineTooLong)
+
+	// Test: Long lines under the limit still parse once the buffer grows
+	long := strings.Repeat("b", 4000)
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nX-Long: " + long + "\r\n\r\n",
+		numBytesPerRead: 100,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, long, r.Headers.Get("x-long"))
+}
+
+func TestClone(t *testing.T) {
+	reader := &chunkReader{
+		data: "POST /items/5?sort=asc HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"X-Trace: original\r\n" +
+			"Content-Length: 8\r\n" +
+			"\r\n" +
+			"original",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	r.Vars["id"] = "5"
+
+	clone := r.Clone()
+	clone.Headers.Replace("x-trace", "changed")
+	clone.Headers.Set("x-extra", "added")
+	clone.Body[0] = 'O'
+	clone.Body = append(clone.Body, " and more"...)
+	clone.Vars["id"] = "6"
+	clone.Params["sort"] = "desc"
+	clone.RequestLine.RequestTarget = "/elsewhere"
+
+	assert.Equal(t, "original", r.Headers.Get("x-trace"))
+	assert.Equal(t, "", r.Headers.Get("x-extra"))
+	assert.Equal(t, "original", string(r.Body))
+	assert.Equal(t, "5", r.Vars["id"])
+	assert.Equal(t, "asc", r.Params["sort"])
+	assert.Equal(t, "/items/5?sort=asc", r.RequestLine.RequestTarget)
+	assert.Equal(t, r.Context(), clone.Context())
+}
+
+func encodedBodyRequest(t *testing.T, encoding string, body []byte) *Request {
+	t.Helper()
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Encoding: " + encoding + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" +
+			string(body),
+		numBytesPerRead: 64,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecompressBody(t *testing.T) {
+	plain := []byte(strings.Repeat("hello compressed world\n", 50))
+
+	// Test: gzip body
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(plain)
+	gw.Close()
+
+	r := encodedBodyRequest(t, "gzip", gz.Bytes())
+	require.NoError(t, r.Decompress(1<<20))
+	assert.Equal(t, plain, r.Body)
+	assert.Equal(t, "", r.Headers.Get("content-encoding"))
+	assert.Equal(t, strconv.Itoa(len(plain)), r.Headers.Get("content-length"))
+
+	// Test: deflate body
+	var zl bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	zw.Write(plain)
+	zw.Close()
+
+	r = encodedBodyRequest(t, "deflate", zl.Bytes())
+	require.NoError(t, r.Decompress(1<<20))
+	assert.Equal(t, plain, r.Body)
+
+	// Test: Decompression bomb past the limit
+	var bomb bytes.Buffer
+	bw, _ := gzip.NewWriterLevel(&bomb, gzip.BestCompression)
+	bw.Write(make([]byte, 10<<20))
+	bw.Close()
+	require.Less(t, bomb.Len(), 64<<10)
+
+	r = encodedBodyRequest(t, "gzip", bomb.Bytes())
+	require.ErrorIs(t, r.Decompress(1<<20), ErrBodyTooLarge)
+
+	// Test: Unknown encodings are refused
+	r = encodedBodyRequest(t, "br", []byte("whatever"))
+	require.ErrorIs(t, r.Decompress(1<<20), ErrUnsupportedEncoding)
+
+	// Test: A deferred body is left on the connection, and decoded as it is
+	// read
+	deferred := func(encoding string, body []byte) *Request {
+		reader := NewReader(io.MultiReader(
+			strings.NewReader("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: "+encoding+
+				"\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"),
+			bytes.NewReader(body),
+		))
+		r, err := reader.ReadRequest(Options{DeferBody: true})
+		require.NoError(t, err)
+		return r
+	}
+	r = deferred("gzip", gz.Bytes())
+	require.NoError(t, r.Decompress(1<<20))
+	assert.True(t, r.BodyPending())
+	assert.Empty(t, r.Headers.Get("content-encoding"))
+	assert.Empty(t, r.Headers.Get("content-length"))
+	got, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, plain, got)
+
+	r = deferred("deflate", zl.Bytes())
+	require.NoError(t, r.Decompress(1<<20))
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, plain, body)
+
+	r = deferred("gzip", bomb.Bytes())
+	require.NoError(t, r.Decompress(1<<20))
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	r = deferred("br", []byte("whatever"))
+	require.ErrorIs(t, r.Decompress(1<<20), ErrUnsupportedEncoding)
+	assert.True(t, r.BodyPending())
+}
+
+func TestRequestTarget(t *testing.T) {
+	parse := func(method, target string) (*Request, error) {
+		reader := &chunkReader{
+			data:            method + " " + target + " HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		return RequestFromReader(reader)
+	}
+
+	// Test: Valid origin-form path with query and percent-encoding
+	r, err := parse("GET", "/files/my%20file.txt?v=1&q=a+b")
+	require.NoError(t, err)
+	assert.Equal(t, "/files/my%20file.txt", r.Path())
+
+	// Test: Raw control character
+	_, err = parse("GET", "/files/\x01secret")
+	require.ErrorIs(t, err, ErrBadRequestTarget)
+
+	// Test: Broken percent-encoding and disallowed characters
+	_, err = parse("GET", "/files/100%")
+	require.ErrorIs(t, err, ErrBadRequestTarget)
+	_, err = parse("GET", "/files/%zz")
+	require.ErrorIs(t, err, ErrBadRequestTarget)
+	_, err = parse("GET", "/a<b>")
+	require.ErrorIs(t, err, ErrBadRequestTarget)
+	_, err = parse("GET", "/page#section")
+	require.ErrorIs(t, err, ErrBadRequestTarget)
+
+	// Test: Asterisk-form, only for OPTIONS
+	r, err = parse("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, "*", r.RequestLine.RequestTarget)
+	_, err = parse("GET", "*")
+	require.ErrorIs(t, err, ErrBadRequestTarget)
+
+	// Test: Absolute-form routes on its path
+	r, err = parse("GET", "http://localhost:42069/users/7?full=1")
+	require.NoError(t, err)
+	assert.Equal(t, "/users/7", r.Path())
+	assert.Equal(t, "1", r.Params["full"])
+	r, err = parse("GET", "http://localhost:42069")
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.Path())
+
+	// Test: Neither origin nor absolute form
+	_, err = parse("GET", "users/7")
+	require.ErrorIs(t, err, ErrBadRequestTarget)
+}
+
+func TestURL(t *testing.T) {
+	reader := &chunkReader{
+		data:            "GET /users/7?full=1 HTTP/1.1\r\nHost: example.com:8080\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:8080", r.Host)
+	assert.Equal(t, "http://example.com:8080/users/7?full=1", r.URL().String())
+
+	r.Scheme = "https"
+	assert.Equal(t, "https://example.com:8080/users/7?full=1", r.URL().String())
+
+	// Test: Absolute-form takes the host from the target
+	reader = &chunkReader{
+		data:            "GET https://other.example/a?b=c HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "other.example", r.Host)
+	assert.Equal(t, "https://other.example/a?b=c", r.URL().String())
+}
+
+func TestBareLF(t *testing.T) {
+	parse := func(raw string, opts Options) (*Request, error) {
+		return RequestFromReaderWithOptions(&chunkReader{data: raw, numBytesPerRead: 3}, opts)
+	}
+
+	// Test: Bare LF after the request line
+	_, err := parse("GET / HTTP/1.1\nHost: localhost:42069\r\n\r\n", Options{})
+	require.ErrorIs(t, err, headers.ErrBareLF)
+
+	// Test: Bare LF after a header
+	_, err = parse("GET / HTTP/1.1\r\nHost: localhost:42069\nX-Other: 1\r\n\r\n", Options{})
+	require.ErrorIs(t, err, headers.ErrBareLF)
+
+	// Test: Bare LF ending the header block
+	_, err = parse("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\n", Options{})
+	require.ErrorIs(t, err, headers.ErrBareLF)
+
+	// Test: Lenient mode reads every line the same way
+	r, err := parse("GET /lenient HTTP/1.1\nHost: localhost:42069\r\nX-Mixed: yes\n\n", Options{AllowBareLF: true})
+	require.NoError(t, err)
+	assert.Equal(t, "/lenient", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+	assert.Equal(t, "yes", r.Headers.Get("x-mixed"))
+
+	// Test: A CR that doesn't end a line is never accepted
+	_, err = parse("GET / HTTP/1.1\r\nHost: local\rhost\r\n\r\n", Options{AllowBareLF: true})
+	require.ErrorIs(t, err, headers.ErrBareCR)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	newReq := func(acceptEncoding string) *Request {
+		raw := "GET / HTTP/1.1\r\nHost: localhost:42069\r\n"
+		if acceptEncoding != "" {
+			raw += "Accept-Encoding: " + acceptEncoding + "\r\n"
+		}
+		r, err := RequestFromReader(strings.NewReader(raw + "\r\n"))
+		require.NoError(t, err)
+		return r
+	}
+
+	cases := []struct {
+		header   string
+		gzip     bool
+		identity bool
+	}{
+		{"", false, true},
+		{"gzip", true, true},
+		{"gzip, deflate, br", true, true},
+		{"deflate, GZIP;q=0.5", true, true},
+		{"br", false, true},
+		{"gzip;q=0", false, true},
+		{"gzip; q=0.000", false, true},
+		{"*", true, true},
+		{"*;q=0", false, false},
+		{"gzip;q=0, *", false, true},
+		{"identity;q=0, gzip", true, false},
+		{"br, *;q=0", false, false},
+	}
+	for _, c := range cases {
+		r := newReq(c.header)
+		assert.Equal(t, c.gzip, r.AcceptsEncoding("gzip"), "gzip for %q", c.header)
+		assert.Equal(t, c.identity, r.AcceptsEncoding("identity"), "identity for %q", c.header)
+	}
+}
+
+func TestRepeatedContentLength(t *testing.T) {
+	// Test: The same length twice is one length
+	r, err := RequestFromReader(strings.NewReader("POST /upload HTTP/1.1\r\nHost: localhost:42069\r\n" +
+		"Content-Length: 5\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, []string{"5"}, r.Headers.Values("content-length"))
+
+	// Test: Differing lengths
+	_, err = RequestFromReader(strings.NewReader("POST /upload HTTP/1.1\r\nHost: localhost:42069\r\n" +
+		"Content-Length: 5\r\nContent-Length: 11\r\n\r\nhello world"))
+	require.ErrorIs(t, err, ErrBadContentLength)
+}
+
+func TestDeferBody(t *testing.T) {
+	const size = 64 << 20
+	head := "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n"
+	next := "GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	reader := NewReader(io.MultiReader(
+		strings.NewReader(head),
+		io.LimitReader(&repeatReader{data: bytes.Repeat([]byte("x"), 4096)}, size),
+		strings.NewReader(next),
+	))
+
+	// Test: The request comes back before its body is read
+	r, err := reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.Path())
+	assert.Empty(t, r.Body)
+	assert.True(t, r.BodyPending())
+
+	// Test: Streaming the body doesn't buffer it
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := io.Copy(io.Discard, r.BodyReader())
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/16))
+	assert.False(t, r.BodyPending())
+
+	r, err = reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.Path())
+	assert.False(t, r.BodyPending())
+
+	// Test: ReadBody reads a chunked body and its trailers, for every copy
+	reader = NewReader(strings.NewReader("POST /c HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+	r, err = reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	r2 := r.WithContext(context.Background())
+	body, err := r2.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "abc", r.Headers.Get("x-checksum"))
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "hello world", string(r.Body))
+
+	// Test: An unread body is skipped on the way to the next request
+	reader = NewReaderSize(&chunkReader{
+		data: "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\none" +
+			"POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\ntwo",
+		numBytesPerRead: 7,
+	}, 16)
+	r, err = reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.Path())
+	r, err = reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.Path())
+	require.NoError(t, r.ParseForm())
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(body))
+
+	// Test: DiscardBody gives up past its limit
+	reader = NewReaderSize(&chunkReader{
+		data:            "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world",
+		numBytesPerRead: 4,
+	}, 16)
+	r, err = reader.ReadRequest(Options{DeferBody: true})
+	require.NoError(t, err)
+	require.ErrorIs(t, r.DiscardBody(5), ErrBodyTooLarge)
+	assert.True(t, r.BodyPending())
+}
+
+func TestParamAccessors(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET /users/42/true HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	r.Vars = map[string]string{"id": "42", "big": "9007199254740993", "active": "true", "name": "ada", "neg": "-7"}
+
+	// Test: Present values
+	id, err := r.ParamInt("id")
+	require.NoError(t, err)
+	assert.Equal(t, 42, id)
+	neg, err := r.ParamInt("neg")
+	require.NoError(t, err)
+	assert.Equal(t, -7, neg)
+	big, err := r.ParamInt64("big")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), big)
+	active, err := r.ParamBool("active")
+	require.NoError(t, err)
+	assert.True(t, active)
+
+	// Test: Missing values
+	_, err = r.ParamInt("page")
+	assert.ErrorIs(t, err, ErrNoParam)
+	assert.Contains(t, err.Error(), "page")
+	_, err = r.ParamInt64("page")
+	assert.ErrorIs(t, err, ErrNoParam)
+	_, err = r.ParamBool("page")
+	assert.ErrorIs(t, err, ErrNoParam)
+
+	// Test: Malformed values
+	_, err = r.ParamInt("name")
+	assert.ErrorIs(t, err, ErrBadParam)
+	assert.Contains(t, err.Error(), `name "ada"`)
+	_, err = r.ParamInt64("active")
+	assert.ErrorIs(t, err, ErrBadParam)
+	_, err = r.ParamBool("id")
+	assert.ErrorIs(t, err, ErrBadParam)
+
+	// Test: Out of range for an int64
+	r.Vars["huge"] = "99999999999999999999"
+	_, err = r.ParamInt64("huge")
+	assert.ErrorIs(t, err, ErrBadParam)
+}
+
+func TestHeadSizeLimits(t *testing.T) {
+	// Test: A request line that never ends fails once it passes the line cap
+	endless := io.MultiReader(strings.NewReader("GET /"), &repeatReader{data: []byte("a")})
+	_, err := RequestFromReader(iotest.OneByteReader(endless))
+	assert.ErrorIs(t, err, ErrURITooLong)
+
+	// Test: So does one that ends too late
+	long := "GET /" + strings.Repeat("a", headers.MaxLineLength) + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	_, err = RequestFromReader(strings.NewReader(long))
+	assert.ErrorIs(t, err, ErrURITooLong)
+
+	// Test: A request line right at the cap is fine
+	line := "GET /" + strings.Repeat("a", headers.MaxLineLength-len("GET / HTTP/1.1")) + " HTTP/1.1"
+	r, err := RequestFromReader(iotest.OneByteReader(strings.NewReader(line + "\r\nHost: localhost\r\n\r\n")))
+	require.NoError(t, err)
+	assert.Len(t, r.RequestLine.RequestTarget, headers.MaxLineLength-len("GET  HTTP/1.1"))
+
+	// Test: Headers that keep coming fail once the head passes MaxHeadSize
+	endless = io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n"),
+		&repeatReader{data: []byte("X-Filler: " + strings.Repeat("a", 100) + "\r\n")})
+	_, err = RequestFromReader(endless)
+	assert.ErrorIs(t, err, ErrHeadTooLarge)
+}
@@ -0,0 +1,83 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrBadRequestTarget is returned for a request target that isn't a valid
+// URI, such as one containing spaces, control characters or broken
+// percent-encoding.
+var ErrBadRequestTarget = fmt.Errorf("invalid request target")
+
+// validateTarget checks target against the request-target forms of RFC 7230
+// section 5.3 this server understands: origin-form ("/path?query"),
+// absolute-form ("http://host/path") and, for OPTIONS, asterisk-form ("*").
+func validateTarget(method, target string) error {
+	if target == "*" {
+		if method == "OPTIONS" {
+			return nil
+		}
+		return ErrBadRequestTarget
+	}
+
+	rest := target
+	if !strings.HasPrefix(target, "/") {
+		scheme, after, ok := strings.Cut(target, "://")
+		if !ok || !validScheme(scheme) || after == "" {
+			return ErrBadRequestTarget
+		}
+		rest = after
+	}
+
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(rest) || !isHex(rest[i+1]) || !isHex(rest[i+2]) {
+				return ErrBadRequestTarget
+			}
+			i += 2
+		case !isURIChar(c):
+			return ErrBadRequestTarget
+		}
+	}
+	return nil
+}
+
+// validScheme reports whether s is an RFC 3986 scheme:
+// ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )
+func validScheme(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isAlpha(c) && !isDigit(c) && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isURIChar reports whether c may appear unencoded in a request target: the
+// RFC 3986 unreserved and sub-delims sets plus the path, query and
+// authority delimiters. "#" is left out, fragments are never sent.
+func isURIChar(c byte) bool {
+	if isAlpha(c) || isDigit(c) {
+		return true
+	}
+	return strings.IndexByte("-._~!$&'()*+,;=:@/?[]", c) >= 0
+}
+
+func isAlpha(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
@@ -0,0 +1,74 @@
+package response
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// WriteAttachment responds 200 with data as a file download, so browsers show
+// a save dialog for filename instead of displaying the body.
+func (w *Writer) WriteAttachment(filename string, contentType string, data []byte) error {
+	w.ReplaceHeader("content-disposition", ContentDisposition("attachment", filename))
+	w.ReplaceHeader("content-type", contentType)
+	w.ReplaceHeader("content-length", fmt.Sprintf("%d", len(data)))
+	return w.Respond(StatusOK, data)
+}
+
+// ContentDisposition builds a Content-Disposition value such as
+// `attachment; filename="report.pdf"`. Names that aren't plain ASCII also get
+// the RFC 5987 filename* form, with an ASCII approximation kept in filename
+// for clients that don't understand it.
+func ContentDisposition(disposition, filename string) string {
+	var plain strings.Builder
+	ascii := true
+	for _, r := range filename {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			// Control characters (CR and LF especially) never make it into a header
+			ascii = false
+		case r >= utf8.RuneSelf:
+			plain.WriteByte('_')
+			ascii = false
+		case r == '"' || r == '\\':
+			plain.WriteByte('\\')
+			plain.WriteRune(r)
+		default:
+			plain.WriteRune(r)
+		}
+	}
+
+	value := fmt.Sprintf(`%s; filename="%s"`, disposition, plain.String())
+	if !ascii {
+		value += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return value
+}
+
+// encodeRFC5987 percent-encodes every byte of s outside the RFC 5987 attr-char set
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		if c < 0x20 || c == 0x7f {
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,73 @@
+package response
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ResponseBuilder assembles a response through chained calls and writes it in
+// one go, e.g.
+//
+//	w.Status(200).Header("X-Foo", "bar").JSON(payload)
+//
+// Nothing reaches the client until one of JSON, HTML or Send is called.
+type ResponseBuilder struct {
+	w      *Writer
+	status StatusCode
+	body   []byte
+	err    error
+}
+
+// Status starts building a response with the given status code.
+func (w *Writer) Status(code StatusCode) *ResponseBuilder {
+	b := &ResponseBuilder{w: w, status: code}
+	if w.Started() {
+		b.err = fmt.Errorf("cannot build a %d response, the response has already been started", code)
+	}
+	return b
+}
+
+// Header sets a response header, replacing any previous value.
+func (b *ResponseBuilder) Header(key, value string) *ResponseBuilder {
+	b.w.ReplaceHeader(key, value)
+	return b
+}
+
+// Cookie adds a Set-Cookie header for name=value.
+func (b *ResponseBuilder) Cookie(name, value string) *ResponseBuilder {
+	b.w.AddHeader("Set-Cookie", name+"="+value)
+	return b
+}
+
+// Body sets the raw response body.
+func (b *ResponseBuilder) Body(body []byte) *ResponseBuilder {
+	b.body = body
+	return b
+}
+
+// JSON marshals v as the body and sends the response as application/json.
+// Marshalling errors are returned before anything is written.
+func (b *ResponseBuilder) JSON(v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.body = body
+	b.w.ReplaceHeader("content-type", "application/json")
+	return b.Send()
+}
+
+// HTML sends html as the body with a text/html content type.
+func (b *ResponseBuilder) HTML(html string) error {
+	b.body = []byte(html)
+	b.w.ReplaceHeader("content-type", "text/html")
+	return b.Send()
+}
+
+// Send writes the status line, headers and body.
+func (b *ResponseBuilder) Send() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.w.respond(b.status, b.body)
+}
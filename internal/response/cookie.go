@@ -0,0 +1,14 @@
+package response
+
+import "net/http"
+
+// SetCookie adds a Set-Cookie header for c, keeping any set before it so a
+// response can set several cookies. Path, Domain, Expires, MaxAge, Secure,
+// HttpOnly and SameSite are written as attributes when set; a cookie whose
+// name isn't a valid token is dropped, as it can't be written. Like any
+// header it has to be set before WriteHeaders.
+func (w *Writer) SetCookie(c *http.Cookie) {
+	if value := c.String(); value != "" {
+		w.AddHeader("set-cookie", value)
+	}
+}
@@ -0,0 +1,41 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// RespondGzip writes a complete response like Respond, with the body gzip
+// encoded when the client accepts it: Content-Encoding is set and
+// Content-Length is the compressed size. Clients that don't advertise gzip,
+// and bodies already given a Content-Encoding, are sent as they are.
+//
+// Either way the response depends on the client's Accept-Encoding, so it is
+// added to Vary; a cache must not hand the gzip copy to a client that can't
+// read it.
+func (w *Writer) RespondGzip(status StatusCode, body []byte) error {
+	if len(body) == 0 || w.headers.Get("content-encoding") != "" {
+		return w.Respond(status, body)
+	}
+	w.AddVary("Accept-Encoding")
+	if !w.acceptsGzip {
+		return w.Respond(status, body)
+	}
+
+	// The content type is judged on the body as written, not the compressed
+	// bytes
+	w.sniffContentType(body)
+	w.contentTypeSet = true
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	w.ReplaceHeader("content-encoding", "gzip")
+	return w.Respond(status, buf.Bytes())
+}
@@ -0,0 +1,16 @@
+package response
+
+import "encoding/json"
+
+// JSON writes a complete response with v marshalled as its body and
+// Content-Type set to application/json. If v can't be marshalled the error
+// is returned and nothing is written, so the handler can still send an error
+// response of its own.
+func (w *Writer) JSON(status StatusCode, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.ReplaceHeader("content-type", "application/json")
+	return w.Respond(status, body)
+}
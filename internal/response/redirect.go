@@ -0,0 +1,30 @@
+package response
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// ErrNotRedirect is returned by Redirect for a status that isn't one of the
+// redirect codes, or a location that can't go in a header.
+var ErrNotRedirect = fmt.Errorf("not a redirect")
+
+// Redirect sends the client to location with status, which has to be 301,
+// 302, 303, 307 or 308. A short HTML page linking to location goes with it
+// for clients that show the body instead of following the redirect.
+func (w *Writer) Redirect(status StatusCode, location string) error {
+	switch status {
+	case StatusMovedPermanently, StatusFound, StatusSeeOther, StatusTemporaryRedirect, StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("%w: status %d", ErrNotRedirect, status)
+	}
+	if strings.ContainsAny(location, "\r\n") {
+		return fmt.Errorf("%w: location %q", ErrNotRedirect, location)
+	}
+
+	w.ReplaceHeader("location", location)
+	w.ReplaceHeader("content-type", "text/html; charset=utf-8")
+	body := fmt.Appendf(nil, "<a href=\"%s\">%s</a>.\n", html.EscapeString(location), GetStatusReason(status))
+	return w.Respond(status, body)
+}
@@ -3,7 +3,11 @@ package response
 import (
 	"fmt"
 	"io"
+	"net/http"
+	"net/textproto"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/noelw19/tcptohttp/internal/headers"
 )
@@ -15,14 +19,58 @@ const (
 	writerStateStatusLine writerState = 2
 	writerStateHeaders    writerState = 3
 	writerStateBody       writerState = 4
+	writerStateDone       writerState = 5
 )
 
 type Writer struct {
 	Writer      io.Writer
 	writerState writerState
 	headers     headers.Headers
+	// cookies holds Set-Cookie values separately from headers, since each
+	// cookie has to go out on its own line rather than being comma-joined.
+	cookies []string
+	// acceptsTrailers is set when the client sent "TE: trailers"
+	acceptsTrailers bool
+	// acceptsGzip is set when the client's Accept-Encoding allows gzip
+	acceptsGzip bool
+	// chunked sends the body with Transfer-Encoding: chunked instead of a
+	// Content-Length
+	chunked bool
+	// noChunked is set for clients that can't read chunked bodies, see
+	// SetAcceptsChunked
+	noChunked bool
+	// closeDelimited is set once the headers went out without any length, the
+	// body then ends when the connection is closed
+	closeDelimited bool
+	// headResponse answers a HEAD request: headers go out as they would for
+	// GET but the body is swallowed
+	headResponse bool
+	// aborted is set when the response was given up on partway
+	aborted bool
+	// orderErr is the first call made out of order, see Err
+	orderErr error
+	// status is the code sent in the status line, zero until then
+	status StatusCode
+	// writeErr is the first error from the underlying writer, see WriteErr
+	writeErr error
+	// contentTypeSet is set once the handler chose the Content-Type itself,
+	// so Respond leaves it alone rather than sniffing the body
+	contentTypeSet bool
+	// sentChunked and sentLength are the body framing the headers announced,
+	// sentLength is -1 when they gave no Content-Length
+	sentChunked bool
+	sentLength  int64
+	// bodyWritten counts the body bytes written with WriteBody
+	bodyWritten int64
 }
 
+var ErrNotInterim = fmt.Errorf("not an interim status code")
+
+// ErrWriteOrder is returned, wrapped, when the writer is used out of order,
+// such as setting a header once the headers have gone out or writing a body
+// twice.
+var ErrWriteOrder = fmt.Errorf("you have executed the writers in the wrong order")
+
 func NewResponseWriter(w io.Writer) *Writer {
 	return &Writer{
 		Writer:      w,
@@ -35,43 +83,236 @@ func (w *Writer) isCorrectState(expected writerState) error {
 	if expected == w.writerState {
 		return nil
 	}
-	return fmt.Errorf("you have executed the writers in the wrong order: current: %d, expected: %d", w.writerState, expected)
+	return w.orderError(fmt.Errorf("%w: current: %d, expected: %d", ErrWriteOrder, w.writerState, expected))
+}
+
+// orderError records err as the writer's ordering violation, unless an
+// earlier one is already recorded, and returns it.
+func (w *Writer) orderError(err error) error {
+	if w.orderErr == nil {
+		w.orderErr = err
+	}
+	return err
+}
+
+// Err returns the first ErrWriteOrder violation on w, or nil. Middleware and
+// handlers share one writer and not every caller checks what a write
+// returns; the server logs this after each request so the mistake still shows
+// up in development instead of only as a malformed response.
+func (w *Writer) Err() error {
+	return w.orderErr
+}
+
+// write sends p to the underlying writer, remembering the first failure so
+// it is still known after callers that ignore what a write returns
+func (w *Writer) write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil && w.writeErr == nil {
+		w.writeErr = err
+	}
+	return n, err
+}
+
+// WriteErr returns the first error the underlying writer returned, usually
+// the client hanging up partway through the response, or nil. The failing
+// write returns it too, but the server checks here once the handler is done
+// so a handler that didn't look still has it reported.
+func (w *Writer) WriteErr() error {
+	return w.writeErr
+}
+
+// headersSent reports whether it is too late to change headers, recording the
+// attempt as an ordering violation if so.
+func (w *Writer) headersSent(key string) bool {
+	if w.writerState < writerStateHeaders {
+		return false
+	}
+	w.orderError(fmt.Errorf("%w: header %q changed after the headers were sent", ErrWriteOrder, key))
+	return true
+}
+
+// StatusCode returns the status of the final response once its status line
+// has been written, however it was written, or 0 before that. Middleware can
+// read it after next returns, e.g. for access logs. Interim 1xx responses
+// don't count.
+func (w *Writer) StatusCode() StatusCode {
+	return w.status
+}
+
+// Started reports whether anything has been written to the client yet.
+func (w *Writer) Started() bool {
+	return w.writerState != writerStateNotStarted
 }
 
+// SetAcceptsTrailers records whether the client is willing to receive
+// trailers, chunked writers should only send them when it is.
+func (w *Writer) SetAcceptsTrailers(ok bool) {
+	w.acceptsTrailers = ok
+}
+
+// AcceptsTrailers reports whether trailers may be sent on this response.
+func (w *Writer) AcceptsTrailers() bool {
+	return w.acceptsTrailers
+}
+
+// SetAcceptsGzip records whether the client accepts gzip encoded bodies,
+// RespondGzip only compresses when it does.
+func (w *Writer) SetAcceptsGzip(ok bool) {
+	w.acceptsGzip = ok
+}
+
+// AcceptsGzip reports whether the response body may be gzip encoded.
+func (w *Writer) AcceptsGzip() bool {
+	return w.acceptsGzip
+}
+
+// SetAcceptsChunked records whether the client can read chunked bodies,
+// which HTTP/1.0 clients can't. Responses that would be chunked are then
+// close-delimited instead: they go out with neither Transfer-Encoding nor
+// Content-Length, and Connection: close, and the body ends when the
+// connection is closed. Trailers are dropped.
+func (w *Writer) SetAcceptsChunked(ok bool) {
+	w.noChunked = !ok
+}
+
+// SetChunked switches the response to Transfer-Encoding: chunked framing. It
+// has to be called before the headers are written; WriteBody then sends each
+// call as a chunk and Respond terminates the body for you.
+func (w *Writer) SetChunked(chunked bool) {
+	w.chunked = chunked
+}
+
+// SetHeadResponse marks the response as an answer to a HEAD request. Body
+// writes are then discarded, while Content-Length still describes the body a
+// GET would have received. A HEAD handler knowing the length without
+// building the body can set Content-Length itself and Respond with no body.
+func (w *Writer) SetHeadResponse(head bool) {
+	w.headResponse = head
+}
+
+// Abort gives up on a response partway through, e.g. when the source of a
+// streamed body fails. Nothing more is written, and the server closes the
+// connection rather than reuse it, so the client can tell the body is
+// incomplete instead of taking a truncated one as whole.
+func (w *Writer) Abort() {
+	w.aborted = true
+	w.writerState = writerStateDone
+}
+
+// Aborted reports whether Abort was called.
+func (w *Writer) Aborted() bool {
+	return w.aborted
+}
+
+// SetDefaultHeaders resets the headers to GetDefaultHeaders plus a Connection
+// header saying whether the connection stays open after the response.
 func (w *Writer) SetDefaultHeaders(keepalive bool) {
 	w.headers = GetDefaultHeaders(0)
+	w.contentTypeSet = false
 	if keepalive {
-		w.ReplaceHeader("Connection", "keep-alive")
-		return
+		w.headers.Set("Connection", "keep-alive")
+	} else {
+		w.headers.Set("Connection", "close")
 	}
 }
 
-func (w *Writer) Respond(status StatusCode, body []byte) {
-	err := w.WriteStatusLine(status)
+// Respond writes a complete response with status and body. It fails with
+// ErrWriteOrder if anything has already been written.
+func (w *Writer) Respond(status StatusCode, body []byte) error {
+	err := w.respond(status, body)
 	if err != nil {
 		fmt.Println(err, status, string(body))
-		return
+		return err
 	}
-	h := w.headers
-	h.Replace("content-length", fmt.Sprintf("%d", len(body)))
 
-	if isHTML(body) {
-		h.Replace("content-type", "text/html")
+	fmt.Println("Request successfully actioned and response sent")
+	return nil
+}
+
+// respond writes a complete response, returning the first error hit
+func (w *Writer) respond(status StatusCode, body []byte) error {
+	err := w.WriteStatusLine(status)
+	if err != nil {
+		return err
+	}
+	// The body is the one source of truth for its length, whatever the
+	// handler set before. Only a HEAD response without a body keeps a length
+	// the handler gave, as that describes the body a GET would get.
+	h := w.headers
+	if !w.headResponse || len(body) > 0 {
+		h.Replace("content-length", fmt.Sprintf("%d", len(body)))
 	}
 
+	w.sniffContentType(body)
+
 	err = w.WriteHeaders()
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
 	_, err = w.WriteBody(body)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	fmt.Println("Request successfully actioned and response sent")
+	if w.chunked {
+		_, err = w.WriteChunkedBodyDone(nil)
+	}
+	return err
+}
+
+// WriteStatus sends a complete response with no body: the status line and the
+// headers set so far. 1xx, 204 and 304 responses go out without
+// Content-Length or Content-Type, since they can never carry a body; other
+// codes get "Content-Length: 0". Nothing can be written afterwards.
+func (w *Writer) WriteStatus(code StatusCode) error {
+	err := w.WriteStatusLine(code)
+	if err != nil {
+		return err
+	}
+
+	w.chunked = false
+	w.headers.Delete("transfer-encoding")
+	if isBodyless(code) {
+		w.headers.Delete("content-length")
+		w.headers.Delete("content-type")
+	} else {
+		w.headers.Replace("content-length", "0")
+	}
+
+	err = w.WriteHeaders()
+	if err != nil {
+		return err
+	}
+
+	w.writerState = writerStateDone
+	return nil
+}
+
+// WriteInterim sends a 1xx interim response, such as 103 Early Hints, made
+// of the status line and h. The writer stays where it was, so the final
+// response is written afterwards as usual, and headers set on the writer are
+// not sent with it. 101 Switching Protocols is refused since no final response
+// can follow it.
+func (w *Writer) WriteInterim(code StatusCode, h headers.Headers) error {
+	if code < 100 || code > 199 || code == StatusSwitchingProtocols {
+		return fmt.Errorf("%w: %d", ErrNotInterim, code)
+	}
+	if err := w.isCorrectState(writerStateNotStarted); err != nil {
+		return err
+	}
+
+	var buf []byte
+	buf = fmt.Appendf(buf, "HTTP/1.1 %d %s\r\n", code, GetStatusReason(code))
+	buf = appendHeaders(buf, h)
+	buf = append(buf, "\r\n"...)
+	_, err := w.write(buf)
+	return err
+}
+
+// isBodyless reports whether responses with code never have a body
+func isBodyless(code StatusCode) bool {
+	return code < 200 || code == StatusNoContent || code == StatusNotModified
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
@@ -84,7 +325,8 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	reason := GetStatusReason(statusCode)
 
 	statusLine := fmt.Appendf(nil, "%s %d %s\r\n", version, statusCode, reason)
-	_, err = w.Writer.Write(statusLine)
+	_, err = w.write(statusLine)
+	w.status = statusCode
 
 	w.writerState = writerStateStatusLine
 	return err
@@ -96,44 +338,78 @@ func (w *Writer) WriteHeaders() error {
 		return err
 	}
 
-	hasBody := false
 	headers := w.headers
 
-	if _, ok := headers.HasContentLength(); ok {
-		hasBody = true
+	if w.noChunked && (w.chunked || strings.EqualFold(headers.Get("transfer-encoding"), "chunked")) {
+		w.chunked = false
+		w.closeDelimited = true
+		headers.Delete("transfer-encoding")
+		headers.Delete("trailer")
+		headers.Delete("content-length")
+		headers.Replace("connection", "close")
+	}
+	if w.chunked {
+		headers.Delete("content-length")
+		headers.Replace("transfer-encoding", "chunked")
 	}
 
-	if len(headers) == 0 || headers == nil {
+	// The defaults describe an empty body, which 1xx, 204 and 304 responses
+	// must not announce
+	if len(headers) == 0 && !isBodyless(w.status) {
 		headers = GetDefaultHeaders(0)
 	}
 
-	for key := range headers {
-
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, headers.Get(key))
-		_, err := w.Writer.Write([]byte(headerLine))
-		if err != nil {
-			return err
-		}
+	buf := appendHeaders(nil, headers)
+	for _, cookie := range w.cookies {
+		buf = appendHeader(buf, "set-cookie", cookie)
 	}
-	// write the final \r\n if there is a body
-	if hasBody {
-		_, err := w.Writer.Write([]byte("\r\n"))
-		if err != nil {
-			return err
-		}
+	// The blank line ending the header block goes out whether or not a body
+	// follows, a 204 or 304 without it leaves the client waiting for more
+	buf = append(buf, "\r\n"...)
+	if _, err := w.write(buf); err != nil {
+		return err
 	}
 
+	w.sentChunked = w.chunked || strings.EqualFold(headers.Get("transfer-encoding"), "chunked")
+	w.sentLength = -1
+	if n, err := strconv.ParseInt(headers.Get("content-length"), 10, 64); err == nil && !w.sentChunked {
+		w.sentLength = n
+	}
 	w.writerState = writerStateHeaders
 	return nil
 }
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	err := w.isCorrectState(writerStateHeaders)
+	// A chunked or close-delimited body can go out over any number of calls,
+	// a Content-Length one is written in one go
+	expected := writerStateHeaders
+	if (w.chunked || w.closeDelimited) && w.writerState == writerStateBody {
+		expected = writerStateBody
+	}
+	err := w.isCorrectState(expected)
 	if err != nil {
 		return 0, err
 	}
 
-	bodyString := string(p) + "\r\n"
-	n, err := w.Writer.Write([]byte(bodyString))
+	if w.headResponse {
+		w.writerState = writerStateBody
+		return len(p), nil
+	}
+
+	if w.chunked {
+		// An empty chunk would read as the end of the body
+		n := 0
+		if len(p) > 0 {
+			n, err = w.WriteChunkedBody(p)
+			if err != nil {
+				return n, err
+			}
+		}
+		w.writerState = writerStateBody
+		return n, nil
+	}
+
+	n, err := w.write(p)
+	w.bodyWritten += int64(n)
 	if err != nil {
 		return n, err
 	}
@@ -142,47 +418,204 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	return n, err
 }
 
+// Complete reports whether a whole, correctly framed response has been
+// written: the headers went out and so did exactly the body they announced,
+// all Content-Length bytes of it or a chunked body up to its last chunk.
+// Anything else leaves the connection in a state the client can't read the
+// next response from, so the server closes it rather than reusing it.
+func (w *Writer) Complete() bool {
+	if w.aborted || w.writeErr != nil || w.writerState < writerStateHeaders {
+		return false
+	}
+	if w.headResponse || isBodyless(w.status) {
+		return true
+	}
+	if w.sentChunked {
+		return w.writerState == writerStateDone
+	}
+	return w.sentLength >= 0 && w.bodyWritten == w.sentLength
+}
+
+// GetDefaultHeaders returns the headers every response starts from. The
+// Content-Length is only advisory: Respond always replaces it with the length
+// of the body it writes, so a stale or wrong value can't reach the client. A
+// negative contentLen, for a length not known yet, leaves it out.
+//
+// There is no Connection header, whether the connection stays open depends on
+// the request; SetDefaultHeaders adds the right one.
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 
-	h.Set("content-length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
+	if contentLen >= 0 {
+		h.Set("content-length", fmt.Sprintf("%d", contentLen))
+	}
 	h.Set("Content-Type", "text/plain")
 
 	return h
 }
 
 func (w *Writer) AddHeader(key, value string) {
+	if w.headersSent(key) {
+		return
+	}
+	w.noteContentType(key)
+	if isSetCookie(key) {
+		w.cookies = append(w.cookies, value)
+		return
+	}
 	w.headers.Set(key, value)
 }
 
 func (w *Writer) DeleteHeader(key string) {
+	if w.headersSent(key) {
+		return
+	}
+	w.noteContentType(key)
+	if isSetCookie(key) {
+		w.cookies = nil
+		return
+	}
 	w.headers.Delete(key)
 }
 
 func (w *Writer) ReplaceHeader(key, value string) {
+	if w.headersSent(key) {
+		return
+	}
+	w.noteContentType(key)
+	if isSetCookie(key) {
+		w.cookies = []string{value}
+		return
+	}
 	w.headers.Replace(key, value)
 }
 
-func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	length := strconv.FormatInt(int64(len(p)), 16)
-	read := 0
-	n, err := w.Writer.Write([]byte(length + "\r\n"))
+// noteContentType records a handler setting or removing the Content-Type
+func (w *Writer) noteContentType(key string) {
+	if strings.EqualFold(key, "content-type") {
+		w.contentTypeSet = true
+	}
+}
+
+// sniffContentType sets the Content-Type from the first 512 bytes of body,
+// as http.DetectContentType reads them, unless the handler set one itself.
+// An empty body keeps the default.
+func (w *Writer) sniffContentType(body []byte) {
+	if w.contentTypeSet || len(body) == 0 {
+		return
+	}
+	w.headers.Replace("content-type", http.DetectContentType(body))
+}
+
+// AddVary adds fields to the response's Vary header, naming request headers
+// the response was chosen by so caches keep a copy per variant. Fields
+// already listed, in any case, aren't repeated, and a Vary of "*" is left
+// alone since it already covers everything.
+func (w *Writer) AddVary(fields ...string) {
+	if w.headersSent("vary") {
+		return
+	}
+	var merged []string
+	for _, field := range strings.Split(w.headers.Joined("vary"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			merged = append(merged, field)
+		}
+	}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || slices.ContainsFunc(merged, func(f string) bool {
+			return f == "*" || strings.EqualFold(f, field)
+		}) {
+			continue
+		}
+		merged = append(merged, field)
+	}
+	if len(merged) > 0 {
+		w.headers.Replace("vary", strings.Join(merged, ", "))
+	}
+}
+
+func isSetCookie(key string) bool {
+	return strings.EqualFold(key, "set-cookie")
+}
+
+// StartChunked begins a chunked response from a handler: it writes the status
+// line and headers with Transfer-Encoding: chunked. Follow it with any number
+// of WriteChunkedBody calls and end with FinishChunked. trailerNames are
+// announced in a Trailer header, check AcceptsTrailers before relying on the
+// client to read them.
+func (w *Writer) StartChunked(status StatusCode, trailerNames ...string) error {
+	err := w.WriteStatusLine(status)
 	if err != nil {
+		return err
+	}
+
+	w.chunked = true
+	if len(trailerNames) > 0 {
+		w.headers.Replace("trailer", strings.Join(trailerNames, ", "))
+	}
+	return w.WriteHeaders()
+}
+
+// FinishChunked ends a chunked response with the terminating chunk, followed
+// by trailers if any are given. Nothing can be written afterwards.
+func (w *Writer) FinishChunked(trailers headers.Headers) error {
+	_, err := w.WriteChunkedBodyDone(trailers)
+	return err
+}
+
+// isChunkedState checks the body of a chunked response can still be written
+func (w *Writer) isChunkedState() error {
+	if w.writerState == writerStateHeaders || w.writerState == writerStateBody {
+		return nil
+	}
+	return w.orderError(fmt.Errorf("%w: current: %d, expected a chunked body in progress", ErrWriteOrder, w.writerState))
+}
+
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if err := w.isChunkedState(); err != nil {
+		return 0, err
+	}
+	if w.headResponse {
+		return len(p), nil
+	}
+	// A zero-length chunk would end the body, there is nothing to send
+	if len(p) == 0 {
+		w.writerState = writerStateBody
+		return 0, nil
+	}
+	if w.closeDelimited {
+		n, err := w.write(p)
+		if err == nil {
+			w.writerState = writerStateBody
+		}
 		return n, err
 	}
-	read += n
-	n, err = w.Writer.Write(fmt.Appendf(p, "\r\n"))
+	// The chunk is framed in a buffer of its own, p is often the caller's
+	// read buffer and its spare capacity isn't ours to write to
+	chunk := make([]byte, 0, len(p)+20)
+	chunk = strconv.AppendInt(chunk, int64(len(p)), 16)
+	chunk = append(chunk, "\r\n"...)
+	chunk = append(chunk, p...)
+	chunk = append(chunk, "\r\n"...)
+	n, err := w.write(chunk)
 	if err != nil {
 		return n, err
 	}
-	read += n
 
-	return read, nil
+	w.writerState = writerStateBody
+	return n, nil
 }
 
 func (w *Writer) WriteChunkedBodyDone(trailers headers.Headers) (int, error) {
-	n, err := w.Writer.Write([]byte("0\r\n"))
+	if err := w.isChunkedState(); err != nil {
+		return 0, err
+	}
+	w.writerState = writerStateDone
+	if w.headResponse || w.closeDelimited {
+		return 0, nil
+	}
+	n, err := w.write([]byte("0\r\n"))
 	if err != nil {
 		return n, err
 	}
@@ -194,7 +627,7 @@ func (w *Writer) WriteChunkedBodyDone(trailers headers.Headers) (int, error) {
 		}
 	}
 
-	n, err = w.Writer.Write([]byte("\r\n"))
+	n, err = w.write([]byte("\r\n"))
 	if err != nil {
 		return n, err
 	}
@@ -202,13 +635,26 @@ func (w *Writer) WriteChunkedBodyDone(trailers headers.Headers) (int, error) {
 }
 
 func (w *Writer) WriteTrailers(trailers headers.Headers) error {
-	for key := range trailers {
+	_, err := w.write(appendHeaders(nil, trailers))
+	return err
+}
 
-		headerLine := fmt.Sprintf("%s:%s\r\n", key, trailers.Get(key))
-		_, err := w.Writer.Write([]byte(headerLine))
-		if err != nil {
-			return err
+// appendHeaders appends a "Key: value" line to buf for every value in h
+func appendHeaders(buf []byte, h headers.Headers) []byte {
+	for key, values := range h {
+		for _, value := range values {
+			buf = appendHeader(buf, key, value)
 		}
 	}
-	return nil
+	return buf
+}
+
+// appendHeader appends one header line. Keys are stored in lower case but
+// written in their canonical form, e.g. "Content-Type", which is what strict
+// clients and proxies expect to see.
+func appendHeader(buf []byte, key, value string) []byte {
+	buf = append(buf, textproto.CanonicalMIMEHeaderKey(key)...)
+	buf = append(buf, ": "...)
+	buf = append(buf, value...)
+	return append(buf, "\r\n"...)
 }
@@ -0,0 +1,699 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noelw19/tcptohttp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipleSetCookie(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+
+	w.AddHeader("Set-Cookie", "session=abc; Path=/")
+	w.AddHeader("Set-Cookie", "theme=dark, light")
+	w.Respond(StatusOK, []byte("ok"))
+
+	out := buf.String()
+	assert.Equal(t, 2, strings.Count(out, "Set-Cookie: "))
+	assert.Contains(t, out, "Set-Cookie: session=abc; Path=/\r\n")
+	assert.Contains(t, out, "Set-Cookie: theme=dark, light\r\n")
+	require.NotContains(t, out, "session=abc; Path=/, theme=dark")
+}
+
+func TestBuilderJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+
+	err := w.Status(StatusCreated).
+		Header("X-Foo", "bar").
+		Cookie("session", "abc").
+		JSON(map[string]int{"id": 7})
+	require.NoError(t, err)
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, out, "X-Foo: bar\r\n")
+	assert.Contains(t, out, "Set-Cookie: session=abc\r\n")
+	assert.Contains(t, out, "Content-Type: application/json\r\n")
+	assert.Contains(t, out, "Content-Length: 8\r\n")
+	assert.Contains(t, out, "\r\n\r\n{\"id\":7}")
+
+	// Test: The response can only be sent once
+	err = w.Status(StatusOK).Body([]byte("again")).Send()
+	require.Error(t, err)
+}
+
+func TestBuilderHTML(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+
+	err := w.Status(StatusOK).
+		Header("Cache-Control", "no-cache").
+		Header("X-Frame-Options", "DENY").
+		HTML("<p>hello</p>")
+	require.NoError(t, err)
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Cache-Control: no-cache\r\n")
+	assert.Contains(t, out, "X-Frame-Options: DENY\r\n")
+	assert.Contains(t, out, "Content-Type: text/html\r\n")
+	assert.Contains(t, out, "<p>hello</p>")
+}
+
+func TestCanonicalHeaderKeys(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.ReplaceHeader("content-type", "text/html")
+	w.ReplaceHeader("X-REQUEST-ID", "42")
+	w.SetChunked(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders())
+	trailers := headers.NewHeaders()
+	trailers.Set("x-checksum", "abc")
+	_, err := w.WriteChunkedBodyDone(trailers)
+	require.NoError(t, err)
+
+	out := buf.String()
+	// Test: Keys are written canonically, with a space after the colon
+	assert.Contains(t, out, "\r\nContent-Type: text/html\r\n")
+	assert.Contains(t, out, "\r\nX-Request-Id: 42\r\n")
+	assert.Contains(t, out, "\r\nTransfer-Encoding: chunked\r\n")
+	// Test: Trailers too
+	assert.True(t, strings.HasSuffix(out, "0\r\nX-Checksum: abc\r\n\r\n"), out)
+}
+
+func TestWriteAttachment(t *testing.T) {
+	// Test: ASCII filename
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.WriteAttachment(`q1 "final".csv`, "text/csv", []byte("a,b\n1,2\n"))
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Content-Disposition: attachment; filename=\"q1 \\\"final\\\".csv\"\r\n")
+	assert.NotContains(t, out, "filename*=")
+	assert.Contains(t, out, "Content-Type: text/csv\r\n")
+	assert.Contains(t, out, "Content-Length: 8\r\n")
+	assert.Contains(t, out, "\r\n\r\na,b\n1,2\n")
+
+	// Test: UTF-8 filename gets the RFC 5987 form and an ASCII fallback
+	buf = &bytes.Buffer{}
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.WriteAttachment("résumé €.pdf", "application/pdf", []byte("%PDF"))
+
+	out = buf.String()
+	assert.Contains(t, out, "Content-Disposition: attachment; filename=\"r_sum_ _.pdf\"; filename*=UTF-8''r%C3%A9sum%C3%A9%20%E2%82%AC.pdf\r\n")
+	assert.Contains(t, out, "Content-Type: application/pdf\r\n")
+
+	// Test: Line breaks can't be used to inject headers
+	value := ContentDisposition("attachment", "evil\r\nX-Injected: 1.txt")
+	assert.NotContains(t, value, "\r")
+	assert.NotContains(t, value, "\n")
+}
+
+func TestWriteHeadersEndsHeaderBlock(t *testing.T) {
+	// Test: A 204 written by hand, without any Content-Length
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.ReplaceHeader("x-request-id", "42")
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nX-Request-Id: 42\r\n\r\n", buf.String())
+}
+
+func TestWriteStatus(t *testing.T) {
+	// Test: 204 has no body and no Content-Length
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	require.NoError(t, w.WriteStatus(StatusNoContent))
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content\r\n"))
+	assert.NotContains(t, out, "Content-Length")
+	assert.NotContains(t, out, "Content-Type")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+	_, body, _ := strings.Cut(out, "\r\n\r\n")
+	assert.Empty(t, body)
+
+	// Test: 304 keeps validators but has no body either
+	buf = &bytes.Buffer{}
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.ReplaceHeader("ETag", `"v2"`)
+	require.NoError(t, w.WriteStatus(StatusNotModified))
+
+	out = buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out, "Etag: \"v2\"\r\n")
+	assert.NotContains(t, out, "Content-Length")
+	_, body, _ = strings.Cut(out, "\r\n\r\n")
+	assert.Empty(t, body)
+
+	// Test: Other codes declare an empty body
+	buf = &bytes.Buffer{}
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	require.NoError(t, w.WriteStatus(StatusAccepted))
+
+	out = buf.String()
+	assert.Contains(t, out, "Content-Length: 0\r\n")
+	_, body, _ = strings.Cut(out, "\r\n\r\n")
+	assert.Empty(t, body)
+
+	// Test: The writer is done
+	_, err := w.WriteBody([]byte("late"))
+	require.Error(t, err)
+	_, err = w.WriteChunkedBody([]byte("late"))
+	require.Error(t, err)
+	assert.NotContains(t, buf.String(), "late")
+	assert.True(t, w.Complete())
+
+	// Test: A bare writer, without default headers set, sends nothing
+	// describing a body with a 204 or 304
+	for _, code := range []StatusCode{StatusNoContent, StatusNotModified} {
+		buf = &bytes.Buffer{}
+		w = NewResponseWriter(buf)
+		require.NoError(t, w.WriteStatus(code))
+		assert.Equal(t, fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", code, GetStatusReason(code)), buf.String())
+	}
+
+	// Test: Other codes from a bare writer still declare an empty body
+	buf = &bytes.Buffer{}
+	w = NewResponseWriter(buf)
+	require.NoError(t, w.WriteStatus(StatusAccepted))
+	assert.Contains(t, buf.String(), "Content-Length: 0\r\n")
+}
+
+func TestWriteInterim(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+
+	hints := headers.NewHeaders()
+	hints.Set("Link", "</style.css>; rel=preload; as=style")
+	hints.Set("Link", "</app.js>; rel=preload; as=script")
+	require.NoError(t, w.WriteInterim(StatusEarlyHints, hints))
+	assert.False(t, w.Started())
+
+	w.Respond(StatusOK, []byte("<html></html>"))
+
+	interim, final, ok := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, ok)
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\nLink: </app.js>; rel=preload; as=script", interim)
+	assert.True(t, strings.HasPrefix(final, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, final, "<html></html>")
+	assert.NotContains(t, final, "Link:")
+
+	// Test: Only 1xx codes other than 101 are interim
+	for _, code := range []StatusCode{StatusOK, StatusSwitchingProtocols, 99} {
+		err := NewResponseWriter(&bytes.Buffer{}).WriteInterim(code, nil)
+		require.ErrorIs(t, err, ErrNotInterim)
+	}
+
+	// Test: Too late once the final response has started
+	require.Error(t, w.WriteInterim(StatusProcessing, nil))
+}
+
+func TestChunkedLifecycle(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+
+	// Test: Chunks can't be written before the response has started
+	_, err := w.WriteChunkedBody([]byte("early"))
+	require.Error(t, err)
+	require.Error(t, w.FinishChunked(nil))
+
+	require.NoError(t, w.StartChunked(StatusOK, "X-Checksum"))
+	for _, chunk := range []string{"one", "two", "three"} {
+		_, err := w.WriteChunkedBody([]byte(chunk))
+		require.NoError(t, err)
+	}
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc123")
+	require.NoError(t, w.FinishChunked(trailers))
+
+	out := buf.String()
+	assert.Contains(t, out, "Transfer-Encoding: chunked\r\n")
+	assert.Contains(t, out, "Trailer: X-Checksum\r\n")
+	assert.NotContains(t, out, "Content-Length")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n3\r\none\r\n3\r\ntwo\r\n5\r\nthree\r\n0\r\nX-Checksum: abc123\r\n\r\n"))
+
+	// Test: Nothing goes out once finished
+	_, err = w.WriteChunkedBody([]byte("late"))
+	require.Error(t, err)
+	require.Error(t, w.FinishChunked(nil))
+	assert.NotContains(t, buf.String(), "late")
+}
+
+func TestSetChunkedWriteBody(t *testing.T) {
+	// Test: Each WriteBody call goes out as a chunk of its own
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.SetChunked(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders())
+	for _, part := range []string{"one", "", "two", "three"} {
+		_, err := w.WriteBody([]byte(part))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.FinishChunked(nil))
+	assert.NotContains(t, buf.String(), "Content-Length")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n3\r\none\r\n3\r\ntwo\r\n5\r\nthree\r\n0\r\n\r\n"), buf.String())
+	assert.True(t, w.Complete())
+
+	// Test: And unframed, one after the other, to a client that can't take
+	// chunks
+	buf.Reset()
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.SetAcceptsChunked(false)
+	w.SetChunked(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders())
+	for _, part := range []string{"one", "two"} {
+		_, err := w.WriteBody([]byte(part))
+		require.NoError(t, err)
+	}
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nonetwo"), buf.String())
+
+	// Test: A Content-Length body is still written in one call
+	buf.Reset()
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.ReplaceHeader("content-length", "3")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders())
+	_, err := w.WriteBody([]byte("one"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("two"))
+	require.ErrorIs(t, err, ErrWriteOrder)
+}
+
+func TestRespondContentLength(t *testing.T) {
+	// Test: A stale length set by the handler is replaced
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.ReplaceHeader("content-length", "999")
+	require.NoError(t, w.Respond(StatusOK, []byte("hello")))
+	assert.Contains(t, buf.String(), "Content-Length: 5\r\n")
+	assert.NotContains(t, buf.String(), "999")
+
+	// Test: Headers built with a mismatched length
+	buf.Reset()
+	w = NewResponseWriter(buf)
+	for key, values := range GetDefaultHeaders(-7) {
+		w.ReplaceHeader(key, values[0])
+	}
+	w.AddHeader("content-length", "2")
+	require.NoError(t, w.Respond(StatusOK, []byte("hello world")))
+	assert.Contains(t, buf.String(), "Content-Length: 11\r\n")
+	assert.Equal(t, 1, strings.Count(buf.String(), "Content-Length"))
+
+	// Test: A negative length is left out rather than sent
+	h := GetDefaultHeaders(-1)
+	_, ok := h["content-length"]
+	assert.False(t, ok)
+	assert.Equal(t, "13", GetDefaultHeaders(13).Get("content-length"))
+}
+
+func TestRespondGzip(t *testing.T) {
+	body := []byte(strings.Repeat("hello gzip ", 100))
+
+	// Test: Client accepting gzip
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.SetAcceptsGzip(true)
+	require.NoError(t, w.RespondGzip(StatusOK, body))
+
+	head, rest, ok := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, ok)
+	head += "\r\n"
+	assert.Contains(t, head, "Content-Encoding: gzip\r\n")
+	compressed := strings.TrimSuffix(rest, "\r\n")
+	assert.Contains(t, head, fmt.Sprintf("Content-Length: %d\r\n", len(compressed)))
+	assert.Less(t, len(compressed), len(body))
+
+	zr, err := gzip.NewReader(strings.NewReader(compressed))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, decoded)
+
+	// Test: Client without gzip gets the body as is
+	buf.Reset()
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	require.NoError(t, w.RespondGzip(StatusOK, body))
+	assert.NotContains(t, buf.String(), "Content-Encoding")
+	assert.Contains(t, buf.String(), fmt.Sprintf("Content-Length: %d\r\n", len(body)))
+	assert.Contains(t, buf.String(), string(body))
+
+	// Test: A body that is already encoded isn't compressed again
+	buf.Reset()
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.SetAcceptsGzip(true)
+	w.ReplaceHeader("content-encoding", "br")
+	require.NoError(t, w.RespondGzip(StatusOK, []byte("already brotli")))
+	assert.Contains(t, buf.String(), "Content-Encoding: br\r\n")
+	assert.Contains(t, buf.String(), "already brotli")
+}
+
+func TestAddVary(t *testing.T) {
+	w := NewResponseWriter(&bytes.Buffer{})
+	w.AddVary("Accept")
+	assert.Equal(t, "Accept", w.headers.Get("vary"))
+
+	// Test: Merged with what is there, without repeats in any case
+	w.ReplaceHeader("Vary", "Origin")
+	w.AddVary("accept-encoding", "Origin", "Accept-Encoding", "ORIGIN")
+	w.AddVary("Accept")
+	assert.Equal(t, "Origin, accept-encoding, Accept", w.headers.Get("vary"))
+
+	// Test: "*" already covers everything
+	w.ReplaceHeader("vary", "*")
+	w.AddVary("Accept")
+	assert.Equal(t, "*", w.headers.Get("vary"))
+
+	// Test: Compression varies on Accept-Encoding whether it happens or not
+	for _, gzipOK := range []bool{true, false} {
+		buf := &bytes.Buffer{}
+		w = NewResponseWriter(buf)
+		w.SetDefaultHeaders(false)
+		w.SetAcceptsGzip(gzipOK)
+		w.AddVary("Accept")
+		require.NoError(t, w.RespondGzip(StatusOK, []byte("some text")))
+		assert.Contains(t, buf.String(), "Vary: Accept, Accept-Encoding\r\n", "gzip accepted: %v", gzipOK)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	retryAfter := func(set func(w *Writer)) string {
+		w := NewResponseWriter(&bytes.Buffer{})
+		set(w)
+		return w.headers.Get("retry-after")
+	}
+
+	// Test: Durations are whole seconds, rounded up
+	assert.Equal(t, "120", retryAfter(func(w *Writer) { w.RetryAfter(2 * time.Minute) }))
+	assert.Equal(t, "2", retryAfter(func(w *Writer) { w.RetryAfter(1500 * time.Millisecond) }))
+	assert.Equal(t, "0", retryAfter(func(w *Writer) { w.RetryAfter(-time.Second) }))
+
+	// Test: Absolute times are HTTP-dates in GMT
+	at := time.Date(2026, time.March, 14, 9, 26, 53, 0, time.FixedZone("NZDT", 13*60*60))
+	assert.Equal(t, "Fri, 13 Mar 2026 20:26:53 GMT", retryAfter(func(w *Writer) { w.RetryAt(at) }))
+
+	// Test: It goes out with the response
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.RetryAfter(30 * time.Second)
+	require.NoError(t, w.Respond(StatusTooManyRequests, []byte("slow down")))
+	assert.Contains(t, buf.String(), "Retry-After: 30\r\n")
+}
+
+func TestWriteChunkedBodyReusedBuffer(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	require.NoError(t, w.StartChunked(StatusOK))
+
+	// One read buffer reused for every chunk, as a streaming copy loop does,
+	// with spare capacity that must be left alone
+	scratch := make([]byte, 8)
+	for i := range scratch {
+		scratch[i] = '#'
+	}
+	for _, piece := range []string{"abc", "defg", "hi"} {
+		n := copy(scratch, piece)
+		spare := string(scratch[n:])
+		_, err := w.WriteChunkedBody(scratch[:n])
+		require.NoError(t, err)
+		assert.Equal(t, spare, string(scratch[n:]), "capacity past the chunk was written to")
+	}
+	require.NoError(t, w.FinishChunked(nil))
+
+	_, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	assert.Equal(t, "3\r\nabc\r\n4\r\ndefg\r\n2\r\nhi\r\n0\r\n\r\n", body)
+}
+
+func TestSetCookie(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+
+	// Test: Every attribute, and a second cookie next to the first
+	w.SetCookie(&http.Cookie{
+		Name:     "session",
+		Value:    "abc123",
+		Path:     "/app",
+		Domain:   "example.com",
+		Expires:  time.Date(2026, time.January, 2, 15, 4, 5, 0, time.UTC),
+		MaxAge:   3600,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.SetCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	// Test: An invalid name is dropped
+	w.SetCookie(&http.Cookie{Name: "bad name", Value: "x"})
+	require.NoError(t, w.Respond(StatusOK, []byte("ok")))
+
+	out := buf.String()
+	assert.Equal(t, 2, strings.Count(out, "Set-Cookie: "))
+	assert.Contains(t, out, "Set-Cookie: session=abc123; Path=/app; Domain=example.com; "+
+		"Expires=Fri, 02 Jan 2026 15:04:05 GMT; Max-Age=3600; HttpOnly; Secure; SameSite=Strict\r\n")
+	assert.Contains(t, out, "Set-Cookie: theme=dark\r\n")
+
+	// Test: Too late once the headers are out
+	w.SetCookie(&http.Cookie{Name: "late", Value: "1"})
+	assert.NotContains(t, buf.String(), "late")
+}
+
+func TestRedirect(t *testing.T) {
+	for _, status := range []StatusCode{StatusMovedPermanently, StatusFound, StatusSeeOther, StatusTemporaryRedirect, StatusPermanentRedirect} {
+		buf := &bytes.Buffer{}
+		w := NewResponseWriter(buf)
+		require.NoError(t, w.Redirect(status, "/login?next=/a&b"))
+
+		out := buf.String()
+		assert.True(t, strings.HasPrefix(out, fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, GetStatusReason(status))), out)
+		assert.Contains(t, out, "Location: /login?next=/a&b\r\n")
+		assert.Contains(t, out, `<a href="/login?next=/a&amp;b">`)
+	}
+
+	// Test: Other statuses are refused and nothing is written
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	require.ErrorIs(t, w.Redirect(StatusOK, "/elsewhere"), ErrNotRedirect)
+	require.ErrorIs(t, w.Redirect(StatusNotModified, "/elsewhere"), ErrNotRedirect)
+	// Test: So are locations that would split the header
+	require.ErrorIs(t, w.Redirect(StatusFound, "/a\r\nSet-Cookie: x=1"), ErrNotRedirect)
+	assert.Empty(t, buf.String())
+	assert.False(t, w.Started())
+}
+
+func TestJSON(t *testing.T) {
+	respond := func(status StatusCode, v any) (string, *Writer, error) {
+		buf := &bytes.Buffer{}
+		w := NewResponseWriter(buf)
+		err := w.JSON(status, v)
+		return buf.String(), w, err
+	}
+
+	// Test: A struct
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	out, _, err := respond(StatusCreated, item{ID: 7, Name: "tea"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"), out)
+	assert.Contains(t, out, "Content-Type: application/json\r\n")
+	assert.Contains(t, out, "Content-Length: 21\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+`{"id":7,"name":"tea"}`), out)
+
+	// Test: A map
+	out, _, err = respond(StatusOK, map[string]int{"count": 3})
+	require.NoError(t, err)
+	assert.Contains(t, out, "Content-Length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+`{"count":3}`), out)
+
+	// Test: A value that can't be marshalled writes nothing
+	out, w, err := respond(StatusOK, make(chan int))
+	var unsupported *json.UnsupportedTypeError
+	require.ErrorAs(t, err, &unsupported)
+	assert.Empty(t, out)
+	assert.False(t, w.Started())
+	require.NoError(t, w.Respond(StatusInternalServerError, []byte("oops")))
+}
+
+func TestSniffContentType(t *testing.T) {
+	respond := func(body []byte, contentType string) string {
+		buf := &bytes.Buffer{}
+		w := NewResponseWriter(buf)
+		w.SetDefaultHeaders(false)
+		if contentType != "" {
+			w.ReplaceHeader("Content-Type", contentType)
+		}
+		require.NoError(t, w.Respond(StatusOK, body))
+		return buf.String()
+	}
+
+	// Test: Documents and fragments are HTML without needing <html>
+	assert.Contains(t, respond([]byte("<!DOCTYPE html><title>x</title>"), ""), "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, respond([]byte("<p>hello</p>"), ""), "Content-Type: text/html; charset=utf-8\r\n")
+	// Test: Plain text
+	assert.Contains(t, respond([]byte("hello world"), ""), "Content-Type: text/plain; charset=utf-8\r\n")
+	// Test: PNG magic bytes
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	assert.Contains(t, respond(png, ""), "Content-Type: image/png\r\n")
+	// Test: JSON isn't mistaken for HTML, even when it carries markup
+	out := respond([]byte(`{"html": "<html></html>"}`), "")
+	assert.Contains(t, out, "Content-Type: text/plain; charset=utf-8\r\n")
+	// Test: An explicit Content-Type wins over the sniffed one
+	out = respond([]byte(`{"html": "<html></html>"}`), "application/json")
+	assert.Contains(t, out, "Content-Type: application/json\r\n")
+	assert.NotContains(t, out, "text/")
+	out = respond([]byte("<html></html>"), "text/plain")
+	assert.Contains(t, out, "Content-Type: text/plain\r\n")
+	// Test: An empty body keeps the default
+	assert.Contains(t, respond(nil, ""), "Content-Type: text/plain\r\n")
+}
+
+func TestComplete(t *testing.T) {
+	newWriter := func() *Writer {
+		w := NewResponseWriter(&bytes.Buffer{})
+		w.SetDefaultHeaders(true)
+		return w
+	}
+
+	// Test: Nothing written
+	w := newWriter()
+	assert.False(t, w.Complete())
+
+	// Test: Respond, with and without a body
+	w = newWriter()
+	require.NoError(t, w.Respond(StatusOK, []byte("hello")))
+	assert.True(t, w.Complete())
+	w = newWriter()
+	require.NoError(t, w.WriteStatus(StatusNoContent))
+	assert.True(t, w.Complete())
+
+	// Test: A body shorter than its Content-Length
+	w = newWriter()
+	w.ReplaceHeader("Content-Length", "10")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders())
+	assert.False(t, w.Complete())
+	_, err := w.WriteBody([]byte("short"))
+	require.NoError(t, err)
+	assert.False(t, w.Complete())
+
+	// Test: No Content-Length leaves the body running until the close
+	w = newWriter()
+	w.DeleteHeader("Content-Length")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders())
+	_, err = w.WriteBody([]byte("open ended"))
+	require.NoError(t, err)
+	assert.False(t, w.Complete())
+
+	// Test: A chunked body only once the last chunk is out
+	w = newWriter()
+	require.NoError(t, w.StartChunked(StatusOK))
+	_, err = w.WriteChunkedBody([]byte("part"))
+	require.NoError(t, err)
+	assert.False(t, w.Complete())
+	require.NoError(t, w.FinishChunked(nil))
+	assert.True(t, w.Complete())
+
+	// Test: HEAD responses have no body to finish
+	w = newWriter()
+	w.SetHeadResponse(true)
+	w.ReplaceHeader("Content-Length", "10")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders())
+	assert.True(t, w.Complete())
+
+	// Test: Aborted responses never are
+	w = newWriter()
+	require.NoError(t, w.Respond(StatusOK, []byte("hello")))
+	w.Abort()
+	assert.False(t, w.Complete())
+}
+
+func TestDefaultConnectionHeader(t *testing.T) {
+	// Test: The defaults don't decide the connection's fate
+	_, ok := GetDefaultHeaders(0)["connection"]
+	assert.False(t, ok)
+
+	// Test: Keep-alive responses don't advertise close
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(true)
+	require.NoError(t, w.Respond(StatusOK, []byte("hello")))
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.NotContains(t, buf.String(), "close")
+
+	buf.Reset()
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	require.NoError(t, w.Respond(StatusOK, []byte("hello")))
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+}
+
+func TestCloseDelimited(t *testing.T) {
+	// Test: A chunked response to a client that can't take chunks
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	w.SetDefaultHeaders(true)
+	w.SetAcceptsChunked(false)
+	require.NoError(t, w.StartChunked(StatusOK, "X-Checksum"))
+	_, err := w.WriteChunkedBody([]byte("hello, "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.FinishChunked(trailers))
+
+	head, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	head += "\r\n"
+	assert.Equal(t, "hello, world", body)
+	assert.Contains(t, head, "Connection: close\r\n")
+	assert.NotContains(t, head, "Transfer-Encoding")
+	assert.NotContains(t, head, "Content-Length")
+	assert.NotContains(t, head, "Trailer")
+	// Test: The connection has to close to end the body
+	assert.False(t, w.Complete())
+
+	// Test: Responses with a known length are unaffected
+	buf.Reset()
+	w = NewResponseWriter(buf)
+	w.SetDefaultHeaders(true)
+	w.SetAcceptsChunked(false)
+	require.NoError(t, w.Respond(StatusOK, []byte("hello")))
+	assert.Contains(t, buf.String(), "Content-Length: 5\r\n")
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.True(t, w.Complete())
+}
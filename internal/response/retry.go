@@ -0,0 +1,24 @@
+package response
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryAfter sets Retry-After to d from now, in whole seconds rounded up so a
+// client never comes back early. It goes with a 503 Service Unavailable or a
+// 429 Too Many Requests to tell the client when to try again.
+func (w *Writer) RetryAfter(d time.Duration) {
+	seconds := int64(0)
+	if d > 0 {
+		seconds = int64((d + time.Second - 1) / time.Second)
+	}
+	w.ReplaceHeader("retry-after", strconv.FormatInt(seconds, 10))
+}
+
+// RetryAt sets Retry-After to the HTTP-date form of t, e.g. for a maintenance
+// window ending at a known time.
+func (w *Writer) RetryAt(t time.Time) {
+	w.ReplaceHeader("retry-after", t.UTC().Format(http.TimeFormat))
+}
@@ -1,10 +0,0 @@
-package response
-
-import "bytes"
-
-func isHTML(body []byte) bool {
-	if bytes.Contains(body, []byte("<html>")) && bytes.Contains(body, []byte("</html>")) {
-		return true
-	}
-	return false
-}
\ No newline at end of file
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// BenchmarkServer load tests a server with a handler that does nothing but
+// respond, so the numbers are the cost of the server itself. Each parallel
+// worker is one client connection; allocations are counted for the whole
+// process, client included.
+//
+//	go test ./internal/server -run '^$' -bench Server -cpu 4
+func BenchmarkServer(b *testing.B) {
+	small := []byte("Hello, World!")
+	large := bytes.Repeat([]byte("a"), 64<<10)
+
+	for _, keepAlive := range []bool{true, false} {
+		for _, body := range [][]byte{small, large} {
+			name := fmt.Sprintf("keepalive=%t/body=%d", keepAlive, len(body))
+			b.Run(name, func(b *testing.B) {
+				benchmarkServer(b, keepAlive, body)
+			})
+		}
+	}
+}
+
+func benchmarkServer(b *testing.B, keepAlive bool, body []byte) {
+	quietStdout(b)
+
+	srv := Serve(0)
+	srv.AddHandler("/", func(w *response.Writer, req *request.Request) {
+		w.Respond(response.StatusOK, body)
+	}).GET()
+	if err := srv.Listen(); err != nil {
+		b.Fatalf("Failed to start server: %v", err)
+	}
+	addr := srv.Listener.Addr().String()
+
+	raw := []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if keepAlive {
+		raw = []byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n")
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var conn net.Conn
+		var reader *bufio.Reader
+		defer func() {
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+
+		for pb.Next() {
+			if conn == nil {
+				var err error
+				conn, err = net.Dial("tcp", addr)
+				if err != nil {
+					b.Errorf("Failed to connect: %v", err)
+					return
+				}
+				reader = bufio.NewReader(conn)
+			}
+
+			if _, err := conn.Write(raw); err != nil {
+				b.Errorf("Failed to write request: %v", err)
+				return
+			}
+			if err := discardResponse(reader, len(body)); err != nil {
+				b.Errorf("Failed to read response: %v", err)
+				return
+			}
+
+			if !keepAlive {
+				conn.Close()
+				conn = nil
+			}
+		}
+	})
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+
+	// Every connection is gone by now, so anything still running is a leak
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		b.Fatalf("Server did not shut down cleanly: %v", err)
+	}
+}
+
+// discardResponse reads one response off r and checks its body length
+func discardResponse(r *bufio.Reader, want int) error {
+	contentLength := -1
+	started := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line == "\r\n" {
+			// Blank lines ahead of the status line belong to the previous
+			// response
+			if !started {
+				continue
+			}
+			break
+		}
+		started = true
+		if value, ok := strings.CutPrefix(strings.ToLower(line), "content-length:"); ok {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if contentLength != want {
+		return fmt.Errorf("content-length %d, want %d", contentLength, want)
+	}
+	_, err := io.CopyN(io.Discard, r, int64(contentLength))
+	return err
+}
+
+// quietStdout silences the server's per-request logging for the rest of b,
+// it would otherwise flood the output and skew the timings
+func quietStdout(b *testing.B) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	b.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/noelw19/tcptohttp/internal/request"
+)
+
+// BodyPolicy decides what happens to a body sent with a method that isn't
+// supposed to carry one, such as GET or DELETE. Such bodies are rarely
+// intended and are a known request smuggling vector.
+type BodyPolicy int
+
+const (
+	// BodyDrain reads the body off the connection and drops it, handlers see
+	// the request as if it had none. This is the default. With DeferBodies,
+	// bodies over MaxBodyDrain are refused as with BodyReject.
+	BodyDrain BodyPolicy = iota
+	// BodyReject answers the request with 400 Bad Request and closes the
+	// connection.
+	BodyReject
+	// BodyPass hands the body to the handler like any other.
+	BodyPass
+)
+
+// methodsWithoutBody are the methods whose body has no defined meaning
+var methodsWithoutBody = map[string]bool{
+	"GET":    true,
+	"HEAD":   true,
+	"DELETE": true,
+}
+
+// hasUnexpectedBody reports whether req carries a body its method shouldn't
+func hasUnexpectedBody(req *request.Request) bool {
+	return methodsWithoutBody[req.RequestLine.Method] && hasBody(req)
+}
+
+// hasBody reports whether req was sent with a body, a chunked one counting
+// even if it turned out empty
+func hasBody(req *request.Request) bool {
+	if n, ok := req.Headers.HasContentLength(); ok && n > 0 {
+		return true
+	}
+	return req.Headers.Get("transfer-encoding") != ""
+}
+
+// applyBodyPolicy enforces s.BodyPolicy on req. It reports false when the
+// request has to be refused.
+func (s *Server) applyBodyPolicy(req *request.Request) bool {
+	if !hasUnexpectedBody(req) {
+		return true
+	}
+
+	switch s.BodyPolicy {
+	case BodyReject:
+		return false
+	case BodyPass:
+	default:
+		// A deferred body has to be read off the wire, one read already just
+		// has to be dropped
+		if req.DiscardBody(MaxBodyDrain) != nil {
+			return false
+		}
+		req.Body = nil
+		req.Headers.Delete("content-length")
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes a client connection currently held open by the server.
+type ConnInfo struct {
+	RemoteAddr string
+	Path       string    // Path of the request being served, empty between requests
+	StartedAt  time.Time // When the connection was accepted
+	Requests   int       // Requests received on this connection, including the current one
+}
+
+// connRegistry tracks the live connections of a server. The zero value is
+// ready to use.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*ConnInfo
+	// idle holds the connections waiting for a request, with none of it
+	// read yet. Only they can be closed without cutting a request short.
+	idle map[net.Conn]bool
+	// closing is set by closeIdle, connections are closed as they go idle
+	closing bool
+}
+
+func (r *connRegistry) add(conn net.Conn) ConnInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conns == nil {
+		r.conns = map[net.Conn]*ConnInfo{}
+	}
+	info := &ConnInfo{
+		RemoteAddr: conn.RemoteAddr().String(),
+		StartedAt:  time.Now(),
+	}
+	r.conns[conn] = info
+	return *info
+}
+
+func (r *connRegistry) remove(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, conn)
+	delete(r.idle, conn)
+}
+
+// markIdle records that conn is waiting for its next request. Once the
+// server is shutting down its wait is cut short straight away.
+func (r *connRegistry) markIdle(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.idle == nil {
+		r.idle = map[net.Conn]bool{}
+	}
+	r.idle[conn] = true
+	if r.closing {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// markBusy records that a request has started arriving on conn, which
+// closeIdle then leaves to finish
+func (r *connRegistry) markBusy(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.idle[conn] {
+		return
+	}
+	delete(r.idle, conn)
+	// The bytes beat the wake-up, undo it so the request can be read. The
+	// request's own timeout, if any, is set once its first byte is in, and
+	// Shutdown's deadline bounds it otherwise.
+	if r.closing {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (r *connRegistry) startRequest(conn net.Conn, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, ok := r.conns[conn]; ok {
+		info.Path = path
+		info.Requests++
+	}
+}
+
+func (r *connRegistry) finishRequest(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, ok := r.conns[conn]; ok {
+		info.Path = ""
+	}
+}
+
+// closeIdle unblocks connections waiting for their next request, so their
+// handler loop can exit, and every connection going idle from then on.
+// Connections partway through reading a request are left to finish it.
+func (r *connRegistry) closeIdle() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closing = true
+	for conn := range r.idle {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// trackedConn is a connection as read by the server. The first bytes a read
+// returns while the connection is idle mark it busy, a request is arriving.
+type trackedConn struct {
+	net.Conn
+	conns *connRegistry
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.conns.markBusy(c.Conn)
+	}
+	return n, err
+}
+
+// closeAll closes every tracked connection, busy or not
+func (r *connRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+func (r *connRegistry) snapshot() []ConnInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(r.conns))
+	for _, info := range r.conns {
+		infos = append(infos, *info)
+	}
+	slices.SortFunc(infos, func(a, b ConnInfo) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+	return infos
+}
+
+// Connections returns a snapshot of the connections currently open, oldest
+// first. It is safe to call while the server is running.
+func (s *Server) Connections() []ConnInfo {
+	return s.conns.snapshot()
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+)
+
+// hop is one proxy hop described by forwarding headers
+type hop struct {
+	forAddr string
+	proto   string
+	host    string
+}
+
+// setClientInfo fills in the client details of req. They come from the
+// connection itself unless the peer is a trusted proxy, in which case the
+// Forwarded or X-Forwarded-* headers it added are honoured.
+func (s *Server) setClientInfo(req *request.Request, conn net.Conn) {
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.Scheme = "http"
+	if _, ok := conn.(*tls.Conn); ok {
+		req.Scheme = "https"
+	}
+
+	peer := addrIP(req.RemoteAddr)
+	if peer == nil || !s.isTrustedProxy(peer) {
+		return
+	}
+
+	hops := parseForwarded(req.Headers.Joined("forwarded"))
+	if len(hops) == 0 {
+		hops = parseXForwarded(req)
+	}
+	if len(hops) == 0 {
+		return
+	}
+
+	// Walk back from the hop closest to us, the first address we don't trust
+	// is the client. Anything further left could have been made up by it.
+	client := hops[0]
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := addrIP(hops[i].forAddr)
+		if ip == nil || !s.isTrustedProxy(ip) {
+			client = hops[i]
+			break
+		}
+	}
+
+	if client.forAddr != "" {
+		req.RemoteAddr = client.forAddr
+	}
+	if proto := strings.ToLower(client.proto); proto == "http" || proto == "https" {
+		req.Scheme = proto
+	}
+	if client.host != "" {
+		req.Host = client.host
+	}
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded parses an RFC 7239 Forwarded header such as
+// `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`
+func parseForwarded(value string) []hop {
+	if value == "" {
+		return nil
+	}
+
+	var hops []hop
+	for _, element := range strings.Split(value, ",") {
+		var h hop
+		for _, pair := range strings.Split(element, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			val = strings.Trim(val, `"`)
+			switch strings.ToLower(key) {
+			case "for":
+				h.forAddr = val
+			case "proto":
+				h.proto = val
+			case "host":
+				h.host = val
+			}
+		}
+		hops = append(hops, h)
+	}
+	return hops
+}
+
+// parseXForwarded turns the de facto X-Forwarded-For/Proto/Host headers into
+// hops. Only X-Forwarded-For is a list; proto and host describe the client.
+func parseXForwarded(req *request.Request) []hop {
+	var hops []hop
+	if xff := req.Headers.Joined("x-forwarded-for"); xff != "" {
+		for _, addr := range strings.Split(xff, ",") {
+			hops = append(hops, hop{forAddr: strings.TrimSpace(addr)})
+		}
+	}
+
+	proto := firstValue(req.Headers.Joined("x-forwarded-proto"))
+	host := firstValue(req.Headers.Joined("x-forwarded-host"))
+	if proto == "" && host == "" {
+		return hops
+	}
+	if len(hops) == 0 {
+		hops = []hop{{}}
+	}
+	for i := range hops {
+		hops[i].proto, hops[i].host = proto, host
+	}
+	return hops
+}
+
+func firstValue(list string) string {
+	first, _, _ := strings.Cut(list, ",")
+	return strings.TrimSpace(first)
+}
+
+// addrIP extracts the IP from "1.2.3.4", "1.2.3.4:80", "[::1]:80" or "::1".
+// It returns nil for anything else, like the "unknown" or obfuscated
+// identifiers Forwarded allows.
+func addrIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
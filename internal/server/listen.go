@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrReusePortUnsupported is returned by Listen when ReusePort is set on a
+// platform without SO_REUSEPORT.
+var ErrReusePortUnsupported = fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+
+// listen opens the server's TCP listener with the socket options configured
+// on s.
+//
+// The accept backlog is not configurable: Go always asks for the largest
+// queue the OS allows (net.core.somaxconn on Linux, kern.ipc.somaxconn on
+// macOS and the BSDs), so raise that limit on the host for servers that see
+// bursts of new connections.
+func (s *Server) listen() (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setSocketOptions(fd, s.ReuseAddr, s.ReusePort)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", s.port))
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package server
+
+// setSocketOptions only supports what every platform does the same way.
+// ReuseAddr is ignored: on Windows SO_REUSEADDR would let other processes
+// take over the port, and elsewhere Go already sets it on listeners.
+func setSocketOptions(fd uintptr, reuseAddr, reusePort bool) error {
+	if reusePort {
+		return ErrReusePortUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+func newReuseServer(port int, body string) *Server {
+	srv := Serve(port)
+	srv.ReuseAddr = true
+	srv.ReusePort = true
+	srv.AddHandler("/who", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte(body))
+	}).GET()
+	return srv
+}
+
+// TestReuseAddrRebind tests that a server can bind the port of one that
+// just closed, while the old connections are still in TIME_WAIT
+func TestReuseAddrRebind(t *testing.T) {
+	first := newReuseServer(0, "first")
+	port := startTestServer(t, first)
+
+	// The server closes this connection first, leaving it in TIME_WAIT
+	response := sendRequest(t, port, "GET /who HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if !strings.Contains(response, "first") {
+		t.Fatalf("Expected the first server to answer, got: %s", response)
+	}
+	first.Close()
+
+	portNum, _ := strconv.Atoi(port)
+	second := newReuseServer(portNum, "second")
+	if err := second.Listen(); err != nil {
+		t.Fatalf("Rebinding port %s right away failed: %v", port, err)
+	}
+	defer second.Close()
+
+	response = sendRequest(t, port, "GET /who HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.Contains(response, "second") {
+		t.Errorf("Expected the second server to answer, got: %s", response)
+	}
+}
+
+// TestReusePort tests that two servers can listen on one port at once, as
+// during a zero-downtime restart
+func TestReusePort(t *testing.T) {
+	old := newReuseServer(0, "old")
+	port := startTestServer(t, old)
+
+	portNum, _ := strconv.Atoi(port)
+	replacement := newReuseServer(portNum, "new")
+	if err := replacement.Listen(); err != nil {
+		t.Fatalf("Second listener on port %s failed: %v", port, err)
+	}
+	defer replacement.Close()
+
+	// Once the old server stops accepting, the new one takes every connection
+	old.Close()
+	response := sendRequest(t, port, "GET /who HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.Contains(response, "new") {
+		t.Errorf("Expected the new server to answer, got: %s", response)
+	}
+
+	// Without the option the port is taken
+	blocked := Serve(portNum)
+	if err := blocked.Listen(); err == nil {
+		blocked.Close()
+		t.Error("Listening without ReusePort should fail while the port is in use")
+	}
+}
@@ -1,17 +1,23 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"maps"
 	"net"
+	"runtime/debug"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/noelw19/tcptohttp/internal/handler"
+	"github.com/noelw19/tcptohttp/internal/headers"
 	"github.com/noelw19/tcptohttp/internal/middleware.go"
 	"github.com/noelw19/tcptohttp/internal/request"
 	"github.com/noelw19/tcptohttp/internal/response"
@@ -26,36 +32,151 @@ func (h HandlerError) Write(w io.Writer) {
 	fmt.Fprintf(w, "HTTP/1.1 %d %s", h.StatusCode, h.Message)
 }
 
+// DefaultMaxDecompressedBodySize is the decoded body limit used when
+// DecompressBodies is on and no MaxDecompressedBodySize is set.
+const DefaultMaxDecompressedBodySize = 10 << 20
+
+// MaxBodyDrain is how much of a deferred body a handler left unread is read
+// and dropped to keep the connection open. Past it, closing is cheaper.
+const MaxBodyDrain = 256 << 10
+
 type Server struct {
-	Listener   net.Listener
+	Listener net.Listener
+	// HandlerTimeout, when non-zero, sets a deadline on every request's
+	// context so handlers doing I/O can give up via req.Context().Done().
+	HandlerTimeout time.Duration
+	// RequestTimeout, when non-zero, bounds the time spent reading a whole
+	// request (line, headers and body). Slower clients get a 408.
+	RequestTimeout time.Duration
+	// IdleTimeout is how long a connection may wait for its first request,
+	// and a keep-alive connection for its next one, before it is closed.
+	// Zero means DefaultIdleTimeout; tests can make it short to see idle
+	// connections closed without waiting a minute.
+	IdleTimeout time.Duration
+	// DecompressBodies, when set, transparently decodes gzip and deflate
+	// request bodies once they are routed to a handler. With DeferBodies a
+	// body is decoded as the handler reads it.
+	DecompressBodies bool
+	// MaxDecompressedBodySize caps a decoded request body, bigger ones are
+	// answered with a 413, or fail the handler's read when deferred. Zero
+	// means DefaultMaxDecompressedBodySize.
+	MaxDecompressedBodySize int64
+	// BodyPolicy sets what to do with bodies sent on GET, HEAD and DELETE
+	// requests. The default, BodyDrain, discards them.
+	BodyPolicy BodyPolicy
+	// TrustedProxies lists the networks of proxies allowed to tell us who the
+	// client is. Requests from them have RemoteAddr, Scheme and Host taken
+	// from their Forwarded or X-Forwarded-* headers; everyone else's
+	// forwarding headers are ignored.
+	TrustedProxies []net.IPNet
+	// AllowBareLF accepts request lines and headers ending in a lone LF
+	// instead of CRLF. Off by default, such requests get a 400.
+	AllowBareLF bool
+	// ReuseAddr sets SO_REUSEADDR on the listener, so a restarted server can
+	// bind its port while connections from the previous one linger in
+	// TIME_WAIT.
+	ReuseAddr bool
+	// ReusePort sets SO_REUSEPORT, letting several processes listen on the
+	// same port at once: a new process can start accepting while the old one
+	// drains, for zero-downtime restarts. Listen fails with
+	// ErrReusePortUnsupported where the platform lacks it.
+	ReusePort bool
+	// ReadBufferSize is the size each connection's read buffer starts at.
+	// The buffer is reused for every request on the connection and grows as
+	// a request needs. Zero means request.DefaultReadBufferSize.
+	ReadBufferSize int
+	// OnWriteError, when set, is called with the first error hit while
+	// writing a response, usually the client going away partway through, so
+	// it can be logged or counted. The connection is closed afterwards.
+	OnWriteError func(req *request.Request, err error)
+	// OnResponse, when set, is called once a response has been written out
+	// in full and the request is finished with, before the connection reads
+	// the next request or is closed.
+	OnResponse func(req *request.Request)
+	// OnConnection, when set, is called for every connection accepted, once
+	// it is listed by Connections and before its first request is read. It
+	// runs on the accept loop, so it should return quickly.
+	OnConnection func(info ConnInfo)
+	// DeferBodies dispatches requests as soon as their headers are read and
+	// leaves the body on the connection until the handler asks for it with
+	// req.ReadBody, req.BodyReader or one of the form and JSON helpers;
+	// req.Body is empty until then. Handlers that ignore a large upload then
+	// never hold it in memory. Whatever is left unread is discarded before
+	// the next request, or the connection closed if that is more than
+	// MaxBodyDrain bytes.
+	DeferBodies bool
+	// SuggestRoutes makes the default 404 suggest the registered route
+	// closest to the one requested, "did you mean /users?". It is meant for
+	// development: the suggestions reveal the route table, so leave it off
+	// in production.
+	SuggestRoutes bool
+	// RedirectTrailingSlash redirects a path that matches no route to the same
+	// path with its trailing slash added or removed, when that one does match:
+	// "/docs/" to a registered "/docs" and the other way round. The query
+	// string is kept. GET and HEAD get a 301, other methods a 308 so they are
+	// repeated with their body.
+	RedirectTrailingSlash bool
+
 	port       int
-	running    bool
+	running    atomic.Bool
 	notFound   handler.HandlerFunc
 	handlers   *handler.Handlers
 	middleware []middleware.MiddlewareHandler
+	rewriters  []Rewriter
+	filters    []RequestFilter
+	conns      connRegistry
+	ready      chan struct{} // Closed once Listen is accepting connections
+	readyOnce  sync.Once
+
+	// baseCtx is the parent of every request context, cancelled when the
+	// server shuts down
+	baseCtx      context.Context
+	cancelBase   context.CancelFunc
+	shuttingDown atomic.Bool
+	active       sync.WaitGroup // Connection handlers still running
 }
 
 func (s *Server) Show() {
-	for r := range *s.handlers {
-		fmt.Printf("%+v\n", (*s.handlers)[r])
-
-	}
+	s.handlers.Each(func(route string, h *handler.Handler) {
+		fmt.Printf("%+v\n", h)
+	})
 }
 
 func Serve(port int) *Server {
 	server := &Server{
 		port:       port,
-		running:    false,
 		handlers:   &handler.Handlers{},
 		middleware: []middleware.MiddlewareHandler{},
+		ready:      make(chan struct{}),
 	}
-	server.OverrideNotFoundHandler(defaultNotFoundHandler)
+	server.baseCtx, server.cancelBase = context.WithCancel(context.Background())
+	server.OverrideNotFoundHandler(server.defaultNotFoundHandler)
 
 	return server
 }
 
+// Ready returns a channel that is closed once Listen has the listener up, from
+// when connections are accepted and Listener is set. Code starting the server
+// in another goroutine can wait on it rather than sleeping.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Close stops the server immediately: the listener and every open
+// connection are closed, cutting off requests in flight, and request contexts
+// are cancelled. Use Shutdown to let requests finish first.
 func (s *Server) Close() error {
-	s.running = false
+	s.shuttingDown.Store(true)
+	err := s.closeListener()
+	s.conns.closeAll()
+	if s.cancelBase != nil {
+		s.cancelBase()
+	}
+	return err
+}
+
+func (s *Server) closeListener() error {
+	s.running.Store(false)
 	if s.Listener != nil {
 		return s.Listener.Close()
 	}
@@ -63,29 +184,51 @@ func (s *Server) Close() error {
 }
 
 func (s *Server) Listen() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	s.handlers.Validate()
+	listener, err := s.listen()
 	if err != nil {
 		return err
 	}
 	s.Listener = listener
+	s.readyOnce.Do(func() { close(s.ready) })
 
+	// The accept loop counts as active too, so Shutdown returning means no
+	// goroutine of this server is left running
+	s.active.Add(1)
 	go func() {
+		defer s.active.Done()
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
 				// If the listener was closed (expected during shutdown), break the loop
-				if errors.Is(err, net.ErrClosed) || !s.running {
+				if errors.Is(err, net.ErrClosed) || !s.running.Load() {
 					break
 				}
 				// Only log unexpected errors
-				if s.running {
+				if s.running.Load() {
 					fmt.Println(err)
 				}
 				continue
 			}
 
-			s.running = true
-			go s.handle(conn)
+			// Register the connection before checking for shutdown, so it is
+			// either refused here or seen by Close closing everything
+			info := s.conns.add(conn)
+			if s.shuttingDown.Load() {
+				s.conns.remove(conn)
+				conn.Close()
+				continue
+			}
+			if s.OnConnection != nil {
+				s.OnConnection(info)
+			}
+
+			s.running.Store(true)
+			s.active.Add(1)
+			go func() {
+				defer s.active.Done()
+				s.handle(conn)
+			}()
 		}
 	}()
 	return nil
@@ -100,20 +243,48 @@ func (s *Server) AddHandler(route string, handleFunc handler.HandlerFunc) *handl
 	return handler
 }
 
-func (s *Server) handle(conn net.Conn) {
-	// defer conn.Close()
+// AddHandlerWith registers a route like AddHandler, with configure setting it
+// up before any request can match it. Use it for routes added while the
+// server is running, where a request could otherwise reach the route before
+// the methods and middleware chained after AddHandler are in place.
+func (s *Server) AddHandlerWith(route string, handleFunc handler.HandlerFunc, configure func(h *handler.Handler)) *handler.Handler {
+	if !strings.Contains(route, "/") {
+		log.Fatalf("Route %s is implimented wrong, be sure to add a / before the route path", route)
+	}
+
+	return s.handlers.AddWith(route, handleFunc, configure)
+}
 
+func (s *Server) handle(conn net.Conn) {
 	if tcp, ok := conn.(*net.TCPConn); ok {
 		tcp.SetKeepAlive(true)
 		tcp.SetKeepAlivePeriod(30 * time.Second)
 	}
 
 	// ✅ Set read deadline to detect closed connections
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+
+	// One reader for the life of the connection, so its buffer is reused and
+	// pipelined requests read along with an earlier one aren't lost
+	reader := request.NewReaderSize(&trackedConn{Conn: conn, conns: &s.conns}, s.ReadBufferSize)
+	opts := request.Options{
+		Timeout:     s.RequestTimeout,
+		AllowBareLF: s.AllowBareLF,
+		DeferBody:   s.DeferBodies,
+	}
 
 	for {
-		req, err := request.RequestFromReader(conn)
+		// Waiting for the next request, unless it is already in, e.g.
+		// pipelined behind the last one
+		if reader.Buffered() == 0 {
+			s.conns.markIdle(conn)
+		}
+		req, err := reader.ReadRequest(opts)
 		if err != nil {
+			if respondParseError(conn, err) {
+				break
+			}
+
 			// Check for timeout (no data received within deadline)
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				// Connection timed out - this is normal for keep-alive
@@ -122,7 +293,7 @@ func (s *Server) handle(conn net.Conn) {
 			}
 
 			// Check for EOF or closed connection
-			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, request.ErrIncompleteRequest) {
 				// Client closed the connection
 				break
 			}
@@ -147,32 +318,59 @@ func (s *Server) handle(conn net.Conn) {
 			req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion)
 
 		fmt.Println("request received for endpoint: ", req.RequestLine.RequestTarget, ", Method: ", req.RequestLine.Method)
+		s.setClientInfo(req, conn)
+		s.conns.startRequest(conn, req.Path())
 
 		// Check if client wants to close connection
-		connectionHeader := strings.ToLower(req.Headers.Get("connection"))
-		keepalive := connectionHeader == "keep-alive"
+		connectionHeader := strings.ToLower(req.Headers.Joined("connection"))
+		keepalive := connectionHeader == "keep-alive" && !s.shuttingDown.Load()
+
+		if !s.applyBodyPolicy(req) {
+			rejectBody(conn)
+			s.conns.finishRequest(conn)
+			break
+		}
 
 		writer := response.NewResponseWriter(conn)
 		writer.SetDefaultHeaders(keepalive)
+		writer.SetAcceptsTrailers(req.AcceptsTrailers())
+		writer.SetAcceptsChunked(req.RequestLine.HttpVersion != "1.0")
+		writer.SetAcceptsGzip(req.AcceptsEncoding("gzip"))
+		writer.SetHeadResponse(req.RequestLine.Method == "HEAD")
+
+		ctx, cancel := s.requestContext()
+		req = req.WithContext(ctx)
+
+		// A client hanging up mid-request cancels the context, so handlers
+		// waiting on slow work can give up
+		stopWatch := reader.WatchClose(cancel)
+		s.serveRecovered(writer, req)
+		stopWatch()
+		cancel()
+		req.RemoveTempFiles()
+		if err := writer.Err(); err != nil {
+			fmt.Printf("response to %s %s written out of order: %v\n", req.RequestLine.Method, req.Path(), err)
+		}
+		writeErr := writer.WriteErr()
+		if writeErr != nil && s.OnWriteError != nil {
+			s.OnWriteError(req, writeErr)
+		}
+		s.conns.finishRequest(conn)
+		if s.OnResponse != nil {
+			s.OnResponse(req)
+		}
 
-		// Use just the path part (without query string) for route matching
-		path := req.Path()
-		matchResult, err := s.handlers.MatchWithVars(path, handler.AllowedMethod(req.RequestLine.Method))
-		if err == nil {
-			// Populate path variables into the request
-			maps.Copy(req.Vars, matchResult.Vars)
-			s.executeMiddlewares(writer, req, matchResult)
-		} else {
-			if err.Error() == "Method not allowed" {
-				body := respond405()
-				writer.Respond(405, body)
-			} else {
-				s.notFound(writer, req)
-			}
+		// If client wants to close, the response was cut short, couldn't be
+		// written or doesn't match its own framing, or the server is shutting
+		// down, exit loop
+		if !keepalive || !writer.Complete() || s.shuttingDown.Load() {
+			break
 		}
 
-		// If client wants to close, exit loop
-		if !keepalive {
+		// A deferred body the handler left unread is still on the wire in
+		// front of the next request and has to go first
+		if req.DiscardBody(MaxBodyDrain) != nil {
+			closeWriteAndWait(conn)
 			break
 		}
 
@@ -181,15 +379,163 @@ func (s *Server) handle(conn net.Conn) {
 		// The connection itself stays open for keep-alive
 
 		// Reset deadline for next request
-		// This gives the client 60 seconds to send the next request
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		// This gives the client IdleTimeout to send the next request
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
 	}
 
 	fmt.Println("Closing conn")
 
+	s.conns.remove(conn)
 	conn.Close()
 }
 
+// requestContext returns the context a single request is served under. It is
+// derived from the server's base context, so Shutdown can cancel it, and
+// bounded by HandlerTimeout when one is configured.
+func (s *Server) requestContext() (context.Context, context.CancelFunc) {
+	base := s.baseCtx
+	if base == nil {
+		base = context.Background()
+	}
+	if s.HandlerTimeout > 0 {
+		return context.WithTimeout(base, s.HandlerTimeout)
+	}
+	return context.WithCancel(base)
+}
+
+// serveRequest routes a parsed request to its handler and runs it.
+func (s *Server) serveRequest(writer *response.Writer, req *request.Request) {
+	for _, filter := range s.filters {
+		if herr := filter(req); herr != nil {
+			writer.Respond(response.StatusCode(herr.StatusCode), []byte(herr.Message))
+			return
+		}
+	}
+
+	for _, rewrite := range s.rewriters {
+		if rewrite(writer, req) {
+			return
+		}
+	}
+
+	// Use just the path part (without query string) for route matching
+	path := req.Path()
+	matchResult, err := s.handlers.MatchWithVars(path, handler.AllowedMethod(req.RequestLine.Method))
+	if err != nil {
+		var notAllowed *handler.MethodNotAllowedError
+		if errors.As(err, &notAllowed) {
+			writer.ReplaceHeader("allow", strings.Join(notAllowed.Allowed, ", "))
+			writer.Respond(response.StatusMethodNotAllowed, respond405())
+		} else if errors.Is(err, handler.ErrBadPath) {
+			writer.Respond(response.StatusBadRequest, []byte(response.GetStatusReason(response.StatusBadRequest)))
+		} else if location, ok := s.trailingSlashRedirect(req); ok {
+			status := response.StatusMovedPermanently
+			if method := req.RequestLine.Method; method != "GET" && method != "HEAD" {
+				status = response.StatusPermanentRedirect
+			}
+			writer.Redirect(status, location)
+		} else {
+			s.notFound(writer, req)
+		}
+		return
+	}
+
+	// Routes limiting what bodies they take turn the rest away up front
+	if hasBody(req) && !matchResult.Handler.AcceptsBody(req.Headers.Get("content-type")) {
+		status := response.StatusUnsupportedMediaType
+		writer.Respond(status, []byte(response.GetStatusReason(status)))
+		return
+	}
+
+	// Only bodies a handler is going to get are decoded. A deferred one is
+	// decoded as the handler reads it, so it stays on the connection for now.
+	if s.DecompressBodies {
+		if err := req.Decompress(s.maxDecompressedBodySize()); err != nil {
+			status := response.StatusBadRequest
+			switch {
+			case errors.Is(err, request.ErrBodyTooLarge):
+				status = response.StatusPayloadTooLarge
+			case errors.Is(err, request.ErrUnsupportedEncoding):
+				status = response.StatusUnsupportedMediaType
+			}
+			writer.Respond(status, []byte(response.GetStatusReason(status)))
+			return
+		}
+	}
+
+	// Routes declaring what they produce pick the variant the client accepts
+	if len(matchResult.Handler.ProducedTypes()) > 0 {
+		method := handler.AllowedMethod(req.RequestLine.Method)
+		hf, contentType, err := matchResult.Handler.SelectVariant(method, req.Negotiate)
+		writer.AddVary("Accept")
+		if err != nil {
+			writer.Respond(response.StatusNotAcceptable, respond406())
+			return
+		}
+		matchResult.HandlerFunc = hf
+		if contentType != "" {
+			writer.ReplaceHeader("content-type", contentType)
+		}
+	}
+
+	// Populate path variables and the matched pattern into the request
+	maps.Copy(req.Vars, matchResult.Vars)
+	req.SetRoutePattern(matchResult.Handler.Route())
+	s.executeMiddlewares(writer, req, matchResult)
+}
+
+// serveRecovered runs serveRequest with a recovery boundary around it, so a
+// panic in a rewriter, middleware or handler costs only the request that hit
+// it. The client gets a 500 if nothing was sent yet; either way the writer is
+// aborted so the connection gets closed, since whatever panicked may have
+// left it in an unknown state.
+func (s *Server) serveRecovered(writer *response.Writer, req *request.Request) {
+	defer func() {
+		rec := recover()
+		if rec == nil {
+			return
+		}
+		fmt.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.Path(), rec, debug.Stack())
+		if !writer.Started() {
+			writer.ReplaceHeader("connection", "close")
+			writer.Respond(response.StatusInternalServerError, respond500())
+		}
+		writer.Abort()
+	}()
+	s.serveRequest(writer, req)
+}
+
+func (s *Server) maxDecompressedBodySize() int64 {
+	if s.MaxDecompressedBodySize > 0 {
+		return s.MaxDecompressedBodySize
+	}
+	return DefaultMaxDecompressedBodySize
+}
+
+// Rewriter inspects a request before it is routed. It can change it, e.g.
+// with req.SetTarget, or answer it itself and return true to skip routing.
+type Rewriter func(w *response.Writer, req *request.Request) (handled bool)
+
+// UseRewriter adds a rewriter run on every request after it is parsed and
+// before it is matched to a route. Rewriters run in the order they were added
+// until one handles the request.
+func (s *Server) UseRewriter(rw Rewriter) {
+	s.rewriters = append(s.rewriters, rw)
+}
+
+// RequestFilter vets a request as soon as it is parsed. Returning a non-nil
+// HandlerError rejects it: the client gets its status code with the message
+// as the body, and nothing else runs for the request.
+type RequestFilter func(req *request.Request) *HandlerError
+
+// UseRequestFilter adds a filter run on every request before anything else
+// sees it, rewriters, routing and middleware included, to turn away plainly
+// bad requests cheaply, e.g. oversized URLs or banned headers. Filters run in
+// the order they were added until one rejects the request.
+func (s *Server) UseRequestFilter(f RequestFilter) {
+	s.filters = append(s.filters, f)
+}
+
 func (s *Server) Use(m middleware.MiddlewareHandler) {
 	s.middleware = append(s.middleware, m)
 }
@@ -198,6 +544,35 @@ func (s *Server) OverrideNotFoundHandler(notFoundHandler handler.HandlerFunc) {
 	s.notFound = notFoundHandler
 }
 
+// trailingSlashRedirect returns where RedirectTrailingSlash sends a request
+// that matched no route: its path with the trailing slash toggled, plus its
+// query, if that path has a route. ok is false when it is off or there is
+// nowhere to send the request.
+func (s *Server) trailingSlashRedirect(req *request.Request) (location string, ok bool) {
+	path := req.Path()
+	// "//host/" would become a redirect to another site
+	if !s.RedirectTrailingSlash || path == "/" || strings.HasPrefix(path, "//") {
+		return "", false
+	}
+	if trimmed, cut := strings.CutSuffix(path, "/"); cut {
+		path = trimmed
+	} else {
+		path += "/"
+	}
+
+	_, err := s.handlers.MatchWithVars(path, handler.AllowedMethod(req.RequestLine.Method))
+	if err != nil && !errors.Is(err, handler.ErrMethodNotAllowed) {
+		return "", false
+	}
+	if _, query, found := strings.Cut(req.RequestLine.RequestTarget, "?"); found {
+		path += "?" + query
+	}
+	return path, true
+}
+
+// executeMiddlewares runs the matched route's func wrapped in its own
+// middleware, and that in the global middleware, so global middleware sees
+// the request first
 func (s *Server) executeMiddlewares(w *response.Writer, r *request.Request, next *handler.MatchResult) {
 	middlewares := slices.Clone(s.middleware)
 
@@ -211,6 +586,72 @@ func (s *Server) executeMiddlewares(w *response.Writer, r *request.Request, next
 	finalHandler(w, r)
 }
 
+// respondParseError answers a request that could not be read with the status
+// matching err. It reports whether a response was written; errors it does not
+// know about are left to the caller.
+func respondParseError(conn net.Conn, err error) bool {
+	var status response.StatusCode
+	switch {
+	case errors.Is(err, request.ErrRequestTimeout):
+		status = response.StatusRequestTimeout
+	case errors.Is(err, request.ErrMissingHost), errors.Is(err, request.ErrDuplicateHost),
+		errors.Is(err, request.ErrBadRequestTarget), errors.Is(err, request.ErrBadContentLength),
+		errors.Is(err, request.ErrBadChunk),
+		errors.Is(err, headers.ErrBareLF), errors.Is(err, headers.ErrBareCR):
+		status = response.StatusBadRequest
+	case errors.Is(err, headers.ErrHeaderLineTooLong), errors.Is(err, request.ErrHeadTooLarge):
+		status = response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrURITooLong):
+		status = response.StatusURITooLong
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		status = response.StatusHTTPVersionNotSupported
+	default:
+		return false
+	}
+
+	body := response.GetStatusReason(status)
+	if status == response.StatusHTTPVersionNotSupported {
+		body = "HTTP Version Not Supported: this server speaks HTTP/1.0 and HTTP/1.1"
+	}
+
+	w := response.NewResponseWriter(conn)
+	w.SetDefaultHeaders(false)
+	w.Respond(status, []byte(body))
+	return true
+}
+
+// rstAvoidanceDelay is how long a connection with unread input is kept after
+// the response, so the client can read it before the close resets the
+// connection and throws it away
+const rstAvoidanceDelay = 500 * time.Millisecond
+
+// DefaultIdleTimeout is the IdleTimeout of servers that don't set one
+const DefaultIdleTimeout = 60 * time.Second
+
+// idleTimeout is IdleTimeout, or its default
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// closeWriteAndWait ends our side of a connection the client is still
+// sending on, then gives the client time to read what it was sent
+func closeWriteAndWait(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	time.Sleep(rstAvoidanceDelay)
+}
+
+// rejectBody refuses a request carrying a body its method shouldn't have
+func rejectBody(conn net.Conn) {
+	w := response.NewResponseWriter(conn)
+	w.SetDefaultHeaders(false)
+	w.Respond(response.StatusBadRequest, []byte("Request body not allowed for this method"))
+}
+
 func respond405() []byte {
 	return []byte(`<html>
   <head>
@@ -223,9 +664,65 @@ func respond405() []byte {
 </html>`)
 }
 
-func defaultNotFoundHandler(w *response.Writer, req *request.Request) {
+func respond406() []byte {
+	return []byte(`<html>
+  <head>
+    <title>406 Not Acceptable</title>
+  </head>
+  <body>
+    <h1>Not Acceptable</h1>
+    <p>This endpoint cannot produce any of the types you accept</p>
+  </body>
+</html>`)
+}
+
+func respond500() []byte {
+	return []byte(`<html>
+  <head>
+    <title>500 Internal Server Error</title>
+  </head>
+  <body>
+    <h1>Internal Server Error</h1>
+    <p>Something went wrong while handling your request</p>
+  </body>
+</html>`)
+}
+
+// maxSuggestDistance is how many edits away from the requested path a route
+// may be and still be suggested
+const maxSuggestDistance = 3
+
+func (s *Server) defaultNotFoundHandler(w *response.Writer, req *request.Request) {
 	w.SetDefaultHeaders(false)
-	w.Respond(404, respond404())
+	if !s.SuggestRoutes {
+		w.Respond(404, respond404())
+		return
+	}
+
+	// The answer is HTML or JSON depending on what the client takes
+	w.AddVary("Accept")
+	route, ok := s.handlers.Closest(req.Path(), maxSuggestDistance)
+	if req.Negotiate([]string{"text/html", "application/json"}) == "application/json" {
+		body := map[string]string{"error": "not found"}
+		if ok {
+			body["suggestion"] = route
+		}
+		w.Status(404).JSON(body)
+		return
+	}
+	if !ok {
+		w.Respond(404, respond404())
+		return
+	}
+	w.Respond(404, fmt.Appendf(nil, `<html>
+  <head>
+    <title>404 Not Found</title>
+  </head>
+  <body>
+    <h1>Not Found</h1>
+    <p>Could not find what you are looking for, did you mean <a href="%[1]s">%[1]s</a>?</p>
+  </body>
+</html>`, html.EscapeString(route)))
 }
 
 func respond404() []byte {
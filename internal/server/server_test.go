@@ -2,16 +2,27 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/noelw19/tcptohttp/internal/decompress"
+	"github.com/noelw19/tcptohttp/internal/handler"
+	"github.com/noelw19/tcptohttp/internal/headers"
+	"github.com/noelw19/tcptohttp/internal/middleware.go"
 	"github.com/noelw19/tcptohttp/internal/request"
 	"github.com/noelw19/tcptohttp/internal/response"
+	"github.com/noelw19/tcptohttp/internal/stream"
 )
 
 // readFullHTTPResponse reads a complete HTTP response from the connection
@@ -81,6 +92,7 @@ func TestKeepAlive(t *testing.T) {
 		body := []byte("test response")
 		w.Respond(200, body)
 	}).GET()
+	responses := notifyResponses(srv)
 
 	// Start the server
 	err := srv.Listen()
@@ -89,8 +101,8 @@ func TestKeepAlive(t *testing.T) {
 	}
 	defer srv.Close()
 
-	// Wait a bit for server to start accepting connections
-	time.Sleep(50 * time.Millisecond)
+	// Wait for the server to start accepting connections
+	<-srv.Ready()
 
 	// Get the actual port the server is listening on
 	addr := srv.Listener.Addr().String()
@@ -131,9 +143,12 @@ func TestKeepAlive(t *testing.T) {
 	if !strings.Contains(response1, "HTTP/1.1 200") {
 		t.Errorf("Expected HTTP/1.1 200, got: %s", response1[:100])
 	}
-	if !strings.Contains(response1, "connection: keep-alive") {
+	if !strings.Contains(response1, "Connection: keep-alive") {
 		t.Error("Response should include 'Connection: keep-alive' header")
 	}
+	if strings.Contains(response1, "Connection: close") {
+		t.Error("Keep-alive response should not include 'Connection: close'")
+	}
 	if !strings.Contains(response1, "test response") {
 		t.Error("Response should include 'test response' body")
 	}
@@ -141,8 +156,8 @@ func TestKeepAlive(t *testing.T) {
 	fmt.Println(response1)
 	fmt.Println("--------------------------------")
 
-	// Wait a bit before second request
-	time.Sleep(100 * time.Millisecond)
+	// Wait for the server to be done with the first request
+	waitForResponse(t, responses)
 
 	// Second request on the SAME connection
 	request2 := "GET /test HTTP/1.1\r\n" +
@@ -194,7 +209,7 @@ func TestKeepAliveConnectionClose(t *testing.T) {
 	}
 	defer srv.Close()
 
-	time.Sleep(50 * time.Millisecond)
+	<-srv.Ready()
 
 	addr := srv.Listener.Addr().String()
 	_, port, err := net.SplitHostPort(addr)
@@ -263,6 +278,7 @@ func TestKeepAliveMultipleRequests(t *testing.T) {
 		body := []byte("test response")
 		w.Respond(200, body)
 	}).GET()
+	responses := notifyResponses(srv)
 
 	err := srv.Listen()
 	if err != nil {
@@ -270,7 +286,7 @@ func TestKeepAliveMultipleRequests(t *testing.T) {
 	}
 	defer srv.Close()
 
-	time.Sleep(50 * time.Millisecond)
+	<-srv.Ready()
 
 	addr := srv.Listener.Addr().String()
 	_, port, err := net.SplitHostPort(addr)
@@ -309,7 +325,7 @@ func TestKeepAliveMultipleRequests(t *testing.T) {
 			t.Errorf("Request %d: Response should include 'test response' body", i)
 		}
 
-		time.Sleep(50 * time.Millisecond)
+		waitForResponse(t, responses)
 	}
 
 	if requestCount != 5 {
@@ -318,3 +334,2310 @@ func TestKeepAliveMultipleRequests(t *testing.T) {
 
 	t.Logf("✅ Multiple requests test passed: %d requests processed on same connection", requestCount)
 }
+
+// notifyResponses sets srv.OnResponse to report every finished request on
+// the returned channel. Call it before the server is started.
+func notifyResponses(srv *Server) <-chan *request.Request {
+	responses := make(chan *request.Request, 16)
+	srv.OnResponse = func(req *request.Request) {
+		responses <- req
+	}
+	return responses
+}
+
+// waitForResponse waits for the server to report a finished request on
+// responses and returns it
+func waitForResponse(t *testing.T, responses <-chan *request.Request) *request.Request {
+	t.Helper()
+
+	select {
+	case req := <-responses:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the response to be written")
+		return nil
+	}
+}
+
+// startTestServer starts srv on the port it was created with and returns the
+// port it is actually listening on. The server is closed when the test ends.
+func startTestServer(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse address: %v", err)
+	}
+	return port
+}
+
+// sendRequest writes a raw request on a fresh connection and returns the
+// complete response.
+func sendRequest(t *testing.T, port, raw string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	response, err := readFullHTTPResponse(conn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return response
+}
+
+// TestHandlerTimeout tests that HandlerTimeout puts a deadline on the request
+// context that both the handler and the Timeout middleware observe
+func TestHandlerTimeout(t *testing.T) {
+	srv := Serve(0)
+	srv.HandlerTimeout = 50 * time.Millisecond
+
+	ctxErr := make(chan error, 1)
+	srv.AddHandler("/slow", func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			ctxErr <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			ctxErr <- nil
+			w.Respond(200, []byte("too late"))
+		}
+	}).Use(middleware.Timeout(time.Minute)).GET()
+
+	port := startTestServer(t, srv)
+
+	start := time.Now()
+	response := sendRequest(t, port, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	if err := <-ctxErr; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected handler context to hit its deadline, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handler context should be done after ~50ms, took %v", elapsed)
+	}
+	if !strings.Contains(response, "HTTP/1.1 503") {
+		t.Errorf("Timeout middleware should answer 503, got: %s", response)
+	}
+}
+
+// TestClientDisconnectCancelsContext tests that a client hanging up while its
+// request is being handled cancels the request context, and that a client
+// pipelining its next request doesn't
+func TestClientDisconnectCancelsContext(t *testing.T) {
+	srv := Serve(0)
+
+	started := make(chan struct{}, 2)
+	ctxErr := make(chan error, 2)
+	srv.AddHandler("/slow", func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		select {
+		case <-req.Context().Done():
+			ctxErr <- req.Context().Err()
+		case <-time.After(300 * time.Millisecond):
+			ctxErr <- nil
+			w.Respond(200, []byte("finished"))
+		}
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	// Test: Hanging up cancels the context
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if _, err := conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	<-started
+	conn.Close()
+
+	select {
+	case err := <-ctxErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected the context to be cancelled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Context was not cancelled after the client hung up")
+	}
+
+	// Test: A pipelined request arriving mid-handler is still served
+	conn, err = net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	<-started
+	if _, err := conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	response := readUntilClosed(t, conn)
+	if err := <-ctxErr; err != nil {
+		t.Fatalf("First request's context should not be cancelled, got %v", err)
+	}
+	if err := <-ctxErr; err != nil {
+		t.Fatalf("Second request's context should not be cancelled, got %v", err)
+	}
+	if strings.Count(response, "finished") != 2 {
+		t.Errorf("Expected both pipelined responses, got: %s", response)
+	}
+}
+
+// TestRequestTimeout tests that a client dribbling its body slower than
+// RequestTimeout allows is answered with a 408
+func TestRequestTimeout(t *testing.T) {
+	srv := Serve(0)
+	srv.RequestTimeout = 100 * time.Millisecond
+	srv.AddHandler("/upload", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("uploaded"))
+	}).POST()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:" + port + "\r\n" +
+		"Content-Length: 100\r\n" +
+		"\r\n" +
+		"ab"))
+	if err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	// Keep sending a byte now and then, never finishing the body in time
+	go func() {
+		for range 20 {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+
+	response, err := readFullHTTPResponse(conn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !strings.Contains(response, "HTTP/1.1 408") {
+		t.Errorf("Expected HTTP/1.1 408, got: %s", response)
+	}
+}
+
+// TestHandlerOutlivesRequestTimeout tests that a handler still working when
+// the request's read deadline passes keeps its context, since the client is
+// still connected and waiting
+func TestHandlerOutlivesRequestTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		configure func(srv *Server)
+	}{
+		{"RequestTimeout", func(srv *Server) { srv.RequestTimeout = 100 * time.Millisecond }},
+		{"IdleTimeout", func(srv *Server) { srv.IdleTimeout = 100 * time.Millisecond }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := Serve(0)
+			tt.configure(srv)
+			ctxErr := make(chan error, 1)
+			srv.AddHandler("/slow", func(w *response.Writer, req *request.Request) {
+				select {
+				case <-req.Context().Done():
+				case <-time.After(400 * time.Millisecond):
+				}
+				ctxErr <- req.Context().Err()
+				w.Respond(200, []byte("finished"))
+			}).GET()
+			port := startTestServer(t, srv)
+
+			response := sendRequest(t, port, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			if err := <-ctxErr; err != nil {
+				t.Errorf("Context should not be cancelled while the client waits, got %v", err)
+			}
+			if !strings.HasPrefix(response, "HTTP/1.1 200") {
+				t.Errorf("Expected a 200, got: %s", response)
+			}
+		})
+	}
+}
+
+// TestConnections tests that open connections are reported with their remote
+// addresses and request counts
+func TestConnections(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/test", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("test"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	clientAddrs := map[string]bool{}
+	for range 2 {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		clientAddrs[conn.LocalAddr().String()] = true
+
+		_, err = conn.Write([]byte("GET /test HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+		if _, err := readFullHTTPResponse(conn, 5*time.Second); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+	}
+
+	infos := srv.Connections()
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 connections, got %d: %+v", len(infos), infos)
+	}
+	for _, info := range infos {
+		if !clientAddrs[info.RemoteAddr] {
+			t.Errorf("Unexpected remote address %s, want one of %v", info.RemoteAddr, clientAddrs)
+		}
+		if info.Requests != 1 {
+			t.Errorf("Expected 1 request served on %s, got %d", info.RemoteAddr, info.Requests)
+		}
+		if info.StartedAt.IsZero() {
+			t.Errorf("Connection %s has no start time", info.RemoteAddr)
+		}
+	}
+}
+
+// TestProducesNotAcceptable tests that handlers declaring what they produce
+// are only run for clients whose Accept header allows it
+func TestProducesNotAcceptable(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/data", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte(`{"ok": true}`))
+	}).Produces("application/json").GET()
+
+	port := startTestServer(t, srv)
+
+	tests := []struct {
+		accept string
+		status string
+	}{
+		{accept: "application/json", status: "HTTP/1.1 200"},
+		{accept: "text/html;q=0.9, application/*;q=0.5", status: "HTTP/1.1 200"},
+		{accept: "*/*", status: "HTTP/1.1 200"},
+		{accept: "text/html", status: "HTTP/1.1 406"},
+		{accept: "application/json;q=0", status: "HTTP/1.1 406"},
+	}
+
+	for _, tt := range tests {
+		response := sendRequest(t, port, "GET /data HTTP/1.1\r\nHost: localhost\r\nAccept: "+tt.accept+"\r\n\r\n")
+		if !strings.HasPrefix(response, tt.status) {
+			t.Errorf("Accept %q: expected %s, got: %s", tt.accept, tt.status, response)
+		}
+		if tt.status == "HTTP/1.1 200" && !strings.Contains(response, "Content-Type: application/json") {
+			t.Errorf("Accept %q: response should declare the negotiated content type, got: %s", tt.accept, response)
+		}
+	}
+}
+
+// TestProducesVariants tests that one route can hold a handler per content
+// type and the Accept header decides which runs
+func TestProducesVariants(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/report", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte(`{"report": "json"}`))
+	}).Produces("application/json").GET()
+	srv.AddHandler("/report", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("<p>report html</p>"))
+	}).GET().Produces("text/html")
+
+	port := startTestServer(t, srv)
+
+	tests := []struct {
+		accept      string
+		status      string
+		contentType string
+		body        string
+	}{
+		{accept: "application/json", status: "HTTP/1.1 200", contentType: "application/json", body: `{"report": "json"}`},
+		{accept: "text/html,application/xhtml+xml,*/*;q=0.8", status: "HTTP/1.1 200", contentType: "text/html", body: "<p>report html</p>"},
+		{accept: "text/html;q=0.5, application/json", status: "HTTP/1.1 200", contentType: "application/json", body: `{"report": "json"}`},
+		{accept: "image/png", status: "HTTP/1.1 406"},
+	}
+
+	for _, tt := range tests {
+		response := sendRequest(t, port, "GET /report HTTP/1.1\r\nHost: localhost\r\nAccept: "+tt.accept+"\r\n\r\n")
+		if !strings.HasPrefix(response, tt.status) {
+			t.Errorf("Accept %q: expected %s, got: %s", tt.accept, tt.status, response)
+			continue
+		}
+		if !strings.Contains(response, "Vary: Accept") {
+			t.Errorf("Accept %q: response should vary on Accept, got: %s", tt.accept, response)
+		}
+		if tt.body == "" {
+			continue
+		}
+		if !strings.Contains(response, "Content-Type: "+tt.contentType) {
+			t.Errorf("Accept %q: expected content type %s, got: %s", tt.accept, tt.contentType, response)
+		}
+		if !strings.HasSuffix(response, tt.body) {
+			t.Errorf("Accept %q: expected body %s, got: %s", tt.accept, tt.body, response)
+		}
+	}
+}
+
+// TestVaryNegotiationAndCompression tests that a response picked by Accept
+// and compressed by Accept-Encoding varies on both, once each
+func TestVaryNegotiationAndCompression(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/report", func(w *response.Writer, req *request.Request) {
+		w.AddVary("Accept")
+		w.RespondGzip(200, []byte(`{"report": "json"}`))
+	}).Produces("application/json").GET()
+	port := startTestServer(t, srv)
+
+	for _, acceptEncoding := range []string{"gzip", "identity"} {
+		response := sendRequest(t, port, "GET /report HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\nAccept-Encoding: "+acceptEncoding+"\r\n\r\n")
+		if !strings.Contains(response, "Vary: Accept, Accept-Encoding\r\n") {
+			t.Errorf("Accept-Encoding %s: expected Vary on Accept and Accept-Encoding, got: %s", acceptEncoding, response)
+		}
+	}
+}
+
+// TestKeepAliveIgnoredBody tests that a POST body the handler never looks at
+// does not corrupt the next request on the same connection
+func TestKeepAliveIgnoredBody(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/ignore", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("ignored"))
+	}).POST()
+	srv.AddHandler("/next", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("next ok"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// A body that looks like a request, sent separately so it is still in
+	// flight when the headers are parsed
+	body := "GET /next HTTP/1.1\r\n\r\nxx"
+	_, err = conn.Write([]byte("POST /ignore HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := conn.Write([]byte(body)); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+
+	response1, err := readFullHTTPResponse(conn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read first response: %v", err)
+	}
+	if !strings.Contains(response1, "ignored") {
+		t.Errorf("Expected the POST handler to answer, got: %s", response1)
+	}
+
+	_, err = conn.Write([]byte("GET /next HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write second request: %v", err)
+	}
+	response2, err := readFullHTTPResponse(conn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read second response: %v", err)
+	}
+	if !strings.Contains(response2, "HTTP/1.1 200") || !strings.Contains(response2, "next ok") {
+		t.Errorf("Second request should parse cleanly, got: %s", response2)
+	}
+}
+
+// readUntilClosed reads everything the server sends until it closes the connection
+func readUntilClosed(t *testing.T, conn net.Conn) string {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return string(data)
+}
+
+// TestStreamTrailers tests that chunked trailers are only sent to clients
+// advertising TE: trailers
+func TestStreamTrailers(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/stream", func(w *response.Writer, req *request.Request) {
+		stream.Streamer(w, headers.NewHeaders(), io.NopCloser(strings.NewReader("hello stream")))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	for _, withTE := range []bool{true, false} {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+
+		request := "GET /stream HTTP/1.1\r\nHost: localhost\r\n"
+		if withTE {
+			request += "TE: trailers\r\n"
+		}
+		if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+
+		response := readUntilClosed(t, conn)
+		if !strings.Contains(response, "hello stream") {
+			t.Errorf("TE %v: expected streamed body, got: %s", withTE, response)
+		}
+		if !strings.HasSuffix(response, "\r\n\r\n") {
+			t.Errorf("TE %v: chunked body should be terminated, got: %q", withTE, response)
+		}
+
+		sentTrailerHeader := strings.Contains(response, "Trailer: X-Content-SHA256")
+		sentTrailers := strings.Contains(strings.ToLower(response), "x-content-sha256:")
+		if sentTrailerHeader != withTE || sentTrailers != withTE {
+			t.Errorf("TE %v: trailer header sent %v, trailers sent %v: %q", withTE, sentTrailerHeader, sentTrailers, response)
+		}
+	}
+}
+
+// TestHostHeaderValidation tests that HTTP/1.1 requests need exactly one Host header
+func TestHostHeaderValidation(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/test", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("test"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	tests := []struct {
+		name    string
+		headers string
+		status  string
+	}{
+		{name: "missing host", headers: "Accept: */*\r\n", status: "HTTP/1.1 400"},
+		{name: "duplicate host", headers: "Host: a.example\r\nHost: b.example\r\n", status: "HTTP/1.1 400"},
+		{name: "single host", headers: "Host: localhost\r\n", status: "HTTP/1.1 200"},
+	}
+
+	for _, tt := range tests {
+		response := sendRequest(t, port, "GET /test HTTP/1.1\r\n"+tt.headers+"\r\n")
+		if !strings.HasPrefix(response, tt.status) {
+			t.Errorf("%s: expected %s, got: %s", tt.name, tt.status, response)
+		}
+	}
+}
+
+// TestHandlerChunkedResponse tests that a handler can opt into chunked framing
+// for a body it built in memory
+func TestHandlerChunkedResponse(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/chunked", func(w *response.Writer, req *request.Request) {
+		w.SetChunked(true)
+		w.Respond(200, []byte("in-memory body"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("GET /chunked HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	response := readUntilClosed(t, conn)
+	if !strings.Contains(response, "Transfer-Encoding: chunked\r\n") {
+		t.Errorf("Response should be chunked, got: %q", response)
+	}
+	if strings.Contains(response, "Content-Length") {
+		t.Errorf("Chunked response should not carry a content-length, got: %q", response)
+	}
+	if !strings.HasSuffix(response, "\r\n\r\ne\r\nin-memory body\r\n0\r\n\r\n") {
+		t.Errorf("Unexpected chunked body framing: %q", response)
+	}
+}
+
+// TestDecompressBodies tests that gzip request bodies are decoded when the
+// server opts in, and that oversized results are refused
+func TestDecompressBodies(t *testing.T) {
+	srv := Serve(0)
+	srv.DecompressBodies = true
+	srv.MaxDecompressedBodySize = 1024
+	srv.AddHandler("/echo", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, req.Body)
+	}).POST()
+
+	port := startTestServer(t, srv)
+
+	gzipped := func(data []byte) string {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(data)
+		gw.Close()
+		return buf.String()
+	}
+
+	for _, tt := range []struct {
+		body   []byte
+		status string
+	}{
+		{body: []byte("decoded for the handler"), status: "HTTP/1.1 200"},
+		{body: make([]byte, 4096), status: "HTTP/1.1 413"},
+	} {
+		encoded := gzipped(tt.body)
+		response := sendRequest(t, port, "POST /echo HTTP/1.1\r\n"+
+			"Host: localhost\r\n"+
+			"Content-Encoding: gzip\r\n"+
+			"Content-Length: "+strconv.Itoa(len(encoded))+"\r\n"+
+			"\r\n"+encoded)
+
+		if !strings.HasPrefix(response, tt.status) {
+			t.Errorf("Expected %s, got: %q", tt.status, response)
+		}
+		if tt.status == "HTTP/1.1 200" && !strings.Contains(response, string(tt.body)) {
+			t.Errorf("Handler should see the decoded body, got: %q", response)
+		}
+	}
+
+	// Test: Requests no handler takes aren't decoded, an undecodable body
+	// doesn't turn their 404 into a 400
+	response := sendRequest(t, port, "POST /missing HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Encoding: gzip\r\nContent-Length: 8\r\n\r\nnot gzip")
+	if !strings.HasPrefix(response, "HTTP/1.1 404") {
+		t.Errorf("Expected a 404, got: %q", response)
+	}
+}
+
+// TestDecompressAfterRouting tests that bodies are only decoded for requests
+// that reach a handler, and with DeferBodies only as the handler reads them
+func TestDecompressAfterRouting(t *testing.T) {
+	srv := Serve(0)
+	srv.DecompressBodies = true
+	srv.DeferBodies = true
+	srv.MaxDecompressedBodySize = 1024
+	srv.AddHandler("/ignore", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("ignored"))
+	}).POST()
+	srv.AddHandler("/echo", func(w *response.Writer, req *request.Request) {
+		body, err := req.ReadBody()
+		if errors.Is(err, request.ErrBodyTooLarge) {
+			w.Respond(response.StatusPayloadTooLarge, []byte("too large"))
+			return
+		}
+		if err != nil {
+			w.Respond(response.StatusBadRequest, []byte(err.Error()))
+			return
+		}
+		w.Respond(200, body)
+	}).POST()
+	port := startTestServer(t, srv)
+
+	gzipped := func(data []byte) string {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(data)
+		gw.Close()
+		return buf.String()
+	}
+	post := func(path, encoded string) string {
+		return sendRequest(t, port, "POST "+path+" HTTP/1.1\r\n"+
+			"Host: localhost\r\n"+
+			"Content-Encoding: gzip\r\n"+
+			"Content-Length: "+strconv.Itoa(len(encoded))+"\r\n"+
+			"\r\n"+encoded)
+	}
+
+	for _, tt := range []struct {
+		name, path, body, status, contains string
+	}{
+		// Bodies that aren't gzip at all show whether decoding was tried
+		{"unknown route", "/missing", "not gzip", "HTTP/1.1 404", ""},
+		{"ignored body", "/ignore", "not gzip", "HTTP/1.1 200", "ignored"},
+		{"read body", "/echo", gzipped([]byte("decoded on read")), "HTTP/1.1 200", "decoded on read"},
+		{"bomb", "/echo", gzipped(make([]byte, 4096)), "HTTP/1.1 413", "too large"},
+	} {
+		response := post(tt.path, tt.body)
+		if !strings.HasPrefix(response, tt.status) || !strings.Contains(response, tt.contains) {
+			t.Errorf("%s: expected %s with %q, got: %q", tt.name, tt.status, tt.contains, response)
+		}
+	}
+
+	// Test: A method the route doesn't take gets its 405 undecoded
+	response := sendRequest(t, port, "PUT /echo HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Encoding: gzip\r\nContent-Length: 8\r\n\r\nnot gzip")
+	if !strings.HasPrefix(response, "HTTP/1.1 405") {
+		t.Errorf("Expected a 405, got: %q", response)
+	}
+}
+
+// TestForwardBodyUpstreamFailure tests that a handler forwarding an upload
+// to an upstream that hangs up partway answers 502, and that the connection
+// is then closed rather than the rest of the upload read
+func TestForwardBodyUpstreamFailure(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		io.CopyN(io.Discard, conn, 64<<10)
+		conn.Close()
+	}()
+
+	srv := Serve(0)
+	srv.DeferBodies = true
+	srv.AddHandler("/upload", func(w *response.Writer, req *request.Request) {
+		conn, err := net.Dial("tcp", upstream.Addr().String())
+		if err != nil {
+			w.Respond(response.StatusBadGateway, []byte(err.Error()))
+			return
+		}
+		defer conn.Close()
+		if _, err := req.ForwardBody(conn); err != nil {
+			w.Respond(response.StatusBadGateway, []byte("upstream failed"))
+			return
+		}
+		w.Respond(200, []byte("forwarded"))
+	}).POST()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n" +
+			"Content-Length: " + strconv.Itoa(256<<20) + "\r\n\r\n"))
+		chunk := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	response := readUntilClosed(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 502") || !strings.HasSuffix(response, "upstream failed") {
+		t.Errorf("Expected a 502 before the connection closed, got: %s", response)
+	}
+}
+
+// TestShutdownDrains tests that Shutdown lets in-flight requests finish and
+// closes idle keep-alive connections
+func TestShutdownDrains(t *testing.T) {
+	srv := Serve(0)
+	started := make(chan struct{})
+	srv.AddHandler("/slow", func(w *response.Writer, req *request.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Respond(200, []byte("finished"))
+	}).GET()
+	srv.AddHandler("/fast", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("fast"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	// An idle keep-alive connection that has already been served
+	idle, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer idle.Close()
+	idle.Write([]byte("GET /fast HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+	if _, err := readFullHTTPResponse(idle, 5*time.Second); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	busy, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer busy.Close()
+	busy.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected a clean shutdown, got: %v", err)
+	}
+
+	response := readUntilClosed(t, busy)
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, "finished") {
+		t.Errorf("In-flight request should complete, got: %s", response)
+	}
+	if rest := readUntilClosed(t, idle); rest != "" {
+		t.Errorf("Idle connection should be closed without a response, got: %s", rest)
+	}
+}
+
+// waitForIdle waits until n of the server's connections are waiting for a
+// request, with none of it read
+func waitForIdle(t *testing.T, srv *Server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		srv.conns.mu.Lock()
+		idle := len(srv.conns.idle)
+		srv.conns.mu.Unlock()
+		if idle == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections idle, want %d", idle, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestShutdownPartialRequest tests that a request partly received when
+// Shutdown starts is read to the end and served, rather than dropped as idle
+func TestShutdownPartialRequest(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/fast", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("fast"))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /fast HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+	if _, err := readFullHTTPResponse(conn, 5*time.Second); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	waitForIdle(t, srv, 1)
+
+	// The next request's line is in, its headers are still coming
+	conn.Write([]byte("GET /fast HTTP/1.1\r\n"))
+	waitForIdle(t, srv, 0)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	// Let Shutdown deal with the idle connections before the request goes on
+	for {
+		srv.conns.mu.Lock()
+		closing := srv.conns.closing
+		srv.conns.mu.Unlock()
+		if closing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.Write([]byte("Host: localhost\r\nConnection: keep-alive\r\n\r\n"))
+	response := readUntilClosed(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, "fast") {
+		t.Errorf("The partly received request should be served, got: %q", response)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected a clean shutdown, got: %v", err)
+	}
+}
+
+// TestShutdownForced tests that Shutdown gives up on a handler ignoring its
+// context once the deadline passes, after cancelling that context
+func TestShutdownForced(t *testing.T) {
+	srv := Serve(0)
+	started := make(chan context.Context, 1)
+	release := make(chan struct{})
+	defer close(release)
+	srv.AddHandler("/stubborn", func(w *response.Writer, req *request.Request) {
+		started <- req.Context()
+		<-release
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /stubborn HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	reqCtx := <-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+	err = srv.Shutdown(ctx)
+	if !errors.Is(err, ErrForcedShutdown) {
+		t.Fatalf("Expected ErrForcedShutdown, got: %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the error to carry the deadline, got: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("Shutdown should return right after its deadline, took %v", elapsed)
+	}
+	if reqCtx.Err() == nil {
+		t.Error("The stubborn handler's context should be cancelled")
+	}
+	if rest := readUntilClosed(t, conn); rest != "" {
+		t.Errorf("Connection should be closed without a response, got: %s", rest)
+	}
+}
+
+// TestBadRequestTarget tests that targets which aren't valid URIs are
+// rejected before routing
+func TestBadRequestTarget(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/files/{name}", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("file "+req.Vars["name"]))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	response := sendRequest(t, port, "GET /files/report HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Errorf("Expected 200 for a valid target, got: %s", response)
+	}
+
+	response = sendRequest(t, port, "GET /files/re\x7fport HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 400") {
+		t.Errorf("Expected 400 for a target with a control character, got: %s", response)
+	}
+
+	// Path variables are percent-decoded, an encoded slash included
+	for target, want := range map[string]string{
+		"/files/hello%20world": "file hello world",
+		"/files/a%2Fb":         "file a/b",
+	} {
+		response = sendRequest(t, port, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, want) {
+			t.Errorf("%s: expected 200 with %q, got: %s", target, want, response)
+		}
+	}
+
+	response = sendRequest(t, port, "GET /files/%zz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 400") {
+		t.Errorf("Expected 400 for an invalid escape, got: %s", response)
+	}
+}
+
+// TestBodyPolicy tests the three ways a GET carrying a body can be handled
+func TestBodyPolicy(t *testing.T) {
+	newServer := func(policy BodyPolicy) string {
+		srv := Serve(0)
+		srv.BodyPolicy = policy
+		srv.AddHandler("/search", func(w *response.Writer, req *request.Request) {
+			w.Respond(200, []byte(fmt.Sprintf("body=%q", req.Body)))
+		}).GET()
+		return startTestServer(t, srv)
+	}
+	const get = "GET /search HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\nContent-Length: 5\r\n\r\nhello"
+
+	// Test: Drain, the default, hides the body and keeps the connection usable
+	port := newServer(BodyDrain)
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	for i, raw := range []string{get, "GET /search HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"} {
+		conn.Write([]byte(raw))
+		response, err := readFullHTTPResponse(conn, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Drain: failed to read response %d: %v", i+1, err)
+		}
+		if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, `body=""`) {
+			t.Errorf("Drain: response %d should have an empty body, got: %s", i+1, response)
+		}
+	}
+
+	// Test: Reject answers 400 and closes the connection
+	port = newServer(BodyReject)
+	conn, err = net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(get))
+	response := readUntilClosed(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 400") {
+		t.Errorf("Reject: expected 400, got: %s", response)
+	}
+	if strings.Contains(response, "body=") {
+		t.Errorf("Reject: handler should not run, got: %s", response)
+	}
+
+	// Test: Pass gives the handler the body
+	port = newServer(BodyPass)
+	response = sendRequest(t, port, get)
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, `body="hello"`) {
+		t.Errorf("Pass: handler should see the body, got: %s", response)
+	}
+
+	// Test: Bodiless GETs are untouched by Reject
+	port = newServer(BodyReject)
+	response = sendRequest(t, port, "GET /search HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Errorf("Reject: a GET without a body should be served, got: %s", response)
+	}
+}
+
+// TestRespondGzip tests that RespondGzip compresses for clients sending
+// Accept-Encoding: gzip and leaves the body alone for others
+func TestRespondGzip(t *testing.T) {
+	srv := Serve(0)
+	body := strings.Repeat("compress me ", 200)
+	srv.AddHandler("/text", func(w *response.Writer, req *request.Request) {
+		w.RespondGzip(200, []byte(body))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	response := sendRequest(t, port, "GET /text HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip, deflate\r\n\r\n")
+	_, compressed, _ := strings.Cut(response, "\r\n\r\n")
+	zr, err := gzip.NewReader(strings.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Expected a gzip body, got: %s", response)
+	}
+	decoded, _ := io.ReadAll(zr)
+	if string(decoded) != body {
+		t.Errorf("Decompressed body doesn't match, got %q", decoded)
+	}
+
+	response = sendRequest(t, port, "GET /text HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if strings.Contains(response, "Content-Encoding") || !strings.Contains(response, body) {
+		t.Errorf("Client without Accept-Encoding should get the plain body, got: %s", response)
+	}
+}
+
+// TestOnWriteError tests that a response failing to write because the client
+// hung up is returned to the handler and reported through OnWriteError
+func TestOnWriteError(t *testing.T) {
+	srv := Serve(0)
+
+	reported := make(chan error, 1)
+	srv.OnWriteError = func(req *request.Request, err error) {
+		if req.Path() != "/download" {
+			t.Errorf("OnWriteError got request for %s", req.Path())
+		}
+		reported <- err
+	}
+
+	handlerErr := make(chan error, 1)
+	srv.AddHandler("/download", func(w *response.Writer, req *request.Request) {
+		w.SetChunked(true)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders()
+		// Keep writing until the closed connection makes a write fail
+		chunk := bytes.Repeat([]byte("x"), 32<<10)
+		for range 1000 {
+			if _, err := w.WriteChunkedBody(chunk); err != nil {
+				handlerErr <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		handlerErr <- nil
+	}).GET()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if _, err := conn.Write([]byte("GET /download HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("Failed to read the start of the response: %v", err)
+	}
+	conn.Close()
+
+	var werr error
+	select {
+	case werr = <-handlerErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler never finished")
+	}
+	if werr == nil {
+		t.Fatal("Expected a write to fail after the client hung up")
+	}
+
+	select {
+	case err := <-reported:
+		if err != werr {
+			t.Errorf("OnWriteError got %v, want the error the handler saw, %v", err, werr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnWriteError was not called")
+	}
+}
+
+// TestRemoteAddr tests that handlers see the address the client connected
+// from, on every request of a keep-alive connection
+func TestRemoteAddr(t *testing.T) {
+	srv := Serve(0)
+	addrs := make(chan string, 2)
+	srv.AddHandler("/whoami", func(w *response.Writer, req *request.Request) {
+		addrs <- req.RemoteAddr
+		w.Respond(200, []byte(req.RemoteAddr))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /whoami HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n" +
+		"GET /whoami HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write requests: %v", err)
+	}
+	readUntilClosed(t, conn)
+
+	want := conn.LocalAddr().String()
+	for range 2 {
+		if got := <-addrs; got != want {
+			t.Errorf("RemoteAddr = %q, want the client's address %q", got, want)
+		}
+	}
+}
+
+// TestForwardedHeaders tests that forwarding headers are only honoured when
+// the peer is a trusted proxy
+func TestForwardedHeaders(t *testing.T) {
+	newServer := func(trusted ...string) string {
+		srv := Serve(0)
+		for _, cidr := range trusted {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatalf("Bad CIDR %s: %v", cidr, err)
+			}
+			srv.TrustedProxies = append(srv.TrustedProxies, *n)
+		}
+		srv.AddHandler("/whoami", func(w *response.Writer, req *request.Request) {
+			w.Respond(200, []byte(fmt.Sprintf("addr=%s url=%s", req.RemoteAddr, req.URL())))
+		}).GET()
+		return startTestServer(t, srv)
+	}
+
+	tests := []struct {
+		name    string
+		trusted []string
+		headers string
+		want    string
+	}{
+		{
+			name:    "trusted X-Forwarded-*",
+			trusted: []string{"127.0.0.0/8"},
+			headers: "X-Forwarded-For: 203.0.113.9\r\nX-Forwarded-Proto: https\r\nX-Forwarded-Host: example.com\r\n",
+			want:    "addr=203.0.113.9 url=https://example.com/whoami?x=1",
+		},
+		{
+			name:    "trusted Forwarded",
+			trusted: []string{"127.0.0.0/8"},
+			headers: "Forwarded: for=\"[2001:db8::7]:4711\";proto=https;host=api.example.com\r\n",
+			want:    "addr=[2001:db8::7]:4711 url=https://api.example.com/whoami?x=1",
+		},
+		{
+			name:    "client spoofing a hop in front of a trusted chain",
+			trusted: []string{"127.0.0.0/8", "10.0.0.0/8"},
+			headers: "X-Forwarded-For: 1.1.1.1, 203.0.113.9, 10.0.0.5\r\n",
+			want:    "addr=203.0.113.9 url=http://localhost/whoami?x=1",
+		},
+		{
+			name:    "untrusted peer",
+			trusted: []string{"10.0.0.0/8"},
+			headers: "X-Forwarded-For: 203.0.113.9\r\nX-Forwarded-Proto: https\r\nX-Forwarded-Host: example.com\r\nForwarded: for=203.0.113.9\r\n",
+			want:    "addr=127.0.0.1:",
+		},
+	}
+
+	for _, tt := range tests {
+		port := newServer(tt.trusted...)
+		response := sendRequest(t, port, "GET /whoami?x=1 HTTP/1.1\r\nHost: localhost\r\n"+tt.headers+"\r\n")
+		if !strings.Contains(response, tt.want) {
+			t.Errorf("%s: expected %q in response, got: %s", tt.name, tt.want, response)
+		}
+		if tt.name == "untrusted peer" && !strings.Contains(response, "url=http://localhost/whoami?x=1") {
+			t.Errorf("%s: forwarded scheme and host should be ignored, got: %s", tt.name, response)
+		}
+	}
+}
+
+// TestHeadRequests tests that an explicit HEAD handler runs instead of the
+// GET one, and that routes without one answer HEAD from GET minus the body
+func TestHeadRequests(t *testing.T) {
+	srv := Serve(0)
+	report := strings.Repeat("expensive report\n", 100)
+	getRuns := 0
+	srv.AddHandler("/report", func(w *response.Writer, req *request.Request) {
+		getRuns++
+		w.Respond(200, []byte(report))
+	}).GET()
+	srv.AddHandler("/report", func(w *response.Writer, req *request.Request) {
+		w.ReplaceHeader("content-length", strconv.Itoa(len(report)))
+		w.ReplaceHeader("x-head", "explicit")
+		w.Respond(200, nil)
+	}).HEAD()
+	srv.AddHandler("/plain", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("plain body"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("HEAD /report HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	response := readUntilClosed(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, "X-Head: explicit") {
+		t.Errorf("Expected the HEAD handler to answer, got: %s", response)
+	}
+	if getRuns != 0 {
+		t.Errorf("GET handler should not run for HEAD, ran %d times", getRuns)
+	}
+	if !strings.Contains(response, "Content-Length: "+strconv.Itoa(len(report))) {
+		t.Errorf("HEAD handler's Content-Length should be kept, got: %s", response)
+	}
+	if strings.Contains(response, "expensive report") {
+		t.Errorf("HEAD response should have no body, got: %s", response)
+	}
+
+	// Test: Falls back to GET with the body discarded
+	conn, err = net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("HEAD /plain HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	response = readUntilClosed(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, "Content-Length: 10") {
+		t.Errorf("Expected GET's headers, got: %s", response)
+	}
+	if !strings.HasSuffix(response, "\r\n\r\n") {
+		t.Errorf("HEAD response should end with the headers, got: %q", response)
+	}
+}
+
+// TestHeadMatchesGet tests that HEAD answered by a GET handler sends the same
+// headers GET does, Content-Length included, with no body
+func TestHeadMatchesGet(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/page", func(w *response.Writer, req *request.Request) {
+		w.ReplaceHeader("cache-control", "no-cache")
+		w.Respond(200, []byte("<p>the page</p>"))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	headerLines := func(method string) ([]string, string) {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(method + " /page HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		head, body, _ := strings.Cut(readUntilClosed(t, conn), "\r\n\r\n")
+		lines := strings.Split(head, "\r\n")
+		slices.Sort(lines)
+		return lines, body
+	}
+
+	getHeaders, getBody := headerLines("GET")
+	headHeaders, headBody := headerLines("HEAD")
+	if !slices.Equal(getHeaders, headHeaders) {
+		t.Errorf("HEAD headers differ from GET's:\nGET:  %q\nHEAD: %q", getHeaders, headHeaders)
+	}
+	if !slices.Contains(headHeaders, "Content-Length: 15") {
+		t.Errorf("HEAD should keep the GET body's Content-Length, got: %q", headHeaders)
+	}
+	if getBody != "<p>the page</p>" || headBody != "" {
+		t.Errorf("Expected a body for GET only, got %q and %q", getBody, headBody)
+	}
+}
+
+// TestOptionsWithCORS tests that CORS answers preflights while plain OPTIONS
+// requests to the same route get the automatic Allow response
+func TestOptionsWithCORS(t *testing.T) {
+	srv := Serve(0)
+	srv.Use(middleware.CORS(middleware.CORSOptions{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+	}))
+	handled := false
+	srv.AddHandler("/items", func(w *response.Writer, req *request.Request) {
+		handled = true
+		w.Respond(200, []byte("items"))
+	}).GET().POST()
+	port := startTestServer(t, srv)
+
+	// Test: A preflight gets CORS's answer
+	response := sendRequest(t, port, "OPTIONS /items HTTP/1.1\r\nHost: localhost\r\n"+
+		"Origin: https://app.example.com\r\nAccess-Control-Request-Method: POST\r\n\r\n")
+	head, _, _ := strings.Cut(response, "\r\n\r\n")
+	head += "\r\n"
+	if !strings.HasPrefix(head, "HTTP/1.1 204") || !strings.Contains(head, "Access-Control-Allow-Methods: GET, POST\r\n") {
+		t.Errorf("Expected the CORS preflight response, got: %s", response)
+	}
+	if strings.Contains(head, "\r\nAllow: ") {
+		t.Errorf("Preflight should not get the automatic Allow header, got: %s", response)
+	}
+
+	// Test: A plain OPTIONS gets the route's methods
+	response = sendRequest(t, port, "OPTIONS /items HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	head, _, _ = strings.Cut(response, "\r\n\r\n")
+	head += "\r\n"
+	if !strings.HasPrefix(head, "HTTP/1.1 204") || !strings.Contains(head, "\r\nAllow: GET, POST\r\n") {
+		t.Errorf("Expected the automatic OPTIONS response, got: %s", response)
+	}
+	if strings.Contains(head, "Access-Control-Allow") {
+		t.Errorf("Plain OPTIONS should not get CORS headers, got: %s", response)
+	}
+	if handled {
+		t.Error("Neither OPTIONS request should reach the GET/POST handler")
+	}
+}
+
+// TestMethodNotAllowed tests that a known path requested with a method it
+// doesn't take gets a 405 listing the ones it does, and an unknown path a 404
+func TestMethodNotAllowed(t *testing.T) {
+	srv := Serve(0)
+	handled := false
+	srv.AddHandler("/items", func(w *response.Writer, req *request.Request) {
+		handled = true
+		w.Respond(200, []byte("items"))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	response := sendRequest(t, port, "POST /items HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+	head, _, _ := strings.Cut(response, "\r\n\r\n")
+	if !strings.HasPrefix(head, "HTTP/1.1 405") || !strings.Contains(head+"\r\n", "\r\nAllow: GET, HEAD, OPTIONS\r\n") {
+		t.Errorf("Expected 405 with an Allow header, got: %s", response)
+	}
+	if handled {
+		t.Error("The GET handler should not run for POST")
+	}
+
+	response = sendRequest(t, port, "POST /nothing HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 404") || strings.Contains(response, "Allow: ") {
+		t.Errorf("Expected a plain 404 for an unknown path, got: %s", response)
+	}
+}
+
+// TestPutRoute tests a PUT route end to end, body and path variables included
+func TestPutRoute(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/docs/{id}", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("stored "+req.Vars["id"]+": "+string(req.Body)))
+	}).PUT()
+	port := startTestServer(t, srv)
+
+	response := sendRequest(t, port, "PUT /docs/42 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.HasSuffix(response, "stored 42: hello") {
+		t.Errorf("Expected the PUT handler to answer, got: %s", response)
+	}
+
+	response = sendRequest(t, port, "GET /docs/42 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 405") || !strings.Contains(response, "Allow: PUT, OPTIONS\r\n") {
+		t.Errorf("Expected 405 for GET on a PUT route, got: %s", response)
+	}
+}
+
+// TestHTTP10CloseDelimited tests that a body of unknown length is sent to an
+// HTTP/1.0 client without chunking, ended by closing the connection
+func TestHTTP10CloseDelimited(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/stream", func(w *response.Writer, req *request.Request) {
+		w.StartChunked(response.StatusOK)
+		w.WriteChunkedBody([]byte("first "))
+		w.WriteChunkedBody([]byte("second"))
+		w.FinishChunked(nil)
+	}).GET()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /stream HTTP/1.0\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+
+	response := readUntilClosed(t, conn)
+	head, body, _ := strings.Cut(response, "\r\n\r\n")
+	head += "\r\n"
+	if body != "first second" {
+		t.Errorf("Expected the raw body, got: %q", body)
+	}
+	if !strings.Contains(head, "Connection: close\r\n") {
+		t.Errorf("Expected Connection: close, got: %s", head)
+	}
+	if strings.Contains(head, "Transfer-Encoding") || strings.Contains(head, "Content-Length") {
+		t.Errorf("Expected no length framing, got: %s", head)
+	}
+
+	// Test: HTTP/1.1 clients still get chunks
+	conn, err = net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	response = readUntilClosed(t, conn)
+	if !strings.Contains(response, "Transfer-Encoding: chunked\r\n") || !strings.HasSuffix(response, "6\r\nsecond\r\n0\r\n\r\n") {
+		t.Errorf("Expected a chunked response, got: %q", response)
+	}
+}
+
+// TestRouteMiddleware tests that middleware added to a route runs once around
+// its handler, inside the global middleware, and not for other routes
+func TestRouteMiddleware(t *testing.T) {
+	srv := Serve(0)
+	var ran []string
+	trace := func(name string) middleware.MiddlewareHandler {
+		return func(next middleware.MiddlewareFunc) middleware.MiddlewareFunc {
+			return func(w *response.Writer, req *request.Request) {
+				ran = append(ran, name+" before")
+				next(w, req)
+				ran = append(ran, name+" after")
+			}
+		}
+	}
+	srv.Use(trace("global"))
+	srv.AddHandler("/query", func(w *response.Writer, req *request.Request) {
+		ran = append(ran, "handler")
+		w.Respond(200, []byte("query"))
+	}).Use(trace("first")).Use(trace("second")).GET()
+	srv.AddHandler("/other", func(w *response.Writer, req *request.Request) {
+		ran = append(ran, "other")
+		w.Respond(200, []byte("other"))
+	}).GET()
+	responses := notifyResponses(srv)
+	port := startTestServer(t, srv)
+
+	// The middleware finishes after the response is out, wait for that
+	sendRequest(t, port, "GET /query HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	waitForResponse(t, responses)
+	want := []string{"global before", "first before", "second before", "handler", "second after", "first after", "global after"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("Ran %v, want %v", ran, want)
+	}
+
+	ran = nil
+	sendRequest(t, port, "GET /other HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	waitForResponse(t, responses)
+	if want := []string{"global before", "other", "global after"}; !slices.Equal(ran, want) {
+		t.Errorf("Ran %v, want %v", ran, want)
+	}
+}
+
+// TestRedirectTrailingSlash tests redirecting to the registered form of a
+// path with or without its trailing slash, keeping the query
+func TestRedirectTrailingSlash(t *testing.T) {
+	newServer := func(redirect bool) string {
+		srv := Serve(0)
+		srv.RedirectTrailingSlash = redirect
+		srv.AddHandler("/wakanda", func(w *response.Writer, req *request.Request) {
+			w.Respond(200, []byte("wakanda"))
+		}).GET().POST()
+		srv.AddHandler("/docs/", func(w *response.Writer, req *request.Request) {
+			w.Respond(200, []byte("docs"))
+		}).GET()
+		return startTestServer(t, srv)
+	}
+	port := newServer(true)
+
+	cases := []struct{ request, status, location string }{
+		{"GET /wakanda/?page=2&q=a%20b HTTP/1.1", "HTTP/1.1 301", "/wakanda?page=2&q=a%20b"},
+		{"GET /docs HTTP/1.1", "HTTP/1.1 301", "/docs/"},
+		{"HEAD /docs?x=1 HTTP/1.1", "HTTP/1.1 301", "/docs/?x=1"},
+		{"POST /wakanda/ HTTP/1.1", "HTTP/1.1 308", "/wakanda"},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		conn.Write([]byte(c.request + "\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n"))
+		response := readUntilClosed(t, conn)
+		conn.Close()
+		if !strings.HasPrefix(response, c.status) || !strings.Contains(response, "Location: "+c.location+"\r\n") {
+			t.Errorf("%s: expected %s to %s, got: %s", c.request, c.status, c.location, response)
+		}
+	}
+
+	// Test: Paths with no route either way still 404
+	response := sendRequest(t, port, "GET /nowhere/ HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 404") {
+		t.Errorf("Expected 404, got: %s", response)
+	}
+
+	// Test: Off by default
+	port = newServer(false)
+	response = sendRequest(t, port, "GET /wakanda/ HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 404") {
+		t.Errorf("Expected 404 with the redirect off, got: %s", response)
+	}
+}
+
+// TestBareLF tests that bare LF line endings are refused unless allowed
+func TestBareLF(t *testing.T) {
+	newServer := func(allow bool) string {
+		srv := Serve(0)
+		srv.AllowBareLF = allow
+		srv.AddHandler("/test", func(w *response.Writer, req *request.Request) {
+			w.Respond(200, []byte("test"))
+		}).GET()
+		return startTestServer(t, srv)
+	}
+
+	port := newServer(false)
+	for _, raw := range []string{
+		"GET /test HTTP/1.1\nHost: localhost\r\n\r\n",
+		"GET /test HTTP/1.1\r\nHost: localhost\n\r\n",
+	} {
+		response := sendRequest(t, port, raw)
+		if !strings.HasPrefix(response, "HTTP/1.1 400") {
+			t.Errorf("Expected 400 for %q, got: %s", raw, response)
+		}
+	}
+
+	port = newServer(true)
+	response := sendRequest(t, port, "GET /test HTTP/1.1\nHost: localhost\n\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Errorf("Expected 200 with AllowBareLF, got: %s", response)
+	}
+}
+
+// TestHandlerChunkedTrailers tests a handler driving a chunked response with
+// trailers through the Writer alone
+func TestHandlerChunkedTrailers(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/report", func(w *response.Writer, req *request.Request) {
+		if err := w.StartChunked(200, "X-Row-Count"); err != nil {
+			t.Errorf("StartChunked: %v", err)
+			return
+		}
+		for _, row := range []string{"a,1\n", "b,2\n", "c,3\n"} {
+			if _, err := w.WriteChunkedBody([]byte(row)); err != nil {
+				t.Errorf("WriteChunkedBody: %v", err)
+				return
+			}
+		}
+		trailers := headers.NewHeaders()
+		if w.AcceptsTrailers() {
+			trailers.Set("X-Row-Count", "3")
+		}
+		if err := w.FinishChunked(trailers); err != nil {
+			t.Errorf("FinishChunked: %v", err)
+		}
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /report HTTP/1.1\r\nHost: localhost\r\nTE: trailers\r\n\r\n"))
+
+	response := readUntilClosed(t, conn)
+	if !strings.Contains(response, "Trailer: X-Row-Count\r\n") {
+		t.Errorf("Trailer should be announced, got: %q", response)
+	}
+	if !strings.HasSuffix(response, "\r\n\r\n4\r\na,1\n\r\n4\r\nb,2\n\r\n4\r\nc,3\n\r\n0\r\nX-Row-Count: 3\r\n\r\n") {
+		t.Errorf("Unexpected chunked body framing: %q", response)
+	}
+}
+
+// TestStreamDecompressionBomb tests that a streamed body decoded through a
+// size limit is cut off, and the client can tell, when it expands too far
+func TestStreamDecompressionBomb(t *testing.T) {
+	var bomb bytes.Buffer
+	gw, _ := gzip.NewWriterLevel(&bomb, gzip.BestCompression)
+	gw.Write(make([]byte, 50<<20))
+	gw.Close()
+
+	srv := Serve(0)
+	srv.AddHandler("/proxy", func(w *response.Writer, req *request.Request) {
+		decoded, err := decompress.NewReader(bytes.NewReader(bomb.Bytes()), "gzip", 64<<10)
+		if err != nil {
+			t.Errorf("NewReader: %v", err)
+			return
+		}
+		stream.Streamer(w, headers.NewHeaders(), decoded)
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /proxy HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+
+	response := readUntilClosed(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Fatalf("Expected the stream to start, got: %.200q", response)
+	}
+	if strings.HasSuffix(response, "0\r\n\r\n") {
+		t.Error("A cut off stream must not end with the last chunk marker")
+	}
+	if len(response) > 256<<10 {
+		t.Errorf("Expected the body to stop near the 64KiB limit, got %d bytes", len(response))
+	}
+}
+
+// TestRewriter tests rewriting a request before routing and short-circuiting
+// one with a redirect
+func TestRewriter(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/x", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("x page="+req.Params["page"]))
+	}).GET()
+	srv.UseRewriter(func(w *response.Writer, req *request.Request) bool {
+		if rest, ok := strings.CutPrefix(req.RequestLine.RequestTarget, "/v1"); ok {
+			req.SetTarget(rest)
+		}
+		return false
+	})
+	srv.UseRewriter(func(w *response.Writer, req *request.Request) bool {
+		if req.Path() != "/legacy" {
+			return false
+		}
+		w.ReplaceHeader("location", "/x")
+		w.Respond(response.StatusMovedPermanently, nil)
+		return true
+	})
+
+	port := startTestServer(t, srv)
+
+	response := sendRequest(t, port, "GET /v1/x?page=2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, "x page=2") {
+		t.Errorf("Expected /v1/x to be served by /x, got: %s", response)
+	}
+
+	response = sendRequest(t, port, "GET /legacy HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 301") || !strings.Contains(response, "Location: /x\r\n") {
+		t.Errorf("Expected a redirect to /x, got: %s", response)
+	}
+}
+
+// TestRequestFilter tests that a filter rejecting a request answers it with
+// its error before rewriters, middleware or the handler run
+func TestRequestFilter(t *testing.T) {
+	srv := Serve(0)
+	ran := []string{}
+	srv.UseRequestFilter(func(req *request.Request) *HandlerError {
+		if len(req.RequestLine.RequestTarget) > 64 {
+			return &HandlerError{StatusCode: 414, Message: "URI too long"}
+		}
+		return nil
+	})
+	srv.UseRequestFilter(func(req *request.Request) *HandlerError {
+		if req.Headers.Get("x-banned") != "" {
+			return &HandlerError{StatusCode: 403, Message: "banned header"}
+		}
+		return nil
+	})
+	srv.UseRewriter(func(w *response.Writer, req *request.Request) bool {
+		ran = append(ran, "rewriter")
+		return false
+	})
+	srv.Use(func(next middleware.MiddlewareFunc) middleware.MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			ran = append(ran, "middleware")
+			next(w, req)
+		}
+	})
+	srv.AddHandler("/x", func(w *response.Writer, req *request.Request) {
+		ran = append(ran, "handler")
+		w.Respond(200, []byte("x"))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	response := sendRequest(t, port, "GET /x HTTP/1.1\r\nHost: localhost\r\nX-Banned: 1\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 403") || !strings.HasSuffix(response, "\r\n\r\nbanned header") {
+		t.Errorf("Expected the filter's 403, got: %s", response)
+	}
+	response = sendRequest(t, port, "GET /x?"+strings.Repeat("a", 64)+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 414") {
+		t.Errorf("Expected the filter's 414, got: %s", response)
+	}
+	if len(ran) != 0 {
+		t.Errorf("Nothing should run for filtered requests, ran %v", ran)
+	}
+
+	response = sendRequest(t, port, "GET /x HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Errorf("Expected an unfiltered request through, got: %s", response)
+	}
+	if !slices.Equal(ran, []string{"rewriter", "middleware", "handler"}) {
+		t.Errorf("Unexpected run order %v", ran)
+	}
+}
+
+// TestPanicRecovery tests that a panic anywhere in the middleware chain is
+// answered with a 500 and the server keeps serving
+func TestPanicRecovery(t *testing.T) {
+	srv := Serve(0)
+	srv.Use(func(next middleware.MiddlewareFunc) middleware.MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			if req.Path() == "/boom" {
+				w.ReplaceHeader("x-before", "panic")
+				panic("middleware failed")
+			}
+			next(w, req)
+		}
+	})
+	srv.AddHandler("/boom", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("unreachable"))
+	}).GET()
+	srv.AddHandler("/ok", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("still here"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	response := sendRequest(t, port, "GET /boom HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 500") {
+		t.Errorf("Expected 500 after a middleware panic, got: %s", response)
+	}
+	if !strings.Contains(response, "Connection: close\r\n") {
+		t.Errorf("Expected the connection to be closed after a panic, got: %s", response)
+	}
+
+	response = sendRequest(t, port, "GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, "still here") {
+		t.Errorf("Expected the server to survive the panic, got: %s", response)
+	}
+}
+
+// waitForGoroutines waits for the goroutine count to drop back to want,
+// failing with a dump of what is still running if it doesn't
+func waitForGoroutines(t *testing.T, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines still running, want %d:\n%s", runtime.NumGoroutine(), want, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestNoGoroutineLeaks tests that stopping the server ends its accept loop
+// and every connection handler, whether connections are busy, idle between
+// keep-alive requests or never sent anything
+func TestNoGoroutineLeaks(t *testing.T) {
+	for _, stop := range []string{"Close", "Shutdown"} {
+		t.Run(stop, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			srv := Serve(0)
+			srv.AddHandler("/", func(w *response.Writer, req *request.Request) {
+				w.Respond(200, []byte("ok"))
+			}).GET()
+			accepted := make(chan ConnInfo, 3)
+			srv.OnConnection = func(info ConnInfo) { accepted <- info }
+			if err := srv.Listen(); err != nil {
+				t.Fatalf("Failed to start server: %v", err)
+			}
+			addr := srv.Listener.Addr().String()
+			_, port, _ := net.SplitHostPort(addr)
+
+			// A finished request, an idle keep-alive connection and a
+			// connection that never sends a byte
+			sendRequest(t, port, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			idle, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer idle.Close()
+			idle.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+			if _, err := readFullHTTPResponse(idle, 5*time.Second); err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			silent, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer silent.Close()
+
+			// Wait for the server to pick up all three connections
+			for range 3 {
+				<-accepted
+			}
+
+			if stop == "Close" {
+				srv.Close()
+			} else {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := srv.Shutdown(ctx); err != nil {
+					t.Fatalf("Shutdown failed: %v", err)
+				}
+			}
+
+			waitForGoroutines(t, before)
+		})
+	}
+}
+
+// TestUnsupportedVersion tests that request lines for HTTP versions other
+// than 1.0 and 1.1 are answered with a 505
+func TestUnsupportedVersion(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("HTTP/"+req.RequestLine.HttpVersion))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	for _, version := range []string{"HTTP/0.9", "HTTP/3.0", "HTTP/2"} {
+		response := sendRequest(t, port, "GET / "+version+"\r\nHost: localhost\r\n\r\n")
+		if !strings.HasPrefix(response, "HTTP/1.1 505") {
+			t.Errorf("Expected 505 for %s, got: %s", version, response)
+		}
+		if !strings.Contains(response, "HTTP/1.0 and HTTP/1.1") {
+			t.Errorf("Expected the body to name the supported versions, got: %s", response)
+		}
+	}
+
+	response := sendRequest(t, port, "GET / HTTP/1.0\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.Contains(response, "HTTP/1.0") {
+		t.Errorf("Expected HTTP/1.0 to be served, got: %s", response)
+	}
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTPS/1.1\r\nHost: localhost\r\n\r\n"))
+	response = readUntilClosed(t, conn)
+	if strings.HasPrefix(response, "HTTP/1.1 505") || strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Errorf("Expected a malformed version not to be served, got: %s", response)
+	}
+}
+
+// TestURITooLong tests that a request line longer than a header line may be
+// is answered with a 414 instead of being buffered
+func TestURITooLong(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("OK"))
+	}).GET()
+
+	port := startTestServer(t, srv)
+
+	target := "/" + strings.Repeat("a", headers.MaxLineLength)
+	response := sendRequest(t, port, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 414") {
+		t.Errorf("Expected 414 for a %d byte target, got: %.100s", len(target), response)
+	}
+}
+
+// TestPipelining tests that requests sent back to back without waiting for
+// responses are all answered, in order
+func TestPipelining(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/{name}", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("hello "+req.Vars["name"]+" "+string(req.Body)))
+	}).GET().POST()
+
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /one HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n" +
+		"POST /two HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /three HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	response := readUntilClosed(t, conn)
+
+	if n := strings.Count(response, "HTTP/1.1 200"); n != 3 {
+		t.Fatalf("Expected 3 responses, got %d: %s", n, response)
+	}
+	one := strings.Index(response, "hello one")
+	two := strings.Index(response, "hello two body")
+	three := strings.Index(response, "hello three")
+	if one < 0 || two < one || three < two {
+		t.Errorf("Expected responses for one, two and three in order, got: %s", response)
+	}
+}
+
+// TestRouteAccept tests that a route limited to JSON bodies turns others away
+// with a 415 before its handler runs
+func TestRouteAccept(t *testing.T) {
+	srv := Serve(0)
+	ran := 0
+	srv.AddHandler("/webhook", func(w *response.Writer, req *request.Request) {
+		ran++
+		w.Respond(200, []byte("received"))
+	}).Accept("application/json").POST()
+	port := startTestServer(t, srv)
+
+	post := func(contentType, body string) string {
+		raw := "POST /webhook HTTP/1.1\r\nHost: localhost\r\n"
+		if contentType != "" {
+			raw += "Content-Type: " + contentType + "\r\n"
+		}
+		return sendRequest(t, port, raw+"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	}
+
+	for _, contentType := range []string{"application/json", "Application/JSON; charset=utf-8"} {
+		if response := post(contentType, `{"event": "push"}`); !strings.HasPrefix(response, "HTTP/1.1 200") {
+			t.Errorf("%s: expected 200, got: %s", contentType, response)
+		}
+	}
+	for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		if response := post(contentType, "event=push"); !strings.HasPrefix(response, "HTTP/1.1 415") {
+			t.Errorf("%q: expected 415, got: %s", contentType, response)
+		}
+	}
+	if ran != 2 {
+		t.Errorf("Handler ran %d times, want only for the 2 JSON bodies", ran)
+	}
+
+	// Requests without a body aren't checked
+	if response := post("", ""); !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Errorf("Expected 200 for a request without a body, got: %s", response)
+	}
+}
+
+// TestDeferBodies tests that with DeferBodies handlers get the request before
+// its body, and that bodies they leave unread don't get in the way of the
+// next request
+func TestDeferBodies(t *testing.T) {
+	srv := Serve(0)
+	srv.DeferBodies = true
+	var pending []bool
+	srv.AddHandler("/ignore", func(w *response.Writer, req *request.Request) {
+		pending = append(pending, req.BodyPending() && len(req.Body) == 0)
+		w.Respond(200, []byte("ignored"))
+	}).POST()
+	srv.AddHandler("/echo", func(w *response.Writer, req *request.Request) {
+		body, err := req.ReadBody()
+		if err != nil {
+			w.Respond(500, []byte(err.Error()))
+			return
+		}
+		w.Respond(200, []byte("echo "+string(body)))
+	}).POST()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	unread := strings.Repeat("x", 4096)
+	conn.Write([]byte("POST /ignore HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n" +
+		"Content-Length: " + strconv.Itoa(len(unread)) + "\r\n\r\n" + unread +
+		"POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 4\r\n\r\nbody"))
+	response := readUntilClosed(t, conn)
+
+	if n := strings.Count(response, "HTTP/1.1 200"); n != 2 {
+		t.Fatalf("Expected 2 responses, got %d: %s", n, response)
+	}
+	if !strings.Contains(response, "echo body") {
+		t.Errorf("Expected the second body echoed, got: %s", response)
+	}
+	if len(pending) != 1 || !pending[0] {
+		t.Errorf("Expected the handler to see an unread body, got %v", pending)
+	}
+
+	// A body too big to drain closes the connection instead, without the
+	// server ever holding it
+	conn, err = net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		conn.Write([]byte("POST /ignore HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n" +
+			"Content-Length: " + strconv.Itoa(64<<20) + "\r\n\r\n"))
+		chunk := make([]byte, 64<<10)
+		for range 2 * MaxBodyDrain / len(chunk) {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	response = readUntilClosed(t, conn)
+	if n := strings.Count(response, "HTTP/1.1 200"); n != 1 || !strings.Contains(response, "ignored") {
+		t.Errorf("Expected one response before the connection closed, got: %s", response)
+	}
+}
+
+// TestBinaryBodyEcho tests that a body goes out byte for byte, with nothing
+// after it that Content-Length doesn't count
+func TestBinaryBodyEcho(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/echo", func(w *response.Writer, req *request.Request) {
+		w.ReplaceHeader("content-type", "application/octet-stream")
+		w.Respond(200, req.Body)
+	}).POST()
+	port := startTestServer(t, srv)
+
+	body := make([]byte, 256)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Read to the close rather than by Content-Length, so stray bytes after
+	// the body show up
+	conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)))
+	response := readUntilClosed(t, conn)
+
+	head, got, ok := strings.Cut(response, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("No end of headers in %q", response)
+	}
+	if !strings.Contains(head+"\r\n", "Content-Length: "+strconv.Itoa(len(body))+"\r\n") {
+		t.Errorf("Expected Content-Length %d, got: %s", len(body), head)
+	}
+	if !bytes.Equal([]byte(got), body) {
+		t.Errorf("Body changed on the way: sent %d bytes, got %d: %q", len(body), len(got), got)
+	}
+}
+
+// TestSuggestRoutes tests that a mistyped path gets the closest route
+// suggested, only when SuggestRoutes is on
+func TestSuggestRoutes(t *testing.T) {
+	get := func(suggest bool, path, accept string) string {
+		srv := Serve(0)
+		srv.SuggestRoutes = suggest
+		srv.AddHandler("/wakanda", func(w *response.Writer, req *request.Request) {
+			w.Respond(200, []byte("forever"))
+		}).GET()
+		port := startTestServer(t, srv)
+
+		raw := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n"
+		if accept != "" {
+			raw += "Accept: " + accept + "\r\n"
+		}
+		return sendRequest(t, port, raw+"\r\n")
+	}
+
+	// Off by default, the route table stays private
+	if response := get(false, "/wakanada", ""); !strings.HasPrefix(response, "HTTP/1.1 404") || strings.Contains(response, "/wakanda") {
+		t.Errorf("Expected a plain 404, got: %s", response)
+	}
+
+	if response := get(true, "/wakanada", ""); !strings.HasPrefix(response, "HTTP/1.1 404") || !strings.Contains(response, "did you mean <a href=\"/wakanda\">/wakanda</a>?") {
+		t.Errorf("Expected /wakanda suggested, got: %s", response)
+	}
+	if response := get(true, "/wakanada", "application/json"); !strings.Contains(response, `{"error":"not found","suggestion":"/wakanda"}`) {
+		t.Errorf("Expected a JSON suggestion, got: %s", response)
+	}
+	if response := get(true, "/nowhere/near/it", ""); !strings.HasPrefix(response, "HTTP/1.1 404") || strings.Contains(response, "did you mean") {
+		t.Errorf("Expected no suggestion for a distant path, got: %s", response)
+	}
+}
+
+// TestRoutePattern tests that middleware and handlers can see the pattern
+// of the route a request matched, not just its path
+func TestRoutePattern(t *testing.T) {
+	srv := Serve(0)
+	var logged []string
+	srv.Use(func(next middleware.MiddlewareFunc) middleware.MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			logged = append(logged, req.RoutePattern())
+			next(w, req)
+		}
+	})
+	srv.AddHandler("/users/{id}", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte(req.RoutePattern()+" id="+req.Vars["id"]))
+	}).GET()
+	srv.AddHandler("/health", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte(req.RoutePattern()))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	if response := sendRequest(t, port, "GET /users/123 HTTP/1.1\r\nHost: localhost\r\n\r\n"); !strings.HasSuffix(response, "/users/{id} id=123") {
+		t.Errorf("Expected the dynamic route's pattern, got: %s", response)
+	}
+	if response := sendRequest(t, port, "GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n"); !strings.HasSuffix(response, "\r\n\r\n/health") {
+		t.Errorf("Expected the static route's pattern, got: %s", response)
+	}
+	if len(logged) != 2 || logged[0] != "/users/{id}" || logged[1] != "/health" {
+		t.Errorf("Middleware saw patterns %q", logged)
+	}
+}
+
+// TestReady tests that Ready is closed once the listener is up, so a server
+// started in another goroutine can be waited on without sleeping
+func TestReady(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("ok"))
+	}).GET()
+
+	select {
+	case <-srv.Ready():
+		t.Fatal("Ready should not be closed before Listen")
+	default:
+	}
+
+	listenErr := make(chan error, 1)
+	go func() { listenErr <- srv.Listen() }()
+	t.Cleanup(func() { srv.Close() })
+
+	select {
+	case <-srv.Ready():
+	case err := <-listenErr:
+		t.Fatalf("Listen failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the server to be ready")
+	}
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse address: %v", err)
+	}
+	response := sendRequest(t, port, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.Contains(response, "HTTP/1.1 200") {
+		t.Errorf("Expected 200 once ready, got: %s", response)
+	}
+}
+
+// TestOnResponse tests that OnResponse is called for every request once its
+// response has been written, in order on a keep-alive connection
+func TestOnResponse(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/a", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("a"))
+	}).GET()
+	srv.AddHandler("/b", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("b"))
+	}).GET()
+	responses := notifyResponses(srv)
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	for _, path := range []string{"/a", "/b"} {
+		_, err := conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+		if _, err := readFullHTTPResponse(conn, 5*time.Second); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if req := waitForResponse(t, responses); req.Path() != path {
+			t.Errorf("Expected OnResponse for %s, got %s", path, req.Path())
+		}
+	}
+
+	select {
+	case req := <-responses:
+		t.Errorf("Unexpected OnResponse for %s", req.Path())
+	default:
+	}
+}
+
+// TestOnConnection tests that OnConnection hears of a connection once it is
+// listed by Connections, before anything is sent on it
+func TestOnConnection(t *testing.T) {
+	srv := Serve(0)
+	accepted := make(chan ConnInfo, 1)
+	srv.OnConnection = func(info ConnInfo) { accepted <- info }
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	info := <-accepted
+	if info.RemoteAddr != conn.LocalAddr().String() {
+		t.Errorf("Expected OnConnection for %s, got %s", conn.LocalAddr(), info.RemoteAddr)
+	}
+	if conns := srv.Connections(); len(conns) != 1 || conns[0].RemoteAddr != info.RemoteAddr {
+		t.Errorf("Expected the connection listed, got %+v", conns)
+	}
+}
+
+// TestIdleTimeout tests that a keep-alive connection is closed once it has
+// waited IdleTimeout for its next request
+func TestIdleTimeout(t *testing.T) {
+	srv := Serve(0)
+	srv.IdleTimeout = 50 * time.Millisecond
+	srv.AddHandler("/", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("ok"))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+	response := readUntilClosed(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Errorf("Expected the request answered before the close, got: %s", response)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the idle connection closed after about 50ms, took %v", elapsed)
+	}
+}
+
+// TestIncompleteResponseClosesConnection tests that a handler writing less
+// body than its Content-Length gets the connection closed, rather than the
+// rest of the body being taken from the next response
+func TestIncompleteResponseClosesConnection(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/short", func(w *response.Writer, req *request.Request) {
+		w.ReplaceHeader("Content-Length", "10")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders()
+		w.WriteBody([]byte("short"))
+	}).GET()
+	srv.AddHandler("/next", func(w *response.Writer, req *request.Request) {
+		w.Respond(200, []byte("next"))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /short HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n" +
+		"GET /next HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write requests: %v", err)
+	}
+
+	response := readUntilClosed(t, conn)
+	if !strings.HasSuffix(response, "\r\n\r\nshort") {
+		t.Errorf("Expected the short body and then the connection closed, got: %q", response)
+	}
+	if strings.Contains(response, "next") {
+		t.Errorf("The connection should not be reused after an incomplete response, got: %q", response)
+	}
+}
+
+// TestAddHandlerWhileServing tests that routes can be added while requests
+// are being matched, run it with -race to see the route table stays
+// consistent. Routes added with AddHandlerWith are never seen half set up:
+// before they have their method and middleware they don't exist at all.
+func TestAddHandlerWhileServing(t *testing.T) {
+	srv := Serve(0)
+	srv.AddHandler("/ping", func(w *response.Writer, req *request.Request) {
+		w.Respond(response.StatusOK, []byte("pong"))
+	}).GET()
+	port := startTestServer(t, srv)
+
+	guard := func(next middleware.MiddlewareFunc) middleware.MiddlewareFunc {
+		return func(w *response.Writer, req *request.Request) {
+			w.ReplaceHeader("x-guard", "on")
+			next(w, req)
+		}
+	}
+
+	const routes = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range routes {
+			body := []byte(fmt.Sprintf("route %d", i))
+			srv.AddHandlerWith(fmt.Sprintf("/r/%d/{id}", i), func(w *response.Writer, req *request.Request) {
+				w.Respond(response.StatusOK, body)
+			}, func(h *handler.Handler) {
+				h.Use(guard).GET()
+			})
+		}
+	}()
+
+	for i := 0; i < routes; i++ {
+		resp := sendRequest(t, port, "GET /ping HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		if !strings.Contains(resp, "200 OK") || !strings.HasSuffix(resp, "pong") {
+			t.Fatalf("Expected pong while routes were added, got %q", resp)
+		}
+		// A route that is there answers GET through its middleware and
+		// nothing else, one that isn't yet is a 404
+		resp = sendRequest(t, port, fmt.Sprintf("GET /r/%d/7 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", i))
+		if !strings.Contains(resp, "404") && !(strings.Contains(resp, "200 OK") && strings.Contains(resp, "X-Guard: on")) {
+			t.Fatalf("Expected a guarded 200 or a 404 for GET /r/%d/7, got %q", i, resp)
+		}
+		resp = sendRequest(t, port, fmt.Sprintf("POST /r/%d/7 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", i))
+		if !strings.Contains(resp, "404") && !strings.Contains(resp, "405") {
+			t.Fatalf("Expected a 404 or 405 for POST /r/%d/7, got %q", i, resp)
+		}
+	}
+	<-done
+
+	resp := sendRequest(t, port, "GET /r/49/7 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if !strings.HasSuffix(resp, "route 49") || !strings.Contains(resp, "X-Guard: on") {
+		t.Errorf("Expected the last route added to answer through its middleware, got %q", resp)
+	}
+}
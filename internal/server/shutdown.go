@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrForcedShutdown is returned by Shutdown when requests were still running at
+// the deadline and had to be cut off.
+var ErrForcedShutdown = fmt.Errorf("server shutdown forced before requests finished")
+
+// Shutdown stops the server gracefully. It stops accepting connections, closes
+// idle keep-alive connections and waits for in-flight requests to finish.
+//
+// If ctx ends first, the context every request runs under is cancelled so
+// handlers watching req.Context() can stop, the remaining connections are
+// closed and Shutdown returns an error wrapping ErrForcedShutdown without
+// waiting for handlers that ignore their context.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	err := s.closeListener()
+
+	cancel := func() {
+		if s.cancelBase != nil {
+			s.cancelBase()
+		}
+	}
+
+	// Connections between requests are woken so they notice the shutdown,
+	// the busy ones as soon as they finish what they are reading or serving
+	s.conns.closeIdle()
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		cancel()
+		return err
+	case <-ctx.Done():
+		cancel()
+		s.conns.closeAll()
+		return fmt.Errorf("%w: %w", ErrForcedShutdown, ctx.Err())
+	}
+}
@@ -0,0 +1,64 @@
+package static
+
+import (
+	"path"
+	"strings"
+)
+
+// Common Cache-Control values
+const (
+	// CacheImmutable suits fingerprinted assets whose name changes with their
+	// content, e.g. app.3f9a1c.js
+	CacheImmutable = "public, max-age=31536000, immutable"
+	// CacheNoCache makes clients revalidate before every use, the right
+	// choice for HTML pages that point at fingerprinted assets
+	CacheNoCache = "no-cache"
+)
+
+// CacheRule sets the Cache-Control value for files matching Pattern.
+//
+// Pattern is a path.Match glob. Patterns without a "/" are matched against
+// the file's base name ("*.js", "*.min.css"), others against its whole path
+// relative to the server root ("/fonts/*").
+type CacheRule struct {
+	Pattern      string
+	CacheControl string
+}
+
+// CachePolicy decides the Cache-Control header of each file served. Rules are
+// tried in order and the first match wins; files matching none get Default,
+// and no header at all when Default is empty.
+type CachePolicy struct {
+	Default string
+	Rules   []CacheRule
+}
+
+// Add appends a rule to the policy and returns it, so rules can be chained:
+//
+//	policy := (&static.CachePolicy{Default: static.CacheNoCache}).
+//		Add("*.js", static.CacheImmutable).
+//		Add("*.css", static.CacheImmutable)
+func (p *CachePolicy) Add(pattern, cacheControl string) *CachePolicy {
+	p.Rules = append(p.Rules, CacheRule{Pattern: pattern, CacheControl: cacheControl})
+	return p
+}
+
+// For returns the Cache-Control value for the file at name, a slash separated
+// path relative to the server root.
+func (p *CachePolicy) For(name string) string {
+	if p == nil {
+		return ""
+	}
+
+	name = "/" + strings.TrimPrefix(name, "/")
+	for _, rule := range p.Rules {
+		subject := name
+		if !strings.Contains(rule.Pattern, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(rule.Pattern, subject); ok {
+			return rule.CacheControl
+		}
+	}
+	return p.Default
+}
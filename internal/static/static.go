@@ -0,0 +1,67 @@
+package static
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// FileServer serves files from a directory on disk.
+//
+//	assets := &static.FileServer{
+//		Root:   "./public",
+//		Prefix: "/assets",
+//		Cache:  (&static.CachePolicy{Default: static.CacheNoCache}).Add("*.js", static.CacheImmutable),
+//	}
+//	srv.AddHandler("/assets/{file}", assets.Serve).GET()
+type FileServer struct {
+	// Root is the directory files are served from
+	Root string
+	// Prefix is stripped from the request path before looking the file up,
+	// usually the static part of the route the server is mounted on
+	Prefix string
+	// Cache sets the Cache-Control header per file, nil sends none
+	Cache *CachePolicy
+}
+
+// Serve is a handler.HandlerFunc answering with the file the request path
+// points at, or 404 when there isn't one. Paths can't escape Root and
+// directories aren't listed.
+func (s *FileServer) Serve(w *response.Writer, req *request.Request) {
+	name := path.Clean("/" + strings.TrimPrefix(req.Path(), s.Prefix))
+	file := filepath.Join(s.Root, filepath.FromSlash(name))
+
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		err = fs.ErrNotExist
+	}
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		status := response.StatusInternalServerError
+		if errors.Is(err, fs.ErrNotExist) {
+			status = response.StatusNotFound
+		}
+		w.Respond(status, []byte(response.GetStatusReason(status)))
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.ReplaceHeader("content-type", contentType)
+	if cacheControl := s.Cache.For(name); cacheControl != "" {
+		w.ReplaceHeader("cache-control", cacheControl)
+	}
+	w.Respond(response.StatusOK, data)
+}
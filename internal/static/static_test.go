@@ -0,0 +1,81 @@
+package static
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, s *FileServer, target string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	s.Serve(w, req)
+	return buf.String()
+}
+
+func TestCachePolicy(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "app.3f9a1c.js"), []byte("console.log(1)"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "index.html"), []byte("<p>hi</p>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "robots.txt"), []byte("User-agent: *"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "fonts"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "fonts", "inter.woff2"), []byte("font"), 0o644))
+
+	s := &FileServer{
+		Root:   root,
+		Prefix: "/assets",
+		Cache: (&CachePolicy{Default: "public, max-age=3600"}).
+			Add("*.js", CacheImmutable).
+			Add("*.html", CacheNoCache).
+			Add("/fonts/*", "public, max-age=604800"),
+	}
+
+	out := serve(t, s, "/assets/app.3f9a1c.js")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Cache-Control: public, max-age=31536000, immutable\r\n")
+	assert.Contains(t, out, "Content-Type: text/javascript")
+	assert.Contains(t, out, "console.log(1)")
+
+	out = serve(t, s, "/assets/index.html")
+	assert.Contains(t, out, "Cache-Control: no-cache\r\n")
+	assert.Contains(t, out, "Content-Type: text/html")
+
+	out = serve(t, s, "/assets/fonts/inter.woff2")
+	assert.Contains(t, out, "Cache-Control: public, max-age=604800\r\n")
+
+	// Test: Files no rule matches get the default
+	out = serve(t, s, "/assets/robots.txt")
+	assert.Contains(t, out, "Cache-Control: public, max-age=3600\r\n")
+
+	// Test: No policy, no header
+	s.Cache = nil
+	out = serve(t, s, "/assets/app.3f9a1c.js")
+	assert.NotContains(t, out, "Cache-Control")
+}
+
+func TestFileServerNotFound(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "public"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644))
+	s := &FileServer{Root: filepath.Join(root, "public")}
+
+	assert.True(t, strings.HasPrefix(serve(t, s, "/missing.css"), "HTTP/1.1 404"))
+	// Test: Directories aren't listed
+	assert.True(t, strings.HasPrefix(serve(t, s, "/"), "HTTP/1.1 404"))
+	// Test: Paths can't climb out of the root
+	out := serve(t, s, "/../secret.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404"))
+	assert.NotContains(t, out, "secret")
+}
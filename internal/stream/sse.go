@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// ErrBadEventName is returned by Send for an event name spanning lines,
+// which would break up the event.
+var ErrBadEventName = fmt.Errorf("event name contains a line break")
+
+// SSEWriter sends Server-Sent Events, a text/event-stream response browsers
+// read with EventSource. Each event goes out as a chunk of its own as soon as
+// it is sent, so clients see it straight away.
+type SSEWriter struct {
+	w   *response.Writer
+	err error // The first write that failed, every Send after it fails too
+}
+
+// flusher is implemented by buffered writers the response may be going to
+type flusher interface {
+	Flush() error
+}
+
+// NewSSEWriter starts an event stream on w: a 200 with Content-Type
+// text/event-stream, Cache-Control no-cache and a chunked body. Headers to go
+// out with it have to be set on w first. Send the events and Close the
+// stream when done.
+//
+//	events := stream.NewSSEWriter(w)
+//	defer events.Close()
+//	for update := range updates {
+//		if err := events.Send("update", update); err != nil {
+//			return // The client went away
+//		}
+//	}
+func NewSSEWriter(w *response.Writer) *SSEWriter {
+	w.ReplaceHeader("content-type", "text/event-stream")
+	w.ReplaceHeader("cache-control", "no-cache")
+	w.DeleteHeader("content-length")
+	return &SSEWriter{w: w, err: w.StartChunked(response.StatusOK)}
+}
+
+// Send writes one event. event is its name, "" for the unnamed events that
+// reach EventSource's onmessage. data may span lines, each goes out in a
+// data field of its own and the client joins them back up with "\n". Once a
+// write fails, because the client went away, Send keeps returning that error.
+func (s *SSEWriter) Send(event, data string) error {
+	if s.err != nil {
+		return s.err
+	}
+	if strings.ContainsAny(event, "\r\n") {
+		return ErrBadEventName
+	}
+
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	// Clients take "\r\n", "\r" and "\n" all as line ends
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+
+	if _, err := s.w.WriteChunkedBody([]byte(b.String())); err != nil {
+		s.err = err
+		return err
+	}
+	if f, ok := s.w.Writer.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			s.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ends the stream with the last chunk. Clients' EventSource reconnects
+// after a while when a stream ends, answering that with a 204 stops it for
+// good.
+func (s *SSEWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	_, err := s.w.WriteChunkedBodyDone(nil)
+	if err == nil {
+		if f, ok := s.w.Writer.(flusher); ok {
+			err = f.Flush()
+		}
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/noelw19/tcptohttp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads the next event off an event stream, joining its data lines
+func readEvent(t *testing.T, r *bufio.Reader) (event, data string) {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event, strings.Join(lines, "\n")
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			lines = append(lines, value)
+		}
+	}
+}
+
+func TestSSEWriter(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	events := []struct{ event, data string }{
+		{"", "hello"},
+		{"update", "line one\nline two"},
+		{"done", "bye"},
+	}
+	// Each event is only sent once the client has read the one before, so
+	// the test hangs if one is held back instead of flushed
+	received := make(chan struct{})
+	go func() {
+		defer server.Close()
+		w := response.NewResponseWriter(server)
+		sse := NewSSEWriter(w)
+		for _, e := range events {
+			if sse.Send(e.event, e.data) != nil {
+				return
+			}
+			<-received
+		}
+		sse.Close()
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	body := bufio.NewReader(resp.Body)
+	for _, want := range events {
+		event, data := readEvent(t, body)
+		assert.Equal(t, want.event, event)
+		assert.Equal(t, want.data, data)
+		received <- struct{}{}
+	}
+	_, err = body.ReadByte()
+	assert.Error(t, err, "expected the stream to end after the last event")
+}
+
+func TestSSEWriterFraming(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sse := NewSSEWriter(response.NewResponseWriter(buf))
+	require.NoError(t, sse.Send("tick", "a\r\nb\rc"))
+	require.NoError(t, sse.Close())
+
+	body, _ := readChunked(t, buf.String())
+	assert.Equal(t, "event: tick\ndata: a\ndata: b\ndata: c\n\n", body)
+
+	// Test: Names spanning lines are refused rather than breaking the event
+	sse = NewSSEWriter(response.NewResponseWriter(&bytes.Buffer{}))
+	assert.ErrorIs(t, sse.Send("tick\ndata: forged", "x"), ErrBadEventName)
+}
@@ -18,34 +18,72 @@ func bytesToStr(bs []byte) string {
 	return out
 }
 
-func Streamer(w *response.Writer, h headers.Headers, reader io.ReadCloser) {
+// DefaultBufferSize is how much Streamer reads at a time, and so the most a
+// chunk it sends holds, unless StreamerOptions say otherwise.
+const DefaultBufferSize = 32 << 10
+
+// StreamerOptions configures Streamer. Empty fields take the defaults shown.
+type StreamerOptions struct {
+	BufferSize int // DefaultBufferSize
+}
+
+// Streamer sends everything read from reader as a chunked 200 response,
+// closing reader when done. Clients accepting trailers get the body's
+// SHA-256 and length after it. Only the first of opts is used.
+func Streamer(w *response.Writer, h headers.Headers, reader io.ReadCloser, opts ...StreamerOptions) {
+	bufferSize := DefaultBufferSize
+	if len(opts) > 0 && opts[0].BufferSize > 0 {
+		bufferSize = opts[0].BufferSize
+	}
+
 	w.WriteStatusLine(response.StatusOK)
 
 	w.DeleteHeader("content-length")
 	w.AddHeader("transfer-encoding", "chunked")
-	w.AddHeader("trailer", "X-Content-SHA256, X-Content-Length")
+	// Only announce trailers to clients that said they can handle them
+	if w.AcceptsTrailers() {
+		w.AddHeader("trailer", "X-Content-SHA256, X-Content-Length")
+	}
 	w.WriteHeaders()
 
-	rawBody := []byte{}
+	defer reader.Close()
+	// One buffer serves every read, WriteChunkedBody frames a copy of what
+	// it is given. The hash and length are worked out as the body goes by
+	// rather than from a copy of it, which could be larger than memory
+	data := make([]byte, bufferSize)
+	hash := sha256.New()
+	var length int64
 
 	for {
-		data := make([]byte, 32)
 		n, err := reader.Read(data)
-		defer reader.Close()
-		if err != nil {
+		// Data can come along with an error, and an empty read must not go
+		// out as a chunk since a zero-length chunk ends the body
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(data[:n]); werr != nil {
+				break
+			}
+			hash.Write(data[:n])
+			length += int64(n)
+		}
+		if err == io.EOF {
 			break
 		}
-		_, err = w.WriteChunkedBody(data[:n])
 		if err != nil {
-			break
+			// Ending the body normally would pass the truncated data off as
+			// complete
+			fmt.Println("Stream aborted:", err)
+			w.Abort()
+			return
 		}
-		rawBody = append(rawBody, data[:n]...)
 	}
 
+	// An empty source ends up here too, as a body of just the last chunk,
+	// with trailers describing zero bytes
 	trailers := headers.NewHeaders()
-	hash := sha256.Sum256(rawBody)
-	trailers.Set("X-Content-SHA256", bytesToStr(hash[:]))
-	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(rawBody)))
+	if w.AcceptsTrailers() {
+		trailers.Set("X-Content-SHA256", bytesToStr(hash.Sum(nil)))
+		trailers.Set("X-Content-Length", fmt.Sprintf("%d", length))
+	}
 
 	w.WriteChunkedBodyDone(trailers)
 	fmt.Println("Request successfully actioned and response sent")
@@ -0,0 +1,155 @@
+// Package http1 is the public face of the HTTP/1.1 building blocks this
+// module's server is made of: a request parser, a response writer and a
+// header map. They can be used on their own, e.g. to parse requests read off
+// any io.Reader or to write responses to any io.Writer, without the server.
+//
+// The types are aliases of the internal ones, so values move freely between
+// this package and code built on the server.
+package http1
+
+import (
+	"io"
+
+	"github.com/noelw19/tcptohttp/internal/headers"
+	"github.com/noelw19/tcptohttp/internal/request"
+	"github.com/noelw19/tcptohttp/internal/response"
+)
+
+// Request is a parsed HTTP/1.1 request.
+type Request = request.Request
+
+// RequestLine is the method, target and version of a request.
+type RequestLine = request.RequestLine
+
+// Options tunes how RequestFromReaderWithOptions reads a request.
+type Options = request.Options
+
+// Writer writes an HTTP/1.1 response, enforcing the order of status line,
+// headers and body.
+type Writer = response.Writer
+
+// StatusCode is an HTTP response status code.
+type StatusCode = response.StatusCode
+
+// Headers is a header map with case-insensitive keys.
+type Headers = headers.Headers
+
+// Errors returned while parsing a request.
+var (
+	ErrBadStartLine       = request.ErrBadStartLine
+	ErrBadRequestTarget   = request.ErrBadRequestTarget
+	ErrRequestTimeout     = request.ErrRequestTimeout
+	ErrMissingHost        = request.ErrMissingHost
+	ErrDuplicateHost      = request.ErrDuplicateHost
+	ErrUnsupportedVersion = request.ErrUnsupportedVersion
+	ErrBadContentLength   = request.ErrBadContentLength
+	ErrIncompleteRequest  = request.ErrIncompleteRequest
+	ErrBadChunk           = request.ErrBadChunk
+	ErrURITooLong         = request.ErrURITooLong
+	ErrHeadTooLarge       = request.ErrHeadTooLarge
+	ErrInvalidHeader      = headers.ErrInvalidHeader
+	ErrHeaderLineTooLong  = headers.ErrHeaderLineTooLong
+	ErrBareLF             = headers.ErrBareLF
+	ErrBareCR             = headers.ErrBareCR
+)
+
+// RequestFromReader reads and parses a single request from reader.
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return request.RequestFromReader(reader)
+}
+
+// RequestFromReaderWithOptions reads a single request from reader like
+// RequestFromReader, applying opts while doing so.
+func RequestFromReaderWithOptions(reader io.Reader, opts Options) (*Request, error) {
+	return request.RequestFromReaderWithOptions(reader, opts)
+}
+
+// NewResponseWriter returns a Writer sending its response to w.
+func NewResponseWriter(w io.Writer) *Writer {
+	return response.NewResponseWriter(w)
+}
+
+// NewHeaders returns an empty header map.
+func NewHeaders() Headers {
+	return headers.NewHeaders()
+}
+
+// StatusText returns the reason phrase for code, e.g. "Not Found" for 404.
+func StatusText(code StatusCode) string {
+	return response.GetStatusReason(code)
+}
+
+// Status codes
+const (
+	// 1xx - Informational
+	StatusContinue           = response.StatusContinue
+	StatusSwitchingProtocols = response.StatusSwitchingProtocols
+	StatusProcessing         = response.StatusProcessing
+	StatusEarlyHints         = response.StatusEarlyHints
+
+	// 2xx - Success
+	StatusOK                   = response.StatusOK
+	StatusCreated              = response.StatusCreated
+	StatusAccepted             = response.StatusAccepted
+	StatusNonAuthoritativeInfo = response.StatusNonAuthoritativeInfo
+	StatusNoContent            = response.StatusNoContent
+	StatusResetContent         = response.StatusResetContent
+	StatusPartialContent       = response.StatusPartialContent
+	StatusMultiStatus          = response.StatusMultiStatus
+	StatusAlreadyReported      = response.StatusAlreadyReported
+	StatusIMUsed               = response.StatusIMUsed
+
+	// 3xx - Redirection
+	StatusMultipleChoices   = response.StatusMultipleChoices
+	StatusMovedPermanently  = response.StatusMovedPermanently
+	StatusFound             = response.StatusFound
+	StatusSeeOther          = response.StatusSeeOther
+	StatusNotModified       = response.StatusNotModified
+	StatusUseProxy          = response.StatusUseProxy
+	StatusTemporaryRedirect = response.StatusTemporaryRedirect
+	StatusPermanentRedirect = response.StatusPermanentRedirect
+
+	// 4xx - Client Error
+	StatusBadRequest                  = response.StatusBadRequest
+	StatusUnauthorized                = response.StatusUnauthorized
+	StatusPaymentRequired             = response.StatusPaymentRequired
+	StatusForbidden                   = response.StatusForbidden
+	StatusNotFound                    = response.StatusNotFound
+	StatusMethodNotAllowed            = response.StatusMethodNotAllowed
+	StatusNotAcceptable               = response.StatusNotAcceptable
+	StatusProxyAuthRequired           = response.StatusProxyAuthRequired
+	StatusRequestTimeout              = response.StatusRequestTimeout
+	StatusConflict                    = response.StatusConflict
+	StatusGone                        = response.StatusGone
+	StatusLengthRequired              = response.StatusLengthRequired
+	StatusPreconditionFailed          = response.StatusPreconditionFailed
+	StatusPayloadTooLarge             = response.StatusPayloadTooLarge
+	StatusURITooLong                  = response.StatusURITooLong
+	StatusUnsupportedMediaType        = response.StatusUnsupportedMediaType
+	StatusRangeNotSatisfiable         = response.StatusRangeNotSatisfiable
+	StatusExpectationFailed           = response.StatusExpectationFailed
+	StatusImATeapot                   = response.StatusImATeapot
+	StatusMisdirectedRequest          = response.StatusMisdirectedRequest
+	StatusUnprocessableEntity         = response.StatusUnprocessableEntity
+	StatusLocked                      = response.StatusLocked
+	StatusFailedDependency            = response.StatusFailedDependency
+	StatusTooEarly                    = response.StatusTooEarly
+	StatusUpgradeRequired             = response.StatusUpgradeRequired
+	StatusPreconditionRequired        = response.StatusPreconditionRequired
+	StatusTooManyRequests             = response.StatusTooManyRequests
+	StatusRequestHeaderFieldsTooLarge = response.StatusRequestHeaderFieldsTooLarge
+	StatusUnavailableForLegalReasons  = response.StatusUnavailableForLegalReasons
+
+	// 5xx - Server Error
+	StatusInternalServerError     = response.StatusInternalServerError
+	StatusNotImplemented          = response.StatusNotImplemented
+	StatusBadGateway              = response.StatusBadGateway
+	StatusServiceUnavailable      = response.StatusServiceUnavailable
+	StatusGatewayTimeout          = response.StatusGatewayTimeout
+	StatusHTTPVersionNotSupported = response.StatusHTTPVersionNotSupported
+	StatusVariantAlsoNegotiates   = response.StatusVariantAlsoNegotiates
+	StatusInsufficientStorage     = response.StatusInsufficientStorage
+	StatusLoopDetected            = response.StatusLoopDetected
+	StatusNotExtended             = response.StatusNotExtended
+	StatusNetworkAuthRequired     = response.StatusNetworkAuthRequired
+)
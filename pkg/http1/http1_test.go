@@ -0,0 +1,51 @@
+package http1_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/noelw19/tcptohttp/pkg/http1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAndRespond(t *testing.T) {
+	raw := "POST /notes?draft=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"
+	req, err := http1.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	assert.Equal(t, "POST", req.RequestLine.Method)
+	assert.Equal(t, "/notes", req.Path())
+	assert.Equal(t, "1", req.Params["draft"])
+	assert.Equal(t, "example.com", req.Headers.Get("Host"))
+	assert.Equal(t, "hello", string(req.Body))
+
+	buf := &bytes.Buffer{}
+	w := http1.NewResponseWriter(buf)
+	w.SetDefaultHeaders(false)
+	w.ReplaceHeader("x-note-id", "7")
+	w.Respond(http1.StatusCreated, []byte("saved"))
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, out, "X-Note-Id: 7\r\n")
+	assert.Equal(t, "Created", http1.StatusText(http1.StatusCreated))
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := http1.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, http1.ErrMissingHost)
+
+	_, err = http1.RequestFromReader(strings.NewReader("GET / HTTP/1.1\nHost: a\n\n"))
+	require.ErrorIs(t, err, http1.ErrBareLF)
+
+	req, err := http1.RequestFromReaderWithOptions(strings.NewReader("GET / HTTP/1.1\nHost: a\n\n"), http1.Options{AllowBareLF: true})
+	require.NoError(t, err)
+	assert.Equal(t, "a", req.Host)
+}
+
+func TestHeaders(t *testing.T) {
+	h := http1.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	assert.Equal(t, "text/plain", h.Get("content-type"))
+}